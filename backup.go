@@ -0,0 +1,252 @@
+package godb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	bakMagic   = "godb.bak" // identifies a backup image
+	bakVersion = 1          // current backup image format version
+	bakHdr     = 22         // magic (8) + version (2) + page size (4) + page count (8)
+	bakChunk   = 64         // pages copied each time the store is locked
+)
+
+// a backup image is a header, followed by every page of the data
+// file as it was when the backup started, followed by a crc32c
+// checksum of all of the pages. the index, free page map and the
+// write-ahead log are not part of the image; they are rebuilt
+// from the data file when a restored collection is first opened.
+//
+//	[0:8]   magic number
+//	[8:10]  format version
+//	[10:14] page size
+//	[14:22] page count
+
+// ErrBadBackup is returned when restoring an image that is not a
+// complete, intact godb backup image
+var ErrBadBackup = errors.New("restore: not a complete godb backup image")
+
+// snapshot is a point-in-time image of the data file, taken by a
+// backup. the pages of the data file are not copied when it is
+// taken; instead, the first time a page is written to while the
+// snapshot is held its original contents are saved, so the pages
+// of the image can be read back one at a time as writes go on.
+type snapshot struct {
+	ngin  *engine        // engine the snapshot was taken of
+	page  int            // page size of the data file
+	pages int            // number of pages in the image
+	saved map[int][]byte // original contents of pages written since
+}
+
+// take a snapshot of the data file
+func (e *engine) snapshot() *snapshot {
+	s := &snapshot{
+		ngin:  e,
+		page:  e.page,
+		pages: e.dev.size() / e.page,
+		saved: make(map[int][]byte),
+	}
+	e.snaps = append(e.snaps, s)
+	return s
+}
+
+// release a snapshot, so writes no longer save pages for it
+func (e *engine) release(s *snapshot) {
+	for i := range e.snaps {
+		if e.snaps[i] == s {
+			e.snaps = append(e.snaps[:i], e.snaps[i+1:]...)
+			return
+		}
+	}
+}
+
+// touch saves the original contents of the run of n pages at page k
+// for any snapshot being taken; it must be called before they change
+func (e *engine) touch(k, n int) {
+	for _, s := range e.snaps {
+		for i := k; i < k+n && i < s.pages; i++ {
+			if _, ok := s.saved[i]; ok {
+				continue
+			}
+			p := make([]byte, e.page)
+			if (i+1)*e.page <= e.dev.size() {
+				copy(p, e.dev.slice(i*e.page, e.page))
+			}
+			s.saved[i] = p
+		}
+	}
+}
+
+// read the image of up to n pages starting at page k into b
+func (s *snapshot) read(k, n int, b []byte) []byte {
+	e := s.ngin
+	b = b[:0]
+	for i := k; i < k+n && i < s.pages; i++ {
+		switch p, ok := s.saved[i]; {
+		case ok:
+			b = append(b, p...)
+		case (i+1)*s.page <= e.dev.size():
+			b = append(b, e.dev.slice(i*s.page, s.page)...)
+		default:
+			// truncated away since, so it was empty to begin with
+			b = append(b, make([]byte, s.page)...)
+		}
+	}
+	return b
+}
+
+// backup streams a point-in-time image of the store to w. the store
+// is only locked (by mu) long enough to take the snapshot and then to
+// copy a few pages at a time, so writers can keep going meanwhile.
+func backup(st *store, mu *sync.RWMutex, w io.Writer) error {
+	mu.Lock()
+	s := st.idx.ngin.snapshot()
+	mu.Unlock()
+	defer s.release(mu)
+	return s.write(mu, w)
+}
+
+// release the snapshot, locking its store (by mu) while it does
+func (s *snapshot) release(mu *sync.RWMutex) {
+	mu.Lock()
+	s.ngin.release(s)
+	mu.Unlock()
+}
+
+// write the backup image of the snapshot to w, read locking its store
+// (by mu) while each few pages are read
+func (s *snapshot) write(mu *sync.RWMutex, w io.Writer) error {
+	hdr := make([]byte, bakHdr)
+	copy(hdr[0:8], bakMagic)
+	binary.BigEndian.PutUint16(hdr[8:10], bakVersion)
+	binary.BigEndian.PutUint32(hdr[10:14], uint32(s.page))
+	binary.BigEndian.PutUint64(hdr[14:22], uint64(s.pages))
+	if _, err := w.Write(hdr); err != nil {
+		return fmt.Errorf("backup: error writing header -> %s", err)
+	}
+	sum := crc32.New(castagnoli)
+	b := make([]byte, 0, bakChunk*s.page)
+	for k := 0; k < s.pages; k += bakChunk {
+		mu.RLock()
+		b = s.read(k, bakChunk, b)
+		mu.RUnlock()
+		sum.Write(b)
+		if _, err := w.Write(b); err != nil {
+			return fmt.Errorf("backup: error writing pages -> %s", err)
+		}
+	}
+	if _, err := w.Write(sum.Sum(nil)); err != nil {
+		return fmt.Errorf("backup: error writing checksum -> %s", err)
+	}
+	return nil
+}
+
+// Backup writes a point-in-time consistent image of the collection
+// to w, while other reads and writes carry on. the image can be
+// given to Restore to bring the collection back to that point. blobs
+// are kept in a store of their own, and are not part of the image.
+func (c *Collection) Backup(w io.Writer) error {
+	return logger(backup(c.st, &c.RWMutex, w))
+}
+
+// Restore replaces the collection at path with a backup image read
+// from r. the whole image is read and checked before anything is
+// replaced, and ErrBadBackup is returned if it is not intact. it is
+// an offline operation; the collection must not be open while it is
+// restored. an encrypted collection's image stays encrypted, and the
+// restored collection is opened with the key it was backed up with.
+func Restore(path string, r io.Reader) error {
+	tmp := path + `.restore.db`
+	if err := restore(tmp, bufio.NewReader(r)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return replace(path, tmp)
+}
+
+// replace the collection at path with the data file restored to tmp
+func replace(path, tmp string) error {
+	// refuse to replace a collection that is open
+	if fd, err := os.OpenFile(path+`.db`, os.O_RDWR, 0); err == nil {
+		defer fd.Close()
+		if err := lockFile(fd, false); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	// everything but the data file is rebuilt from it, and the log
+	// must not be replayed on top of the restored data
+	for _, ext := range []string{`.idx`, `.fm`, `.wal`} {
+		if err := os.Remove(path + ext); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, path+`.db`)
+}
+
+// read a backup image from br into a new data file at path, checking
+// it. no more than the image is read from br, so another can follow it.
+func restore(path string, br *bufio.Reader) error {
+	hdr := make([]byte, bakHdr)
+	if _, err := io.ReadFull(br, hdr); err != nil || string(hdr[0:8]) != bakMagic {
+		return ErrBadBackup
+	}
+	if v := binary.BigEndian.Uint16(hdr[8:10]); v != bakVersion {
+		return fmt.Errorf("restore: unsupported backup version %d (expected %d)", v, bakVersion)
+	}
+	page := int(binary.BigEndian.Uint32(hdr[10:14]))
+	pages := int(binary.BigEndian.Uint64(hdr[14:22]))
+	if page < 512 || page&(page-1) != 0 || pages < 1 {
+		return ErrBadBackup
+	}
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	sum := crc32.New(castagnoli)
+	b := make([]byte, page)
+	for k := 0; k < pages; k++ {
+		if _, err := io.ReadFull(br, b); err != nil {
+			return ErrBadBackup
+		}
+		sum.Write(b)
+		if k == 0 {
+			if err := checkSuper(b, page); err != nil {
+				return err
+			}
+			// the image was taken while the collection was open
+			binary.BigEndian.PutUint32(b[22:26], binary.BigEndian.Uint32(b[22:26])&^sbOpen)
+		}
+		if _, err := fd.Write(b); err != nil {
+			return err
+		}
+	}
+	tail := make([]byte, 4)
+	if _, err := io.ReadFull(br, tail); err != nil || binary.BigEndian.Uint32(tail) != sum.Sum32() {
+		return ErrBadBackup
+	}
+	return fd.Sync()
+}
+
+// check the superblock at the start of page 0 of a backup image
+func checkSuper(b []byte, page int) error {
+	if string(b[0:8]) != sbMagic {
+		return ErrBadBackup
+	}
+	if v := binary.BigEndian.Uint16(b[8:10]); v != sbVersion {
+		return fmt.Errorf("restore: unsupported format version %d (expected %d)", v, sbVersion)
+	}
+	if int(binary.BigEndian.Uint32(b[10:14])) != page {
+		return ErrBadBackup
+	}
+	return nil
+}
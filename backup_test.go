@@ -0,0 +1,172 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hookWriter calls fn once, after the first write to it
+type hookWriter struct {
+	bytes.Buffer
+	fn func()
+}
+
+func (w *hookWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	if w.fn != nil {
+		w.fn()
+		w.fn = nil
+	}
+	return n, err
+}
+
+// test that a backup holds the collection as it was when the backup
+// started, whatever is written while it runs, and restores to that
+func Test_Backup_Restore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup")
+	c := openTestCollection(t, path)
+	val := func(i int) string { return strings.Repeat(fmt.Sprint(i), 50) }
+	for i := 0; i < 1000; i++ {
+		c.Add(i, val(i))
+	}
+	w := &hookWriter{fn: func() {
+		for i := 0; i < 1000; i += 3 {
+			c.Set(i, "changed")
+		}
+		for i := 1; i < 1000; i += 3 {
+			c.Del(i)
+		}
+		for i := 1000; i < 3000; i++ {
+			c.Add(i, strings.Repeat("n", 3000))
+		}
+		c.Compact()
+	}}
+	if err := c.Backup(w); err != nil {
+		t.Fatalf("backing up: %s\n", err)
+	}
+	if err := Restore(path, bytes.NewReader(w.Bytes())); err != ErrLocked {
+		t.Fatalf("expected ErrLocked restoring over an open collection, got: %v\n", err)
+	}
+	n := c.Count()
+	c.Close()
+
+	img := w.Bytes()
+	bad := append([]byte{}, img...)
+	bad[len(bad)/2] ^= 0x01
+	if err := Restore(path, bytes.NewReader(bad)); err != ErrBadBackup {
+		t.Fatalf("expected ErrBadBackup, got: %v\n", err)
+	}
+	if err := Restore(path, bytes.NewReader(img[:len(img)-10])); err != ErrBadBackup {
+		t.Fatalf("expected ErrBadBackup, got: %v\n", err)
+	}
+	c = openTestCollection(t, path)
+	if c.Count() != n {
+		t.Fatalf("expected a bad image to change nothing, got: %d records\n", c.Count())
+	}
+	c.Close()
+	if err := Restore(path, bytes.NewReader(img)); err != nil {
+		t.Fatalf("restoring: %s\n", err)
+	}
+	c = openTestCollection(t, path)
+	defer c.Close()
+	if c.Count() != 1000 {
+		t.Fatalf("expected 1000 records, got: %d\n", c.Count())
+	}
+	for i := 0; i < 1000; i++ {
+		var s string
+		if err := c.Get(i, &s); err != nil || s != val(i) {
+			t.Fatalf("expected %q for %d, got: %q, %v\n", val(i), i, s, err)
+		}
+	}
+}
+
+// test that an encrypted collection's backup stays encrypted, and
+// restores to a collection opened with the same key
+func Test_Backup_Encrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup")
+	key := bytes.Repeat([]byte{7}, 16)
+	c := openTestCollection(t, path, WithEncryption(key))
+	c.Set("a", "SECRETNAME")
+	var img bytes.Buffer
+	if err := c.Backup(&img); err != nil {
+		t.Fatalf("backing up: %s\n", err)
+	}
+	c.Close()
+	if bytes.Contains(img.Bytes(), []byte("SECRETNAME")) {
+		t.Fatalf("expected nothing in the clear in the image\n")
+	}
+	if err := Restore(path, &img); err != nil {
+		t.Fatalf("restoring: %s\n", err)
+	}
+	c = openTestCollection(t, path, WithEncryption(key))
+	defer c.Close()
+	var s string
+	if err := c.Get("a", &s); err != nil || s != "SECRETNAME" {
+		t.Fatalf("expected %q, got: %q, %v\n", "SECRETNAME", s, err)
+	}
+}
+
+// the nonces sealing the records under keys in c, by page and
+// sequence number
+func recordNonces(t *testing.T, c *Collection, keys []string) map[[2]uint64]string {
+	e := c.st.idx.ngin.(*engine)
+	blks, err := c.st.blocks()
+	if err != nil {
+		t.Fatalf("listing blocks: %s\n", err)
+	}
+	nonces := make(map[[2]uint64]string)
+	for _, key := range keys {
+		k, _ := genKey(key)
+		for _, blk := range blks {
+			if string(blk.key) == string(k) {
+				seq := binary.BigEndian.Uint64(e.dev.slice(blk.pos*e.page+pgHdr, sealHdr))
+				nonces[[2]uint64{uint64(blk.pos), seq}] = key
+			}
+		}
+	}
+	return nonces
+}
+
+// test that two copies restored from the same image of an encrypted
+// collection never seal their own writes under the same nonce
+func Test_Backup_Nonces(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 16)
+	c := openTestCollection(t, filepath.Join(dir, "orig"), WithEncryption(key))
+	c.Set("a", "a")
+	var img bytes.Buffer
+	if err := c.Backup(&img); err != nil {
+		t.Fatalf("backing up: %s\n", err)
+	}
+	c.Close()
+	var keys []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprint("k", i))
+	}
+	seen := make(map[[2]uint64]string)
+	for _, name := range []string{"one", "two"} {
+		path := filepath.Join(dir, name)
+		if err := Restore(path, bytes.NewReader(img.Bytes())); err != nil {
+			t.Fatalf("restoring %s: %s\n", name, err)
+		}
+		c := openTestCollection(t, path, WithEncryption(key))
+		// the same keys, and so the same pages, but different values
+		for _, k := range keys {
+			c.Set(k, name+k)
+		}
+		for nonce := range recordNonces(t, c, keys) {
+			if _, ok := seen[nonce]; ok {
+				t.Fatalf("expected no nonce to be used by both copies, got: %v\n", nonce)
+			}
+			seen[nonce] = name
+		}
+		c.Close()
+	}
+	if len(seen) != 2*len(keys) {
+		t.Fatalf("expected %d nonces, got: %d\n", 2*len(keys), len(seen))
+	}
+}
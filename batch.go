@@ -0,0 +1,209 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Batch collects Add, Set and Del operations to be applied to a
+// collection together by Collection.Apply. the zero value is an
+// empty batch, ready to use.
+type Batch struct {
+	ops []batchOp
+}
+
+// an operation waiting in a batch
+type batchOp struct {
+	op  byte
+	key interface{}
+	val interface{}
+}
+
+// Add adds val under key when the batch is applied, failing the whole
+// batch if key already exists
+func (b *Batch) Add(key, val interface{}) {
+	b.ops = append(b.ops, batchOp{walAdd, key, val})
+}
+
+// Set sets val under key when the batch is applied
+func (b *Batch) Set(key, val interface{}) {
+	b.ops = append(b.ops, batchOp{walSet, key, val})
+}
+
+// Del deletes key when the batch is applied, failing the whole batch
+// if key does not exist
+func (b *Batch) Del(key interface{}) {
+	b.ops = append(b.ops, batchOp{walDel, key, nil})
+}
+
+// Len returns the number of operations in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch, so it can be used again
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Apply applies every operation in b to the collection, in order, all
+// or nothing. every key and value is encoded and checked first, along
+// with each Add (which must not find its key) and Del (which must),
+// taking the operations before it in the batch into account. if any
+// of them fail nothing is applied. otherwise the batch is written to
+// the log as a single entry and applied while the collection is
+// locked, so no reader ever sees it half applied, and after a crash
+// it is either replayed in full or not at all.
+func (c *Collection) Apply(b *Batch) error {
+	ents := make([]*walEntry, len(b.ops))
+	for i, op := range b.ops {
+		ent := &walEntry{op: op.op}
+		var err error
+		if op.op == walDel {
+			ent.key, err = c.genKey(op.key)
+		} else {
+			ent.key, ent.val, err = c.boundscheck(op.key, op.val)
+		}
+		if err != nil {
+			return logger(fmt.Errorf("collection: error in batch operation %d (%s)", i, err))
+		}
+		ents[i] = ent
+	}
+	c.Lock()
+	seq, err := c.st.apply(ents)
+	c.Unlock()
+	if err == nil {
+		err = c.st.wait(seq)
+	}
+	return logger(err)
+}
+
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//			APPLY			//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+// check a batch of entries against the index, then log and apply them
+func (s *store) apply(ents []*walEntry) (uint64, error) {
+	if err := s.precheck(ents); err != nil {
+		return 0, err
+	}
+	return s.commit(s.stamp(ents))
+}
+
+// check that every add in a batch of entries is of a key that won't
+// exist yet, and every del of one that will, and that every val fits
+// in a record
+func (s *store) precheck(ents []*walEntry) error {
+	if s.ro {
+		return ErrReadOnly
+	}
+	if s.err != nil {
+		return s.err
+	}
+	// whether each key will exist once the entries before it are applied
+	live := make(map[string]bool)
+	exists := func(key []byte) (bool, error) {
+		if ok, seen := live[string(key)]; seen {
+			return ok, nil
+		}
+		return s.idx.live(key)
+	}
+	for i, ent := range ents {
+		if ent.op == walAdd || ent.op == walSet {
+			if err := verify(ent.key, ent.val, s.idx.ngin.maxValSize()); err != nil {
+				return fmt.Errorf("store[precheck]: error in operation %d -> %q", i, err)
+			}
+		}
+		switch ent.op {
+		case walAdd:
+			ok, err := exists(ent.key)
+			if err != nil {
+				return fmt.Errorf("store[precheck]: error while checking key in operation %d -> %q", i, err)
+			}
+			if ok {
+				return fmt.Errorf("store[precheck]: key already exists in operation %d, not applying batch", i)
+			}
+			live[string(ent.key)] = true
+		case walSet:
+			live[string(ent.key)] = true
+		case walDel:
+			ok, err := exists(ent.key)
+			if err != nil {
+				return fmt.Errorf("store[precheck]: error while checking key in operation %d -> %q", i, err)
+			}
+			if !ok {
+				return fmt.Errorf("store[precheck]: key does not exist in operation %d, not applying batch", i)
+			}
+			live[string(ent.key)] = false
+		}
+	}
+	return nil
+}
+
+// give each add and set in a batch of entries the next version, in
+// the form they are logged in
+func (s *store) stamp(ents []*walEntry) []*walEntry {
+	ver := s.idx.ngin.version()
+	out := make([]*walEntry, len(ents))
+	for i, ent := range ents {
+		out[i] = ent
+		if ent.op != walDel {
+			ver++
+			out[i] = &walEntry{ent.op, ent.key, setEntryVal(ver, 0, ent.val)}
+		}
+	}
+	return out
+}
+
+// log a batch of stamped entries as a single entry, then apply them.
+// an add is applied as a set, so the batch can be applied again (when
+// a transaction is replayed) and end up the same.
+func (s *store) commit(ents []*walEntry) (uint64, error) {
+	if s.ro {
+		return 0, ErrReadOnly
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if len(ents) == 0 {
+		return 0, nil
+	}
+	seq, err := s.log.log(walBat, nil, encodeBatch(ents))
+	if err != nil {
+		return 0, fmt.Errorf("store[commit]: error while writing to log -> %q", err)
+	}
+	for _, ent := range ents {
+		// an error here leaves the batch half applied until the log
+		// is replayed, the next time the store is opened
+		if err := ent.apply(s.idx); err != nil {
+			return 0, fmt.Errorf("store[commit]: error while applying batch to index -> %q", err)
+		}
+	}
+	return seq, s.checkpoint()
+}
+
+// encode the entries of a batch one after another
+func encodeBatch(ents []*walEntry) []byte {
+	var b []byte
+	for _, ent := range ents {
+		b = append(b, ent.encode()...)
+	}
+	return b
+}
+
+// decode the entries of a batch
+func decodeBatch(b []byte) ([]*walEntry, error) {
+	var ents []*walEntry
+	for len(b) > 0 {
+		if len(b) < walHdr {
+			return nil, fmt.Errorf("short batch entry")
+		}
+		n := walHdr + int(binary.BigEndian.Uint32(b[1:5])) + int(binary.BigEndian.Uint32(b[5:9]))
+		if n > len(b) || binary.BigEndian.Uint32(b[9:13]) != walChecksum(b[:n]) {
+			return nil, fmt.Errorf("bad batch entry")
+		}
+		klen := walHdr + int(binary.BigEndian.Uint32(b[1:5]))
+		ents = append(ents, &walEntry{op: b[0], key: b[walHdr:klen], val: b[klen:n]})
+		b = b[n:]
+	}
+	return ents, nil
+}
@@ -0,0 +1,101 @@
+package godb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// report whether the collection has a record for key
+func hasKey(c *Collection, key interface{}) bool {
+	var v interface{}
+	return c.Get(key, &v) == nil
+}
+
+// test that a batch is applied in full, in order, or not at all
+func Test_Batch_Apply(t *testing.T) {
+	c := openTestCollection(t, "batch", WithBackend(Memory))
+	defer c.Close()
+	c.Add("a", "a")
+	var b Batch
+	b.Add("b", "b")
+	b.Set("a", "a2")
+	b.Add("a", "dup") // fails; a exists
+	if err := c.Apply(&b); err == nil {
+		t.Fatalf("expected adding an existing key to fail the batch\n")
+	}
+	var s string
+	if c.Get("a", &s); s != "a" || hasKey(c, "b") || c.Count() != 1 {
+		t.Fatalf("expected nothing to be applied, got: a = %q, %d records\n", s, c.Count())
+	}
+	b.Reset()
+	if b.Len() != 0 {
+		t.Fatalf("expected an empty batch, got: %d writes\n", b.Len())
+	}
+	// each write sees the ones before it
+	b.Del("a")
+	b.Add("a", "a3")
+	b.Add("b", "b")
+	b.Del("b")
+	b.Set("c", "c")
+	if err := c.Apply(&b); err != nil {
+		t.Fatalf("applying: %s\n", err)
+	}
+	if c.Get("a", &s); s != "a3" || hasKey(c, "b") || !hasKey(c, "c") || c.Count() != 2 {
+		t.Fatalf("expected a3 and c, got: a = %q, %d records\n", s, c.Count())
+	}
+	b.Reset()
+	b.Set("d", "d")
+	b.Del("missing")
+	if err := c.Apply(&b); err == nil {
+		t.Fatalf("expected deleting a missing key to fail the batch\n")
+	}
+	if hasKey(c, "d") {
+		t.Fatalf("expected nothing to be applied\n")
+	}
+}
+
+// test that entries survive being encoded into a batch and back
+func Test_Batch_Encode(t *testing.T) {
+	ents := []*walEntry{
+		{walSet, []byte("a"), setEntryVal(1, 0, []byte("one"))},
+		{walDel, []byte("b"), nil},
+	}
+	got, err := decodeBatch(encodeBatch(ents))
+	if err != nil || len(got) != len(ents) {
+		t.Fatalf("expected %d entries, got: %d, %v\n", len(ents), len(got), err)
+	}
+	for i := range ents {
+		if got[i].op != ents[i].op || !bytes.Equal(got[i].key, ents[i].key) || !bytes.Equal(got[i].val, ents[i].val) {
+			t.Fatalf("expected entry %d to be %v, got: %v\n", i, ents[i], got[i])
+		}
+	}
+	b := encodeBatch(ents)
+	if _, err := decodeBatch(b[:len(b)-1]); err == nil {
+		t.Fatalf("expected a short batch to fail to decode\n")
+	}
+}
+
+// test that a batch logged before a crash is replayed whole, and one
+// only partly logged is thrown away whole
+func Test_Batch_Crash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch")
+	c := openTestCollection(t, path)
+	c.Add("c", "c")
+	x, xv, _ := encodeKeyVal("x", "x")
+	y, yv, _ := encodeKeyVal("y", "y")
+	k, _ := genKey("c")
+	ents := c.st.stamp([]*walEntry{{walSet, x, xv}, {walDel, k, nil}})
+	if _, err := c.st.log.log(walBat, nil, encodeBatch(ents)); err != nil {
+		t.Fatalf("logging: %s\n", err)
+	}
+	torn := (&walEntry{walBat, nil, encodeBatch(c.st.stamp([]*walEntry{{walSet, y, yv}}))}).encode()
+	c.st.log.file.WriteAt(torn[:len(torn)-3], c.st.log.size)
+	crashCollection(c)
+
+	c = openTestCollection(t, path)
+	defer c.Close()
+	if !hasKey(c, "x") || hasKey(c, "c") || hasKey(c, "y") || c.Count() != 1 {
+		t.Fatalf("expected just x, got: %d records\n", c.Count())
+	}
+}
@@ -0,0 +1,389 @@
+package godb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	blobChunk = 60 * KB // bytes of a blob held by each chunk record
+	blobHead  = 24      // id (8) + size (8) + chunk count (8)
+)
+
+// ErrNoBlob is returned when there is no blob stored under a key
+var ErrNoBlob = errors.New("blob: no blob stored under key")
+
+// ErrBlobClosed is returned when a blob is read after it (or the
+// collection it is in) has been closed
+var ErrBlobClosed = errors.New("blob: blob has been closed")
+
+// blobs are kept out of line, in a store of their own alongside the
+// collection (path + `.blob`), so large values are never read into
+// memory whole or pushed through msgpack. each blob is written as a
+// series of chunk records, keyed by a blob id and the chunk's number.
+// a head record, keyed by the blob's own key, holds the id, size and
+// number of chunks of the blob. a new blob is written under a new id
+// and only replaces the old one once it is complete, so a reader never
+// sees a blob half written.
+//
+// chunk keys start with a zero byte, which no encoded key does, so
+// they can't collide with a head record. the next unused blob id is
+// kept in a record keyed by the zero byte alone.
+var blobNextKey = []byte{0x00}
+
+// key of chunk n of blob id
+func blobChunkKey(id uint64, n int) []byte {
+	k := make([]byte, 17)
+	binary.BigEndian.PutUint64(k[1:9], id)
+	binary.BigEndian.PutUint64(k[9:17], uint64(n))
+	return k
+}
+
+// a blob's head record
+type blobInfo struct {
+	id     uint64
+	size   int64
+	chunks int
+}
+
+func (b *blobInfo) encode() []byte {
+	v := make([]byte, blobHead)
+	binary.BigEndian.PutUint64(v[0:8], b.id)
+	binary.BigEndian.PutUint64(v[8:16], uint64(b.size))
+	binary.BigEndian.PutUint64(v[16:24], uint64(b.chunks))
+	return v
+}
+
+// read the head record for key from the blob store
+func readBlobInfo(st *store, key []byte) (*blobInfo, error) {
+	ok, err := st.idx.has(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNoBlob
+	}
+	v, err := st.idx.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != blobHead {
+		return nil, fmt.Errorf("blob: invalid head record (%d bytes)", len(v))
+	}
+	return &blobInfo{
+		id:     binary.BigEndian.Uint64(v[0:8]),
+		size:   int64(binary.BigEndian.Uint64(v[8:16])),
+		chunks: int(binary.BigEndian.Uint64(v[16:24])),
+	}, nil
+}
+
+// open the collection's blob store, if it isn't open already. unless
+// create is set, ErrNoBlob is returned if there isn't one yet. the
+// collection must be locked. any chunks left behind by a blob that
+// was cut short are deleted as it is opened.
+func (c *Collection) openBlobs(create bool) (*store, error) {
+	if c.blobs != nil {
+		return c.blobs, nil
+	}
+	if !create || c.opts.readOnly {
+		if c.opts.backend == Memory {
+			return nil, ErrNoBlob
+		}
+		if _, err := os.Stat(c.dsn + `.blob.db`); os.IsNotExist(err) {
+			return nil, ErrNoBlob
+		}
+	}
+	o := *c.opts
+	st, err := openStore(c.dsn+`.blob`, &o)
+	if err != nil {
+		return nil, fmt.Errorf("blob: error opening blob store -> %s", err)
+	}
+	if !o.readOnly {
+		if err := sweepBlobs(st); err != nil {
+			st.close()
+			return nil, fmt.Errorf("blob: error sweeping blob store -> %s", err)
+		}
+	}
+	c.blobs = st
+	return st, nil
+}
+
+// open the collection's blob store for a reader. the collection is
+// left locked for reading if there is no error.
+func (c *Collection) readBlobs() (*store, error) {
+	c.RLock()
+	if c.blobs != nil {
+		return c.blobs, nil
+	}
+	c.RUnlock()
+	c.Lock()
+	_, err := c.openBlobs(false)
+	c.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// it may have been closed again in between
+	c.RLock()
+	if c.blobs == nil {
+		c.RUnlock()
+		return nil, ErrBlobClosed
+	}
+	return c.blobs, nil
+}
+
+// delete every chunk that doesn't belong to the blob of a head record.
+// they are left behind if a crash cuts PutBlob short before the new
+// blob is swapped in, or DeleteBlob (or PutBlob, replacing a blob)
+// short before the old one's chunks have all been deleted.
+func sweepBlobs(st *store) error {
+	heads := make(map[uint64]bool)
+	var chunks [][]byte
+	err := st.idx.scan(nil, func(key, val []byte) (bool, error) {
+		switch {
+		case len(key) == 17 && key[0] == 0x00:
+			chunks = append(chunks, append([]byte(nil), key...))
+		case len(key) > 0 && key[0] != 0x00 && len(val) == blobHead:
+			heads[binary.BigEndian.Uint64(val[0:8])] = true
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range chunks {
+		if heads[binary.BigEndian.Uint64(k[1:9])] {
+			continue
+		}
+		if _, err := st.del(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocate a new blob id
+func nextBlobID(st *store) (uint64, error) {
+	id := uint64(1)
+	ok, err := st.idx.has(blobNextKey)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		v, err := st.idx.get(blobNextKey)
+		if err != nil {
+			return 0, err
+		}
+		id = binary.BigEndian.Uint64(v)
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, id+1)
+	if _, err := st.set(blobNextKey, v, 0); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// delete the first n chunks of blob id
+func delBlobChunks(st *store, id uint64, n int) (uint64, error) {
+	var seq uint64
+	for i := 0; i < n; i++ {
+		k := blobChunkKey(id, i)
+		ok, err := st.idx.has(k)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		if seq, err = st.del(k); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// PutBlob stores everything read from r as the blob under key,
+// replacing any blob already stored under it. r is read and written
+// out a chunk at a time, and the collection is only locked while each
+// chunk is written, so a blob of any size can be stored without
+// holding it in memory or holding up other readers and writers. the
+// new blob replaces the old one only once it has been read in full.
+func (c *Collection) PutBlob(key interface{}, r io.Reader) error {
+	k, err := c.genKey(key)
+	if err != nil {
+		return logger(err)
+	}
+	if c.opts.readOnly {
+		return logger(ErrReadOnly)
+	}
+	c.Lock()
+	st, err := c.openBlobs(true)
+	var id uint64
+	if err == nil {
+		id, err = nextBlobID(st)
+	}
+	c.Unlock()
+	if err != nil {
+		return logger(err)
+	}
+	b := &blobInfo{id: id}
+	buf := make([]byte, blobChunk)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			c.Lock()
+			_, err := st.set(blobChunkKey(id, b.chunks), buf[:n], 0)
+			c.Unlock()
+			if err != nil {
+				rerr = err
+			} else {
+				b.chunks++
+				b.size += int64(n)
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			// throw away what was written of the new blob
+			c.Lock()
+			delBlobChunks(st, id, b.chunks+1)
+			c.Unlock()
+			return logger(fmt.Errorf("blob: error storing blob -> %s", rerr))
+		}
+	}
+	// swap the new blob in, then delete the one it replaces
+	c.Lock()
+	old, err := readBlobInfo(st, k)
+	if err == ErrNoBlob {
+		old, err = nil, nil
+	}
+	var seq uint64
+	if err == nil {
+		seq, err = st.set(k, b.encode(), 0)
+	}
+	if err == nil && old != nil {
+		var s uint64
+		if s, err = delBlobChunks(st, old.id, old.chunks); s > 0 {
+			seq = s
+		}
+	}
+	c.Unlock()
+	if err == nil {
+		// every chunk was logged before seq, so this covers them all
+		err = st.wait(seq)
+	}
+	return logger(err)
+}
+
+// GetBlob returns a reader for the blob stored under key, or ErrNoBlob
+// if there isn't one. the blob is read a chunk at a time as the reader
+// is read from. if the blob is replaced or deleted before the reader
+// has been read to the end, reading it fails.
+func (c *Collection) GetBlob(key interface{}) (io.ReadCloser, error) {
+	k, err := c.genKey(key)
+	if err != nil {
+		return nil, logger(err)
+	}
+	st, err := c.readBlobs()
+	if err == ErrNoBlob {
+		return nil, err
+	}
+	if err != nil {
+		return nil, logger(err)
+	}
+	b, err := readBlobInfo(st, k)
+	c.RUnlock()
+	if err == ErrNoBlob {
+		return nil, err
+	}
+	if err != nil {
+		return nil, logger(err)
+	}
+	return &blobReader{c: c, st: st, info: b}, nil
+}
+
+// DeleteBlob deletes the blob stored under key, or returns ErrNoBlob if
+// there isn't one
+func (c *Collection) DeleteBlob(key interface{}) error {
+	k, err := c.genKey(key)
+	if err != nil {
+		return logger(err)
+	}
+	if c.opts.readOnly {
+		return logger(ErrReadOnly)
+	}
+	c.Lock()
+	st, err := c.openBlobs(false)
+	var b *blobInfo
+	if err == nil {
+		b, err = readBlobInfo(st, k)
+	}
+	var seq uint64
+	if err == nil {
+		seq, err = st.del(k)
+	}
+	if err == nil {
+		var s uint64
+		if s, err = delBlobChunks(st, b.id, b.chunks); s > 0 {
+			seq = s
+		}
+	}
+	c.Unlock()
+	if err == ErrNoBlob {
+		return err
+	}
+	if err == nil {
+		err = st.wait(seq)
+	}
+	return logger(err)
+}
+
+// blobReader reads a blob a chunk at a time
+type blobReader struct {
+	c      *Collection
+	st     *store
+	info   *blobInfo
+	n      int    // next chunk to read
+	buf    []byte // what is left of the current chunk
+	closed bool
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrBlobClosed
+	}
+	if len(r.buf) == 0 {
+		if r.n >= r.info.chunks {
+			return 0, io.EOF
+		}
+		r.c.RLock()
+		if r.c.blobs != r.st {
+			// the collection has been closed
+			r.c.RUnlock()
+			return 0, ErrBlobClosed
+		}
+		val, err := r.st.idx.get(blobChunkKey(r.info.id, r.n))
+		if err == nil {
+			// the value may point into the data file, so copy it out
+			// before letting go of the lock
+			r.buf = append([]byte(nil), val...)
+		}
+		r.c.RUnlock()
+		if err != nil {
+			return 0, fmt.Errorf("blob: cannot read chunk %d of blob (replaced or deleted?) -> %s", r.n, err)
+		}
+		r.n++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *blobReader) Close() error {
+	r.buf, r.closed = nil, true
+	return nil
+}
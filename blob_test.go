@@ -0,0 +1,177 @@
+package godb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// read the whole blob under key, failing the test on error
+func readBlob(t *testing.T, c *Collection, key interface{}) []byte {
+	rc, err := c.GetBlob(key)
+	if err != nil {
+		t.Fatalf("getting blob %v: %s\n", key, err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading blob %v: %s\n", key, err)
+	}
+	return b
+}
+
+// test that blobs are stored, replaced and deleted whole
+func Test_Blob_PutGet(t *testing.T) {
+	c := openTestCollection(t, "blob", WithBackend(Memory))
+	defer c.Close()
+	if _, err := c.GetBlob("pdf"); err != ErrNoBlob {
+		t.Fatalf("expected ErrNoBlob, got: %v\n", err)
+	}
+	data := make([]byte, 3*blobChunk+123)
+	rand.Read(data)
+	if err := c.PutBlob("pdf", bytes.NewReader(data)); err != nil {
+		t.Fatalf("putting blob: %s\n", err)
+	}
+	if got := readBlob(t, c, "pdf"); !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes back, got: %d (or different ones)\n", len(data), len(got))
+	}
+	if err := c.PutBlob("pdf", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("replacing blob: %s\n", err)
+	}
+	if got := readBlob(t, c, "pdf"); string(got) != "hello" {
+		t.Fatalf("expected %q, got: %q\n", "hello", got)
+	}
+	// next id, head and a single chunk; the old chunks are gone
+	if n := c.blobs.count(); n != 3 {
+		t.Fatalf("expected 3 records in the blob store, got: %d\n", n)
+	}
+	if c.Count() != 0 {
+		t.Fatalf("expected blobs to be kept out of the collection, got: %d records\n", c.Count())
+	}
+	if err := c.DeleteBlob("pdf"); err != nil {
+		t.Fatalf("deleting blob: %s\n", err)
+	}
+	if err := c.DeleteBlob("pdf"); err != ErrNoBlob {
+		t.Fatalf("expected ErrNoBlob, got: %v\n", err)
+	}
+}
+
+// test that reading a closed blob, or one in a closed collection, is
+// an error
+func Test_Blob_Closed(t *testing.T) {
+	c := openTestCollection(t, "blob", WithBackend(Memory))
+	data := make([]byte, 2*blobChunk)
+	if err := c.PutBlob("img", bytes.NewReader(data)); err != nil {
+		t.Fatalf("putting blob: %s\n", err)
+	}
+	rc, err := c.GetBlob("img")
+	if err != nil {
+		t.Fatalf("getting blob: %s\n", err)
+	}
+	rc.Close()
+	if _, err := rc.Read(make([]byte, 10)); err != ErrBlobClosed {
+		t.Fatalf("expected ErrBlobClosed, got: %v\n", err)
+	}
+	rc, _ = c.GetBlob("img")
+	if _, err := rc.Read(make([]byte, 10)); err != nil {
+		t.Fatalf("reading blob: %s\n", err)
+	}
+	c.Close()
+	if _, err := io.Copy(ioutil.Discard, rc); err != ErrBlobClosed {
+		t.Fatalf("expected ErrBlobClosed, got: %v\n", err)
+	}
+}
+
+// test that chunks left behind by a blob cut short by a crash are
+// deleted when the blob store is next opened
+func Test_Blob_Sweep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blob")
+	c := openTestCollection(t, path)
+	if err := c.PutBlob("keep", bytes.NewReader([]byte("kept"))); err != nil {
+		t.Fatalf("putting blob: %s\n", err)
+	}
+	// write some chunks of a new blob, and crash before its head is
+	c.Lock()
+	id, err := nextBlobID(c.blobs)
+	if err != nil {
+		t.Fatalf("allocating blob id: %s\n", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.blobs.set(blobChunkKey(id, i), make([]byte, 100), 0); err != nil {
+			t.Fatalf("writing chunk: %s\n", err)
+		}
+	}
+	c.Unlock()
+	crashCollection(c)
+
+	c = openTestCollection(t, path)
+	defer c.Close()
+	if got := readBlob(t, c, "keep"); string(got) != "kept" {
+		t.Fatalf("expected %q, got: %q\n", "kept", got)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := c.blobs.idx.has(blobChunkKey(id, i)); ok {
+			t.Fatalf("expected chunk %d of the cut short blob to be gone\n", i)
+		}
+	}
+	// next id, head and a single chunk
+	if n := c.blobs.count(); n != 3 {
+		t.Fatalf("expected 3 records in the blob store, got: %d\n", n)
+	}
+}
+
+// test that a healthy blob store checks out, even though its values
+// aren't msgpack
+func Test_Blob_Repair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blob")
+	c := openTestCollection(t, path)
+	data := make([]byte, 2*blobChunk+1)
+	if err := c.PutBlob("img", bytes.NewReader(data)); err != nil {
+		t.Fatalf("putting blob: %s\n", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("closing: %s\n", err)
+	}
+	r, err := Repair(path + `.blob`)
+	if err != nil {
+		t.Fatalf("repairing: %s\n", err)
+	}
+	if !r.OK() {
+		t.Fatalf("expected no problems, got: %v\n", r.Problems)
+	}
+}
+
+// test that rotating the key of a collection rotates its blob store too
+func Test_Blob_RotateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blob")
+	oldKey, newKey := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+	c := openTestCollection(t, path, WithEncryption(oldKey))
+	data := make([]byte, 2*blobChunk+1)
+	rand.Read(data)
+	c.Set("doc", "meta")
+	if err := c.PutBlob("img", bytes.NewReader(data)); err != nil {
+		t.Fatalf("putting blob: %s\n", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("closing: %s\n", err)
+	}
+	if err := RotateKey(path, oldKey, newKey); err != nil {
+		t.Fatalf("rotating key: %s\n", err)
+	}
+	// running it again finds both already rotated
+	if err := RotateKey(path, oldKey, newKey); err != nil {
+		t.Fatalf("rotating key again: %s\n", err)
+	}
+	c = openTestCollection(t, path, WithEncryption(newKey))
+	defer c.Close()
+	var s string
+	if err := c.Get("doc", &s); err != nil || s != "meta" {
+		t.Fatalf("expected %q, got: %q, %v\n", "meta", s, err)
+	}
+	if got := readBlob(t, c, "img"); !bytes.Equal(got, data) {
+		t.Fatalf("expected the blob back under the new key\n")
+	}
+}
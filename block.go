@@ -1,6 +0,0 @@
-package godb
-
-// data record block position (on disk, in mapped file)
-type block struct {
-    pos int
-}
\ No newline at end of file
@@ -3,7 +3,6 @@ package godb
 import (
 	"bytes"
 	"fmt"
-	"unsafe"
 )
 
 const M = 128
@@ -20,32 +19,169 @@ const M = 128
 	close() error
 }*/
 
-// btree is a b+tree implementation
+// btree is a b+tree implementation. its nodes live in pages
+// of an index file managed by the pager, so opening a tree
+// only has to read the index file's meta page.
 type btree struct {
-	root  *node
-	ngin  *engine
+	root  int // page of the root node
+	pgr   *pager
+	ngin  storage
+	comp  Compression // compression used for values written to the tree
 	count int
+	gen   uint64  // bumped by every commit, so a cursor can tell if its leaf may have changed
+	bad   []error // corrupt records skipped while loading
 }
 
 // creates a new btree instance and returns it if
 // there are no errors encountered while opening
-// the mmap'd file (engine) backing the tree on disk.
-func (t *btree) open(path string) error {
-	t.root = newLeaf()
-	t.root.ptrs[M-1] = nil
-	t.root.rent = nil
+// the file (engine) backing the tree on disk.
+func (t *btree) open(path string, o *options) error {
 	isnew, err := t.ngin.open(path)
+	if err == ErrLocked {
+		return err
+	}
+	if err != nil {
+		// wrapped with %w, so a *FormatError can still be picked out
+		return fmt.Errorf("btree[open]: error opening tree, counld not open engine -> %w", err)
+	}
+	t.pgr, err = openPager(path, o)
 	if err != nil {
-		return fmt.Errorf("btree[open]: error opening tree, counld not open engine -> %s", err)
+		t.ngin.close()
+		return fmt.Errorf("btree[open]: error opening tree, could not open index -> %s", err)
 	}
-	// reconstruct index if a mapped file already exists
-	if !isnew {
-		for payload := range t.ngin.loadAllRecords() {
+	if !t.pgr.stale {
+		// index was closed cleanly, so it can be used as is
+		t.root, t.count = t.pgr.root, t.pgr.count
+		return nil
+	}
+	// otherwise start a new index, and reconstruct it if a mapped
+	// file already exists
+	return t.rebuild(!isnew)
+}
+
+// throws away the index and starts a new one, reconstructing it from
+// the records in the data file if load is set
+func (t *btree) rebuild(load bool) (err error) {
+	defer t.catch(&err)
+	if err := t.pgr.reset(); err != nil {
+		return fmt.Errorf("btree[rebuild]: error resetting index -> %s", err)
+	}
+	t.count, t.bad = 0, nil
+	t.pgr.begin()
+	t.root = t.newLeaf().id
+	if load {
+		ch := t.ngin.loadAllRecords()
+		// let the loader finish if the rebuild is cut short
+		defer func() {
+			for range ch {
+			}
+		}()
+		for payload := range ch {
+			if payload.err != nil {
+				// skip damaged records instead of indexing them
+				t.bad = append(t.bad, logger(payload.err))
+				continue
+			}
 			if err := t.load(payload); err != nil {
 				return fmt.Errorf("btree...loading: error while reconstructing: %q", err)
 			}
+			// write out what has been loaded every so often so the
+			// whole tree doesn't have to fit in the node cache
+			if t.count%nodeCache == 0 {
+				if err := t.commit(); err != nil {
+					return err
+				}
+				t.pgr.begin()
+			}
 		}
 	}
+	return t.commit()
+}
+
+// catch recovers an *indexError raised by the pager while the tree is
+// being walked, hands it back through err and marks the index stale.
+// it must be deferred, directly, by every method that walks the tree
+// on behalf of a caller outside it. the tree may only be locked for
+// reading, so it is left for the next write to rebuild (see heal).
+func (t *btree) catch(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	ie, ok := r.(*indexError)
+	if !ok {
+		panic(r)
+	}
+	t.pgr.mu.Lock()
+	t.pgr.stale = true
+	t.pgr.mu.Unlock()
+	*err = fmt.Errorf("btree: index is damaged and must be rebuilt -> %w", ie)
+}
+
+// repair is catch for the methods that change the tree. a write may
+// be cut short half way through changing it, so the index is rebuilt
+// from the data file there and then rather than being left as it is.
+func (t *btree) repair(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	ie, ok := r.(*indexError)
+	if !ok {
+		panic(r)
+	}
+	if rerr := t.rebuild(true); rerr != nil {
+		*err = fmt.Errorf("btree: index is damaged and could not be rebuilt -> %s", rerr)
+		return
+	}
+	*err = fmt.Errorf("btree: index was damaged and has been rebuilt -> %w", ie)
+}
+
+// rebuilds the index if it has been marked stale since it was opened.
+// called before every write, with the tree locked for writing.
+func (t *btree) heal() error {
+	t.pgr.mu.Lock()
+	stale := t.pgr.stale
+	t.pgr.mu.Unlock()
+	if !stale {
+		return nil
+	}
+	logger(fmt.Errorf("btree[heal]: rebuilding damaged index"))
+	return t.rebuild(true)
+}
+
+// returns the node stored at the provided page
+func (t *btree) node(id int) *node {
+	if t.pgr == nil {
+		return nil
+	}
+	return t.pgr.get(id)
+}
+
+// create and return a new inner node
+func (t *btree) newNode() *node {
+	return t.pgr.alloc(false)
+}
+
+// create and return a new leaf node
+func (t *btree) newLeaf() *node {
+	return t.pgr.alloc(true)
+}
+
+// marks a node as changed so it is written on commit
+func (t *btree) dirty(n ...*node) {
+	for _, n := range n {
+		n.dirty = true
+	}
+}
+
+// writes every node changed by the current operation to the index
+func (t *btree) commit() error {
+	t.gen++
+	t.pgr.root, t.pgr.count = t.root, t.count
+	if err := t.pgr.commit(); err != nil {
+		return fmt.Errorf("btree[commit]: error writing index -> %s", err)
+	}
 	return nil
 }
 
@@ -58,71 +194,60 @@ func (t *btree) load(p payload) error {
 	// copy elements from memory mapped payload
 	// to new address space to be used. (so it
 	// doesn't screw with the memory mapping.)
-	key, blk := make([]byte, maxKey), new(block)
+	key := make([]byte, len(p.key))
 	copy(key, p.key)
-	blk.pos = p.pos
 
 	// check if key already exists
-	leaf, _ := t.find(key)
+	leaf, i := t.find(key)
 	if leaf == nil {
 		// returned empty leaf node
 		return fmt.Errorf("btree[load]: leaf node is nil\n")
 	}
-
-	// if room in leaf insert
-	if leaf.numk < M-1 {
-		// inserting block into leaf (already added record to engine)
-		insertIntoLeaf(leaf, key, blk)
-		// incrementing record count by one
-		t.count++
+	if i > -1 {
+		// a second copy of a record, left behind by a move that was
+		// cut short; both copies hold the same data so keep the first
+		t.bad = append(t.bad, logger(fmt.Errorf("btree[load]: duplicate key at block %d (first seen at block %d)", p.pos, leaf.ptrs[i])))
 		return nil
 	}
-	// otherwise, insert, split, and balance... returning updated root
-	t.count++ // incrementing record count by one
-	t.root = insertIntoLeafAfterSplitting(t.root, leaf, key, blk)
+	// insert into leaf (already added record to engine)
+	t.insert(leaf, key, p.pos)
 	return nil
 }
 
 // Has returns a boolean indicating weather or not the
 // provided key and associated record / value exists.
-func (t *btree) has(key []byte) bool {
-	_, blk := t.find(key)
-	return blk != nil
+func (t *btree) has(key []byte) (ok bool, err error) {
+	defer t.catch(&err)
+	_, i := t.find(key)
+	return i > -1, nil
 }
 
 // Add inserts a new record using provided key.
 // It only inserts if the key does not already exist.
-func (t *btree) add(key []byte, val []byte) error {
+func (t *btree) add(key []byte, val []byte) (err error) {
+	defer t.repair(&err)
+	if err := t.heal(); err != nil {
+		return err
+	}
 	// check if key already exists
-	leaf, blk := t.find(key)
+	leaf, i := t.find(key)
 	if leaf == nil {
 		// returned empty leaf node
 		return fmt.Errorf("btree[add]: leaf node is nil\n")
 	}
-	if blk != nil {
+	if i > -1 {
 		// key already exists, don't add!
 		return fmt.Errorf("btree[add]: key already exists, not adding\n")
 	}
-	blk = new(block)
 	// key does not exist. add into engine
-	pos, err := t.ngin.addRecord(newRecord(key, val))
+	pos, err := t.ngin.addRecord(newRecord(key, val, 0, t.ngin.version()+1, t.comp))
 	if err != nil {
 		// failed to add record to engine
 		return fmt.Errorf("btree[add]: failed to add record to engine -> %s", err)
 	}
-	blk.pos = pos
-	// if room in leaf insert
-	if leaf.numk < M-1 {
-		// inserting block into leaf (already added record to engine)
-		insertIntoLeaf(leaf, key, blk)
-		// incrementing record count by one
-		t.count++
-		return nil
-	}
-	// otherwise, insert, split, and balance... returning updated root
-	t.count++ // incrementing record count by one
-	t.root = insertIntoLeafAfterSplitting(t.root, leaf, key, blk)
-	return nil
+	t.pgr.begin()
+	t.insert(leaf, key, pos)
+	return t.commit()
 }
 
 // Set is mainly used for re-indexing
@@ -130,38 +255,58 @@ func (t *btree) add(key []byte, val []byte) error {
 // be contained the btree/index. it will
 // overwrite duplicate keys, as it does
 // not check to see if the key exists...
-func (t *btree) set(key []byte, val []byte) error {
+// the record expires at exp, or never if exp is 0, and is
+// written at version ver.
+func (t *btree) set(key []byte, val []byte, exp int64, ver uint64) (err error) {
+	defer t.repair(&err)
+	if err := t.heal(); err != nil {
+		return err
+	}
 	// check if key already exists
-	leaf, blk := t.find(key)
+	leaf, i := t.find(key)
 	if leaf == nil {
 		return fmt.Errorf("btree[set]: leaf node is nil\n")
 	}
 	// check if key exists in tree
-	if blk != nil {
-		// key exists in tree, update engine
-		t.ngin.setRecord(blk.pos, newRecord(key, val))
+	if i > -1 {
+		// key exists in tree, update engine (the record may move)
+		pos, err := t.ngin.setRecord(leaf.ptrs[i], newRecord(key, val, exp, ver, t.comp))
+		if err != nil {
+			return fmt.Errorf("btree[set]: failed to update record in engine -> %s", err)
+		}
+		if pos != leaf.ptrs[i] {
+			t.pgr.begin()
+			leaf.ptrs[i] = pos
+			t.dirty(leaf)
+			return t.commit()
+		}
 		return nil
 	}
 	// key does not exist. add into engine
-	blk = new(block)
-	pos, err := t.ngin.addRecord(newRecord(key, val))
+	pos, err := t.ngin.addRecord(newRecord(key, val, exp, ver, t.comp))
 	if err != nil {
 		// failed to add to engine
 		return fmt.Errorf("btree[set]: failed to add to engine -> %s", err)
 	}
-	blk.pos = pos
+	t.pgr.begin()
+	t.insert(leaf, key, pos)
+	return t.commit()
+}
+
+// inserts a key and the block position of its record into the
+// provided leaf, splitting and balancing the tree if needed
+func (t *btree) insert(leaf *node, key []byte, pos int) {
 	// if room in leaf insert
 	if leaf.numk < M-1 {
-		// insert block into leaf (already added record to engine)
-		insertIntoLeaf(leaf, key, blk)
-		// increent record count by one
+		// inserting block into leaf (already added record to engine)
+		t.insertIntoLeaf(leaf, key, pos)
+		// incrementing record count by one
 		t.count++
-		return nil
+		return
 	}
 	// otherwise, insert, split, and balance... returning updated root
 	t.count++ // incrementing record count by one
-	t.root = insertIntoLeafAfterSplitting(t.root, leaf, key, blk)
-	return nil
+	t.root = t.insertIntoLeafAfterSplitting(t.node(t.root), leaf, key, pos).id
 }
 
 /*
@@ -169,28 +314,30 @@ func (t *btree) set(key []byte, val []byte) error {
  */
 
 // creates a new root for two sub-btrees and inserts the key into the new root
-func insertIntoNewRoot(left *node, key []byte, right *node) *node {
-	root := newNode()
+func (t *btree) insertIntoNewRoot(left *node, key []byte, right *node) *node {
+	root := t.newNode()
 	root.keys[0] = key
-	root.ptrs[0] = unsafe.Pointer(left)
-	root.ptrs[1] = unsafe.Pointer(right)
+	root.ptrs[0] = left.id
+	root.ptrs[1] = right.id
 	root.numk++
-	root.rent = nil
-	left.rent = root
-	right.rent = root
+	root.rent = 0
+	left.rent = root.id
+	right.rent = root.id
+	t.dirty(left, right)
 	return root
 }
 
 // insert a new node (leaf or internal) into btree, return root of btree
-func insertIntoRent(root, left *node, key []byte, right *node) *node {
-	if left.rent == nil {
-		return insertIntoNewRoot(left, key, right)
+func (t *btree) insertIntoRent(root, left *node, key []byte, right *node) *node {
+	if left.rent == 0 {
+		return t.insertIntoNewRoot(left, key, right)
 	}
-	leftIndex := getLeftIndex(left.rent, left)
-	if left.rent.numk < M-1 {
-		return insertIntoNode(root, left.rent, leftIndex, key, right)
+	rent := t.node(left.rent)
+	leftIndex := getLeftIndex(rent, left)
+	if rent.numk < M-1 {
+		return t.insertIntoNode(root, rent, leftIndex, key, right)
 	}
-	return insertIntoNodeAfterSplitting(root, left.rent, leftIndex, key, right)
+	return t.insertIntoNodeAfterSplitting(root, rent, leftIndex, key, right)
 }
 
 // helper->insert_into_rent
@@ -198,7 +345,7 @@ func insertIntoRent(root, left *node, key []byte, right *node) *node {
 // node to the left of the key to be inserted
 func getLeftIndex(rent, left *node) int {
 	var leftIndex int
-	for leftIndex <= rent.numk && (*node)(unsafe.Pointer(rent.ptrs[leftIndex])) != left {
+	for leftIndex <= rent.numk && rent.ptrs[leftIndex] != left.id {
 		leftIndex++
 	}
 	return leftIndex
@@ -209,21 +356,22 @@ func getLeftIndex(rent, left *node) int {
  */
 
 // insert a new key, ptr to a node
-func insertIntoNode(root, n *node, leftIndex int, key []byte, right *node) *node {
+func (t *btree) insertIntoNode(root, n *node, leftIndex int, key []byte, right *node) *node {
 	copy(n.ptrs[leftIndex+2:], n.ptrs[leftIndex+1:])
 	copy(n.keys[leftIndex+1:], n.keys[leftIndex:])
-	n.ptrs[leftIndex+1] = unsafe.Pointer(right)
+	n.ptrs[leftIndex+1] = right.id
 	n.keys[leftIndex] = key
 	n.numk++
+	t.dirty(n)
 	return root
 }
 
 // insert a new key, ptr to a node causing node to split
-func insertIntoNodeAfterSplitting(root, oldNode *node, leftIndex int, key []byte, right *node) *node {
+func (t *btree) insertIntoNodeAfterSplitting(root, oldNode *node, leftIndex int, key []byte, right *node) *node {
 
 	var i, j int
 	var tmpKeys [M][]byte
-	var tmpPtrs [M + 1]unsafe.Pointer
+	var tmpPtrs [M + 1]int
 
 	for i, j = 0, 0; i < oldNode.numk+1; i, j = i+1, j+1 {
 		if j == leftIndex+1 {
@@ -239,12 +387,12 @@ func insertIntoNodeAfterSplitting(root, oldNode *node, leftIndex int, key []byte
 		tmpKeys[j] = oldNode.keys[i]
 	}
 
-	tmpPtrs[leftIndex+1] = unsafe.Pointer(right)
+	tmpPtrs[leftIndex+1] = right.id
 	tmpKeys[leftIndex] = key
 
 	split := cut(M)
 
-	newNode := newNode()
+	newNode := t.newNode()
 	oldNode.numk = 0
 
 	for i = 0; i < split-1; i++ {
@@ -265,68 +413,70 @@ func insertIntoNodeAfterSplitting(root, oldNode *node, leftIndex int, key []byte
 
 	newNode.ptrs[j] = tmpPtrs[i]
 
-	// free tmps...
-	for i = 0; i < M; i++ {
-		tmpKeys[i] = nil
-		tmpPtrs[i] = nil
+	// wipe the part of the old node that moved to the new one
+	for i = oldNode.numk; i < M-1; i++ {
+		oldNode.keys[i] = nil
+	}
+	for i = oldNode.numk + 1; i < M; i++ {
+		oldNode.ptrs[i] = 0
 	}
-	tmpPtrs[M] = nil
 
 	newNode.rent = oldNode.rent
 
 	for i = 0; i <= newNode.numk; i++ {
-		n := (*node)(unsafe.Pointer(newNode.ptrs[i]))
-		n.rent = newNode
+		n := t.node(newNode.ptrs[i])
+		n.rent = newNode.id
+		t.dirty(n)
 	}
-	return insertIntoRent(root, oldNode, prime, newNode)
+	t.dirty(oldNode, newNode)
+	return t.insertIntoRent(root, oldNode, prime, newNode)
 }
 
 /*
  *	Leaf node insert internals
  */
 
-// inserts a new key and *block into a leaf
-func insertIntoLeaf(leaf *node, key []byte, blk *block) {
-	var i, pos int
-	for pos < leaf.numk && bytes.Compare(leaf.keys[pos], key) == -1 {
-		pos++
+// inserts a new key and block position into a leaf
+func (t *btree) insertIntoLeaf(leaf *node, key []byte, pos int) {
+	var i, at int
+	for at < leaf.numk && bytes.Compare(leaf.keys[at], key) == -1 {
+		at++
 	}
 
-	for i = leaf.numk; i > pos; i-- {
+	for i = leaf.numk; i > at; i-- {
 		leaf.keys[i] = leaf.keys[i-1]
 		leaf.ptrs[i] = leaf.ptrs[i-1]
 	}
 
-	// leaf.engine.set(writeRecord(ptr), pos)
-
 	// assumed value is already inserted into engine
-	leaf.keys[pos] = key
-	leaf.ptrs[pos] = unsafe.Pointer(blk)
+	leaf.keys[at] = key
+	leaf.ptrs[at] = pos
 	leaf.numk++
+	t.dirty(leaf)
 }
 
-// inserts a new key and *block into a leaf, so as
+// inserts a new key and block position into a leaf, so as
 // to exceed the order, causing the leaf to be split
-func insertIntoLeafAfterSplitting(root, leaf *node, key []byte, blk *block) *node {
+func (t *btree) insertIntoLeafAfterSplitting(root, leaf *node, key []byte, pos int) *node {
 	// perform linear search to find index to insert new record
-	var pos int
-	for pos < M-1 && bytes.Compare(leaf.keys[pos], key) == -1 {
-		pos++
+	var at int
+	for at < M-1 && bytes.Compare(leaf.keys[at], key) == -1 {
+		at++
 	}
 	var tmpKeys [M][]byte
-	var tmpPtrs [M]unsafe.Pointer
+	var tmpPtrs [M]int
 	var i, j int
 	// copy leaf keys & ptrs to temp
 	// reserve space at insertion index for new record
 	for i, j = 0, 0; i < leaf.numk; i, j = i+1, j+1 {
-		if j == pos {
+		if j == at {
 			j++
 		}
 		tmpKeys[j] = leaf.keys[i]
 		tmpPtrs[j] = leaf.ptrs[i]
 	}
-	tmpKeys[pos] = key
-	tmpPtrs[pos] = unsafe.Pointer(blk)
+	tmpKeys[at] = key
+	tmpPtrs[at] = pos
 
 	leaf.numk = 0
 	// index where to split leaf
@@ -338,7 +488,7 @@ func insertIntoLeafAfterSplitting(root, leaf *node, key []byte, blk *block) *nod
 		leaf.numk++
 	}
 	// create new leaf
-	newLeaf := newLeaf()
+	newLeaf := t.newLeaf()
 
 	// writing to new leaf from split point to end of giginal leaf pre split
 	for i, j = split, 0; i < M; i, j = i+1, j+1 {
@@ -346,58 +496,59 @@ func insertIntoLeafAfterSplitting(root, leaf *node, key []byte, blk *block) *nod
 		newLeaf.ptrs[j] = tmpPtrs[i]
 		newLeaf.numk++
 	}
-	// freeing tmps...
-	for i = 0; i < M; i++ {
-		tmpKeys[i] = nil
-		tmpPtrs[i] = nil
-	}
 	newLeaf.ptrs[M-1] = leaf.ptrs[M-1]
-	leaf.ptrs[M-1] = unsafe.Pointer(newLeaf)
+	leaf.ptrs[M-1] = newLeaf.id
 
 	// wipe old and new leaf
 	for i = leaf.numk; i < M-1; i++ {
 		leaf.keys[i] = nil
-		leaf.ptrs[i] = nil
+		leaf.ptrs[i] = 0
 	}
 	for i = newLeaf.numk; i < M-1; i++ {
 		newLeaf.keys[i] = nil
-		newLeaf.ptrs[i] = nil
+		newLeaf.ptrs[i] = 0
 	}
 
 	newLeaf.rent = leaf.rent
 	newKey := newLeaf.keys[0]
-	return insertIntoRent(root, leaf, newKey, newLeaf)
+	t.dirty(leaf, newLeaf)
+	return t.insertIntoRent(root, leaf, newKey, newLeaf)
 }
 
 // Get returns the record for
 // a given key if it exists
-func (t *btree) get(key []byte) ([]byte, error) {
-	if _, blk := t.find(key); blk != nil {
-		val, err := t.ngin.getRecordVal(blk.pos)
+// (and has not expired)
+func (t *btree) get(key []byte) (val []byte, err error) {
+	defer t.catch(&err)
+	if leaf, i := t.find(key); i > -1 {
+		val, exp, err := t.ngin.getRecordVal(leaf.ptrs[i])
+		if _, ok := err.(*CorruptError); ok {
+			return nil, err
+		}
 		if err != nil {
 			return nil, fmt.Errorf("btree[get]: failed to get record from engine -> %s", err)
 		}
+		if expired(exp) {
+			return nil, fmt.Errorf("btree[get]: record has expired\n")
+		}
 		return val, nil
 	}
 	return nil, fmt.Errorf("btree[get]: failed to get block from leaf\n")
 }
 
-// returns: leaf node, block
-func (t *btree) find(key []byte) (*node, *block) {
-	leaf := findLeaf(t.root, key)
+// returns: leaf node, index of key in leaf (or -1)
+func (t *btree) find(key []byte) (*node, int) {
+	leaf := t.findLeaf(key)
 	if leaf == nil {
-		return nil, nil
+		return nil, -1
 	}
 	var i int
 	for i = 0; i < leaf.numk; i++ {
 		if bytes.Equal(leaf.keys[i], key) {
-			break
+			return leaf, i
 		}
 	}
-	if i == leaf.numk {
-		return leaf, nil
-	}
-	return leaf, (*block)(unsafe.Pointer(leaf.ptrs[i]))
+	return leaf, -1
 }
 
 /*
@@ -405,8 +556,8 @@ func (t *btree) find(key []byte) (*node, *block) {
  */
 
 // finds and returns leaf node
-func findLeaf(root *node, key []byte) *node {
-	var c *node = root
+func (t *btree) findLeaf(key []byte) *node {
+	var c *node = t.node(t.root)
 	if c == nil {
 		return c
 	}
@@ -421,59 +572,32 @@ func findLeaf(root *node, key []byte) *node {
 				break
 			}
 		}
-		c = (*node)(unsafe.Pointer(c.ptrs[i]))
+		c = t.node(c.ptrs[i])
 	}
 	// this is the found leaf node
 	return c
 }
 
 // Del deletes a record by key
-func (t *btree) del(key []byte) error {
-	leaf, blk := t.find(key)
-	err := fmt.Errorf("btree[del]: failed to locate proper leaf or block (leaf: %+v, block: %+v)", leaf, blk)
-	if blk != nil && leaf != nil {
-		// delete record from engine
-		if err = t.ngin.delRecord(blk.pos); err != nil {
-			return fmt.Errorf("btree[del]: faied to delete record from engine -> %s", err)
-		}
-		// delete index block from tree
-		t.count--
-		t.root = deleteEntry(t.root, leaf, key, unsafe.Pointer(blk))
-		blk, err = nil, nil
-	}
-	return err
-	/*
-		// t.find returns *node (leaf node), and a *block
-		// otherwise it will simply return nil for both values
-		leaf, blk := t.find(key)
-
-		if leaf == nil {
-			return fmt.Errorf("btree[del]: failed to find leaf node")
-		}
-		if blk == nil {
-			return fmt.Errorf("btree[del]: failed to find block in leaf node")
-		}
-		// double check passed key, and OLD records key
-		A
-		rkey, err := t.ngin.getRecordKey(blk.pos)
-		if err != nil {
-			return fmt.Errorf("btree[del]: failed to get record from engine -> %s", err)
-		}
-		// ensure they match...
-		if !bytes.Equal(rkey, key) {
-			fmt.Printf("check key matches:\n\t%q\n%q\n", rkey, key)
-			return fmt.Errorf("btree[del]: key does not match record key on disk at same block position")
-		}
-		// so far, so good... attempt to delete record from the mapped engine
-		if err := t.ngin.delRecord(blk.pos); err != nil {
-			return fmt.Errorf("btree[del]: failed to delete record from engine -> %s", err)
-		}
-		// success!
-		// remove from btree, rebalance, etc.
-		t.count-- // decrementing record count by one
-		t.root = deleteEntry(t.root, leaf, key, unsafe.Pointer(blk))
-		return nil
-	*/
+func (t *btree) del(key []byte) (err error) {
+	defer t.repair(&err)
+	if err := t.heal(); err != nil {
+		return err
+	}
+	leaf, i := t.find(key)
+	if leaf == nil || i < 0 {
+		return fmt.Errorf("btree[del]: failed to locate proper leaf or block (leaf: %+v, index: %d)", leaf, i)
+	}
+	pos := leaf.ptrs[i]
+	// delete record from engine
+	if err := t.ngin.delRecord(pos); err != nil {
+		return fmt.Errorf("btree[del]: faied to delete record from engine -> %s", err)
+	}
+	// delete index block from tree
+	t.pgr.begin()
+	t.count--
+	t.root = t.deleteEntry(t.node(t.root), leaf, key, pos).id
+	return t.commit()
 }
 
 /*
@@ -482,16 +606,17 @@ func (t *btree) del(key []byte) error {
 
 // helper for delete methods... returns index of
 // a nodes nearest sibling to the left if one exists
-func getNeighborIndex(n *node) int {
-	for i := 0; i <= n.rent.numk; i++ {
-		if (*node)(unsafe.Pointer(n.rent.ptrs[i])) == n {
+func (t *btree) getNeighborIndex(n *node) int {
+	rent := t.node(n.rent)
+	for i := 0; i <= rent.numk; i++ {
+		if rent.ptrs[i] == n.id {
 			return i - 1
 		}
 	}
 	panic("btree[getNeighborIndex]: (panic) search for nonexistent ptr to node in rent.")
 }
 
-func removeEntryFromNode(n *node, key []byte, ptr unsafe.Pointer) *node {
+func (t *btree) removeEntryFromNode(n *node, key []byte, ptr int) *node {
 	var i, numPtrs int
 	// remove key and shift over keys accordingly
 	for !bytes.Equal(n.keys[i], key) {
@@ -510,11 +635,7 @@ func removeEntryFromNode(n *node, key []byte, ptr unsafe.Pointer) *node {
 	}
 
 	i = 0
-	//for !reflect.DeepEqual((*uintptr)(unsafe.Pointer(n.ptrs[i])), (*uintptr)(unsafe.Pointer(ptr))) {
-	//	i++
-	//}
-
-	for n.ptrs[i] != ptr {
+	for i < numPtrs && n.ptrs[i] != ptr {
 		i++
 	}
 
@@ -524,34 +645,35 @@ func removeEntryFromNode(n *node, key []byte, ptr unsafe.Pointer) *node {
 
 	// one key has been removed
 	n.numk--
-	// set other ptrs to nil for tidiness; remember leaf
+	n.keys[n.numk] = nil
+	// set other ptrs to 0 for tidiness; remember leaf
 	// nodes use the last ptr to point to the next leaf
 	if n.leaf {
 		for i := n.numk; i < M-1; i++ {
-			n.ptrs[i] = nil
+			n.ptrs[i] = 0
 		}
 	} else {
 		for i := n.numk + 1; i < M; i++ {
-			n.ptrs[i] = nil
+			n.ptrs[i] = 0
 		}
 	}
-
+	t.dirty(n)
 	return n
 }
 
 // deletes an entry from the btree; removes record, key, and ptr from leaf and rebalances btree
-func deleteEntry(root, n *node, key []byte, ptr unsafe.Pointer) *node {
+func (t *btree) deleteEntry(root, n *node, key []byte, ptr int) *node {
 
 	var primeIndex, minKeys, capacity int
 	var neighbor *node
 	var prime []byte
 
 	// remove key and ptr from node
-	n = removeEntryFromNode(n, key, ptr)
+	n = t.removeEntryFromNode(n, key, ptr)
 
 	// case: deletion from the root
-	if n == root {
-		return adjustRoot(root)
+	if n.id == root.id {
+		return t.adjustRoot(root)
 	}
 
 	// case: delete from node below root (rest of funtion body)
@@ -568,19 +690,20 @@ func deleteEntry(root, n *node, key []byte, ptr unsafe.Pointer) *node {
 
 	// case: node is below minimum order, a coalescence or redistribution is needed...
 
-	neighborIndex := getNeighborIndex(n)
+	neighborIndex := t.getNeighborIndex(n)
 	if neighborIndex == -1 {
 		primeIndex = 0
 	} else {
 		primeIndex = neighborIndex
 	}
 
-	prime = n.rent.keys[primeIndex]
+	rent := t.node(n.rent)
+	prime = rent.keys[primeIndex]
 
 	if neighborIndex == -1 {
-		neighbor = (*node)(unsafe.Pointer(n.rent.ptrs[1]))
+		neighbor = t.node(rent.ptrs[1])
 	} else {
-		neighbor = (*node)(unsafe.Pointer(n.rent.ptrs[neighborIndex]))
+		neighbor = t.node(rent.ptrs[neighborIndex])
 	}
 
 	if n.leaf {
@@ -591,37 +714,37 @@ func deleteEntry(root, n *node, key []byte, ptr unsafe.Pointer) *node {
 
 	// coalescence
 	if neighbor.numk+n.numk < capacity {
-		return coalesceNodes(root, n, neighbor, neighborIndex, prime)
+		return t.coalesceNodes(root, n, neighbor, neighborIndex, prime)
 	}
 
 	// redistrubution
-	return redistributeNodes(root, n, neighbor, neighborIndex, primeIndex, prime)
+	return t.redistributeNodes(root, n, neighbor, neighborIndex, primeIndex, prime)
 }
 
-func adjustRoot(root *node) *node {
+func (t *btree) adjustRoot(root *node) *node {
 	// if non-empty root key and ptr
 	// have already been deleted, so
 	// nothing to be done here
 	if root.numk > 0 {
 		return root
 	}
-	var newRoot *node
 	// if root is empty and has a child
 	// promote first (only) child as the
 	// new root node. If it's a leaf then
-	// the while btree is empty...
-	if !root.leaf {
-		newRoot = (*node)(unsafe.Pointer(root.ptrs[0]))
-		newRoot.rent = nil
-	} else {
-		newRoot = nil
+	// the whole btree is empty, and the
+	// empty leaf stays on as the root...
+	if root.leaf {
+		return root
 	}
-	root = nil // free root
+	newRoot := t.node(root.ptrs[0])
+	newRoot.rent = 0
+	t.dirty(newRoot)
+	t.pgr.release(root) // free root
 	return newRoot
 }
 
 // merge (underflow)
-func coalesceNodes(root, n, neighbor *node, neighborIndex int, prime []byte) *node {
+func (t *btree) coalesceNodes(root, n, neighbor *node, neighborIndex int, prime []byte) *node {
 	var i, j, neighborInsertionIndex, nEnd int
 	var tmp *node
 	// swap neight with node if nod eis on the
@@ -652,8 +775,9 @@ func coalesceNodes(root, n, neighbor *node, neighborIndex int, prime []byte) *no
 		}
 		neighbor.ptrs[i] = n.ptrs[j]
 		for i = 0; i < neighbor.numk+1; i++ {
-			tmp = (*node)(unsafe.Pointer(neighbor.ptrs[i]))
-			tmp.rent = neighbor
+			tmp = t.node(neighbor.ptrs[i])
+			tmp.rent = neighbor.id
+			t.dirty(tmp)
 		}
 	} else {
 		// in a leaf; append the keys and ptrs.
@@ -668,15 +792,17 @@ func coalesceNodes(root, n, neighbor *node, neighborIndex int, prime []byte) *no
 		}
 		neighbor.ptrs[M-1] = n.ptrs[M-1]
 	}
-	root = deleteEntry(root, n.rent, prime, unsafe.Pointer(n))
-	n = nil // free n
+	t.dirty(neighbor)
+	root = t.deleteEntry(root, t.node(n.rent), prime, n.id)
+	t.pgr.release(n) // free n
 	return root
 }
 
 // merge / redistribute
-func redistributeNodes(root, n, neighbor *node, neighborIndex, primeIndex int, prime []byte) *node {
+func (t *btree) redistributeNodes(root, n, neighbor *node, neighborIndex, primeIndex int, prime []byte) *node {
 	var i int
 	var tmp *node
+	rent := t.node(n.rent)
 	// case: node n has a neighnor to the left
 	if neighborIndex != -1 {
 		if !n.leaf {
@@ -688,29 +814,32 @@ func redistributeNodes(root, n, neighbor *node, neighborIndex, primeIndex int, p
 		}
 		if !n.leaf {
 			n.ptrs[0] = neighbor.ptrs[neighbor.numk]
-			tmp = (*node)(unsafe.Pointer(n.ptrs[0]))
-			tmp.rent = n
-			neighbor.ptrs[neighbor.numk] = nil
+			tmp = t.node(n.ptrs[0])
+			tmp.rent = n.id
+			t.dirty(tmp)
+			neighbor.ptrs[neighbor.numk] = 0
 			n.keys[0] = prime
-			n.rent.keys[primeIndex] = neighbor.keys[neighbor.numk-1]
+			rent.keys[primeIndex] = neighbor.keys[neighbor.numk-1]
 		} else {
 			n.ptrs[0] = neighbor.ptrs[neighbor.numk-1]
-			neighbor.ptrs[neighbor.numk-1] = nil
+			neighbor.ptrs[neighbor.numk-1] = 0
 			n.keys[0] = neighbor.keys[neighbor.numk-1]
-			n.rent.keys[primeIndex] = n.keys[0]
+			rent.keys[primeIndex] = n.keys[0]
 		}
+		neighbor.keys[neighbor.numk-1] = nil
 	} else {
 		// case: n is left most child (n has no left neighbor)
 		if n.leaf {
 			n.keys[n.numk] = neighbor.keys[0]
 			n.ptrs[n.numk] = neighbor.ptrs[0]
-			n.rent.keys[primeIndex] = neighbor.keys[1]
+			rent.keys[primeIndex] = neighbor.keys[1]
 		} else {
 			n.keys[n.numk] = prime
 			n.ptrs[n.numk+1] = neighbor.ptrs[0]
-			tmp = (*node)(unsafe.Pointer(n.ptrs[n.numk+1]))
-			tmp.rent = n
-			n.rent.keys[primeIndex] = neighbor.keys[0]
+			tmp = t.node(n.ptrs[n.numk+1])
+			tmp.rent = n.id
+			t.dirty(tmp)
+			rent.keys[primeIndex] = neighbor.keys[0]
 		}
 		for i = 0; i < neighbor.numk-1; i++ {
 			neighbor.keys[i] = neighbor.keys[i+1]
@@ -718,32 +847,23 @@ func redistributeNodes(root, n, neighbor *node, neighborIndex, primeIndex int, p
 		}
 		if !n.leaf {
 			neighbor.ptrs[i] = neighbor.ptrs[i+1]
+			neighbor.ptrs[i+1] = 0
+		} else {
+			neighbor.ptrs[i] = 0
 		}
+		neighbor.keys[i] = nil
 	}
 	n.numk++
 	neighbor.numk--
+	t.dirty(n, neighbor, rent)
 	return root
 }
 
-func destroybtreeNodes(n *node) {
-	if n == nil {
-		return
-	}
-	if n.leaf {
-		for i := 0; i < n.numk; i++ {
-			n.ptrs[i] = nil
-		}
-	} else {
-		for i := 0; i < n.numk+1; i++ {
-			destroybtreeNodes((*node)(unsafe.Pointer(n.ptrs[i])))
-		}
-	}
-	n = nil // free
-}
-
-// Close destroys all the nodes of the btree
+// Close writes out the index and closes the engine
 func (t *btree) close() error {
-	destroybtreeNodes(t.root)
+	if err := t.pgr.close(); err != nil {
+		return fmt.Errorf("btree[close]: error encountered while closing index -> %s", err)
+	}
 	if err := t.ngin.close(); err != nil {
 		return fmt.Errorf("btree[close]: error encountered while closing engine -> %s", err)
 	}
@@ -760,103 +880,184 @@ func cut(length int) int {
 	return length/2 + 1
 }
 
-/* UNKNOWN IF WE NEED YET OR NOT */
+// finds the first leaf in the btree (lexicographically)
+func (t *btree) findFirstLeaf() *node {
+	c := t.node(t.root)
+	if c == nil {
+		return c
+	}
+	for !c.leaf {
+		c = t.node(c.ptrs[0])
+	}
+	return c
+}
+
+// returns the leaf to the right of the provided leaf, if any
+func (t *btree) nextLeaf(n *node) *node {
+	// if node has neighbor, visit...
+	if n.leaf && n.ptrs[M-1] != 0 {
+		return t.node(n.ptrs[M-1])
+	}
+	return nil
+}
 
-// All returns all of the values in the btree (lexicographically)
+// finds the last leaf in the btree (lexicographically)
+func (t *btree) findLastLeaf() *node {
+	c := t.node(t.root)
+	if c == nil {
+		return c
+	}
+	for !c.leaf {
+		c = t.node(c.ptrs[c.numk])
+	}
+	return c
+}
 
-/*
-func (t *btree) All() [][]byte {
-	leaf := findFirstLeaf(t.root)
-	if leaf == nil {
+// returns the leaf to the left of the provided leaf, if any. leaves
+// only link to the right, so it is found by following the path from
+// the root to the leaf and taking the last turn to the left of it.
+func (t *btree) prevLeaf(n *node) *node {
+	if n.numk == 0 {
 		return nil
 	}
-	var vals [][]byte
-	for {
-		for i := 0; i < leaf.numk; i++ {
-			if leaf.ptrs[i] != nil {
-				// get record from leaf
-				rec := (*record)(unsafe.Pointer(leaf.ptrs[i]))
-				// get doc and append to docs
-				vals = append(vals, rec.val)
-			}
+	var left *node
+	c := t.node(t.root)
+	for c != nil && !c.leaf {
+		i := 0
+		for i < c.numk && bytes.Compare(n.keys[0], c.keys[i]) >= 0 {
+			i++
 		}
-		// we're at the end, no more leaves to iterate
-		if leaf.ptrs[M-1] == nil {
-			break
+		if i > 0 {
+			left = t.node(c.ptrs[i-1])
 		}
-		// increment/follow pointer to next leaf node
-		leaf = (*node)(unsafe.Pointer(leaf.ptrs[M-1]))
+		c = t.node(c.ptrs[i])
 	}
-	return vals
+	if left == nil {
+		return nil
+	}
+	for !left.leaf {
+		left = t.node(left.ptrs[left.numk])
+	}
+	return left
 }
-*/
 
-// binary search utility
-
-/*
-func search(n *node, key []byte) int {
-	lo, hi := 0, n.numk
-	for lo < hi {
-		md := (lo + hi) >> 1
-		if bytes.Compare(key, n.keys[md]) >= 0 {
-			lo = md + 1
-		} else {
-			hi = md - 1
-		}
+// returns the leaf holding the first key at or after key, and the
+// index of that key in it. the index is the number of keys in the
+// leaf if the key is in a leaf further to the right (or there isn't
+// one at all).
+func (t *btree) seek(key []byte) (*node, int) {
+	leaf := t.findLeaf(key)
+	if leaf == nil {
+		return nil, 0
 	}
-	return lo
+	i := 0
+	for i < leaf.numk && bytes.Compare(leaf.keys[i], key) < 0 {
+		i++
+	}
+	return leaf, i
 }
-*/
 
-// finds the first leaf in the btree (lexicographically)
+// report whether the record for key exists and has not expired
+func (t *btree) live(key []byte) (ok bool, err error) {
+	defer t.catch(&err)
+	leaf, i := t.find(key)
+	if i < 0 {
+		return false, nil
+	}
+	exp, rerr := t.ngin.getRecordExp(leaf.ptrs[i])
+	return rerr != nil || !expired(exp), nil
+}
 
-func (t *btree) findFirstLeaf() *node {
-	if t.root == nil {
-		return t.root
+// returns the version of the record for key, or 0 if there is no
+// record for key or it has expired
+func (t *btree) version(key []byte) (ver uint64, err error) {
+	defer t.catch(&err)
+	leaf, i := t.find(key)
+	if i < 0 {
+		return 0, nil
 	}
-	c := t.root
-	for !c.leaf {
-		c = (*node)(unsafe.Pointer(c.ptrs[0]))
+	r, err := t.ngin.getRecord(leaf.ptrs[i])
+	if err != nil {
+		return 0, fmt.Errorf("btree[version]: failed to get record from engine -> %s", err)
 	}
-	return c
+	if expired(r.expires()) {
+		return 0, nil
+	}
+	return r.version(), nil
 }
 
-func (t *btree) nextRecord() <-chan []byte {
-	n := t.findFirstLeaf()
-	if n == nil {
-		return nil
+// returns the expiry of the record for key, or 0 if it never expires
+// or there is no record for key
+func (t *btree) expiry(key []byte) (exp int64, err error) {
+	defer t.catch(&err)
+	leaf, i := t.find(key)
+	if i < 0 {
+		return 0, nil
 	}
-	ch := make(chan []byte, 1)
-	go func() {
-		for {
-			for i := 0; i < n.numk; i++ {
-				if blk := n.getBlock(i); blk != nil {
-					val, err := t.ngin.getRecordVal(blk.pos)
-					if err != nil {
-						ch <- nil
-					}
-					ch <- val
-				}
-			}
-			if n = n.nextLeaf(); n == nil {
-				break
-			}
+	exp, rerr := t.ngin.getRecordExp(leaf.ptrs[i])
+	if rerr != nil {
+		return 0, nil
+	}
+	return exp, nil
+}
+
+// returns the key and block position of every record in the tree
+func (t *btree) blocks() (blks []payload, err error) {
+	defer t.catch(&err)
+	for n := t.findFirstLeaf(); n != nil; n = t.nextLeaf(n) {
+		for i := 0; i < n.numk; i++ {
+			blks = append(blks, payload{key: n.keys[i], pos: n.ptrs[i]})
 		}
-		close(ch)
-	}()
-	return ch
+	}
+	return blks, nil
 }
 
-// first insertion, start a new btree
+// moves the record for key toward the front of the data file, as
+// long as it is still stored at block position pos. returns true
+// if the record was moved. the old copy is left at pos, to be cut
+// once the new one (and the index) has been synced.
+func (t *btree) move(key []byte, pos int) (ok bool, err error) {
+	defer t.repair(&err)
+	if err := t.heal(); err != nil {
+		return false, err
+	}
+	leaf, i := t.find(key)
+	if i < 0 || leaf.ptrs[i] != pos {
+		// deleted or moved since its position was taken
+		return false, nil
+	}
+	to, ok := t.ngin.move(pos)
+	if !ok {
+		return false, nil
+	}
+	t.pgr.begin()
+	leaf.ptrs[i] = to
+	t.dirty(leaf)
+	return true, t.commit()
+}
 
-/*
-func startNewbtree(key []byte, blk *block) *node {
-	root := newLeaf()
-	root.keys[0] = key
-	root.ptrs[0] = unsafe.Pointer(blk)
-	root.ptrs[M-1] = nil
-	root.rent = nil
-	root.numk++
-	return root
+// calls fn with the key and value of every live record in key order,
+// starting after the key after (or at the first record, if after is
+// nil), until fn returns false or an error
+func (t *btree) scan(after []byte, fn func(key, val []byte) (bool, error)) (err error) {
+	defer t.catch(&err)
+	n, i := t.findFirstLeaf(), 0
+	if after != nil {
+		if n, i = t.seek(after); n != nil && i < n.numk && bytes.Equal(n.keys[i], after) {
+			i++
+		}
+	}
+	for ; n != nil; n, i = t.nextLeaf(n), 0 {
+		for ; i < n.numk; i++ {
+			val, exp, err := t.ngin.getRecordVal(n.ptrs[i])
+			if err != nil || expired(exp) {
+				// unreadable records are left for Check to report
+				continue
+			}
+			if more, err := fn(n.keys[i], val); err != nil || !more {
+				return err
+			}
+		}
+	}
+	return nil
 }
-*/
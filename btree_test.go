@@ -3,6 +3,8 @@ package godb
 import (
 	"bytes"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"testing"
@@ -11,115 +13,157 @@ import (
 // count should print count... duh
 var btree_tree *btree
 
+// store holding btree_tree
+var btree_store *store
+
+// open a tree on the memory backend, failing the test on error
+func openTestTree(tb testing.TB) *btree {
+	st, err := openStore("btree_test", newOptions([]Option{WithBackend(Memory)}))
+	if err != nil {
+		tb.Fatalf("opening tree: %s\n", err)
+	}
+	btree_store = st
+	return st.idx
+}
+
+// close the tree opened by openTestTree, failing the test on error
+func closeTestTree(tb testing.TB) {
+	if err := btree_store.close(); err != nil {
+		tb.Fatalf("closing tree: %s\n", err)
+	}
+}
+
 // test has
 func Test_BTree_Has(t *testing.T) {
-	btree_tree = new(btree)
-	if ok := btree_tree.has([]byte{0x42}); ok {
-		t.Fatalf("expexted nil, got: %v\n", ok)
+	btree_tree = openTestTree(t)
+	defer closeTestTree(t)
+	if ok, _ := btree_tree.has([]byte{0x42}); ok {
+		t.Fatalf("expexted false, got: %v\n", ok)
 	}
 	if btree_tree.count != 0 {
 		t.Fatalf("expected 0, got: %v\n", btree_tree.count)
 	}
+	btree_tree.set([]byte{0x42}, []byte{0x99}, 0, 1)
+	if ok, _ := btree_tree.has([]byte{0x42}); !ok {
+		t.Fatalf("expexted true, got: %v\n", ok)
+	}
 }
 
 // test add
 func Test_BTree_Add(t *testing.T) {
-	btree_tree = new(btree)
-	btree_tree.add([]byte{0x42}, []byte{0x99})
+	btree_tree = openTestTree(t)
+	defer closeTestTree(t)
+	if err := btree_tree.add([]byte{0x42}, []byte{0x99}); err != nil {
+		t.Fatalf("expected nil, got: %s\n", err)
+	}
 	if btree_tree.count != 1 {
 		t.Fatalf("expected 1, got: %d\n", btree_tree.count) // should be 1
 	}
 	if dat, _ := btree_tree.get([]byte{0x42}); !bytes.Equal(dat, []byte{0x99}) {
-		t.Fatalf("expected '0x99', got: %s\n", dat)
+		t.Fatalf("expected '0x99', got: %x\n", dat)
+	}
+	// overwrite record, should no work
+	if err := btree_tree.add([]byte{0x42}, []byte{0x77}); err == nil {
+		t.Fatalf("expected error adding an existing key, got: nil\n")
 	}
-	btree_tree.add([]byte{0x42}, []byte{0x77}) // overwrite record, should no work
 	if btree_tree.count != 1 {
 		t.Fatalf("expected 1, got: %d\n", btree_tree.count) // should be 1
 	}
 	if dat, _ := btree_tree.get([]byte{0x42}); !bytes.Equal(dat, []byte{0x99}) {
-		t.Fatalf("expected '0x99', got: %s\n", dat)
+		t.Fatalf("expected '0x99', got: %x\n", dat)
 	}
 	btree_tree.add([]byte{0x22}, []byte{0x44})
 	if btree_tree.count != 2 {
 		t.Fatalf("expected 2, got: %d\n", btree_tree.count) // should be 2
 	}
 	if dat, _ := btree_tree.get([]byte{0x22}); !bytes.Equal(dat, []byte{0x44}) {
-		t.Fatalf("expected '0x44', got: %s\n", dat)
+		t.Fatalf("expected '0x44', got: %x\n", dat)
 	}
 }
 
 // test get
 func Test_BTree_Get(t *testing.T) {
-	btree_tree = new(btree)
+	btree_tree = openTestTree(t)
+	defer closeTestTree(t)
 	if btree_tree.count != 0 {
 		t.Fatalf("expected 0, got: %d\n", btree_tree.count)
 	}
-	if dat, _ := btree_tree.get([]byte{0x11}); dat != nil {
-		t.Fatalf("expexted nil, got: %s\n", dat)
+	if dat, err := btree_tree.get([]byte{0x11}); dat != nil || err == nil {
+		t.Fatalf("expexted nil and an error, got: %x, %v\n", dat, err)
 	}
-	btree_tree.set([]byte{0x11}, []byte{0x01})
+	btree_tree.set([]byte{0x11}, []byte{0x01}, 0, 1)
 	if btree_tree.count != 1 {
 		t.Fatalf("expected 1, got: %d\n", btree_tree.count)
 	}
-	if dat, _ := btree_tree.get([]byte{0x11}); !bytes.Equal(dat, []byte{0x01}) {
-		t.Fatalf("expected '0x01', got: %s\n", dat)
+	if dat, err := btree_tree.get([]byte{0x11}); err != nil || !bytes.Equal(dat, []byte{0x01}) {
+		t.Fatalf("expected '0x01', got: %x, %v\n", dat, err)
 	}
 }
 
 // test set
 func Test_BTree_Set(t *testing.T) {
-	btree_tree = new(btree)
-	btree_tree.set([]byte{0x42}, []byte{0x99})
+	btree_tree = openTestTree(t)
+	defer closeTestTree(t)
+	btree_tree.set([]byte{0x42}, []byte{0x99}, 0, 1)
 	if btree_tree.count != 1 {
 		t.Fatalf("expected 1, got: %d\n", btree_tree.count) // should be 1
 	}
 	if dat, _ := btree_tree.get([]byte{0x42}); !bytes.Equal(dat, []byte{0x99}) {
-		t.Fatalf("expected '0x99', got: %s\n", dat)
+		t.Fatalf("expected '0x99', got: %x\n", dat)
 	}
-	btree_tree.set([]byte{0x42}, []byte{0x77}) // overwrite record
+	btree_tree.set([]byte{0x42}, []byte{0x77}, 0, 2) // overwrite record
 	if btree_tree.count != 1 {
 		t.Fatalf("expected 1, got: %d\n", btree_tree.count) // should be 1
 	}
 	if dat, _ := btree_tree.get([]byte{0x42}); !bytes.Equal(dat, []byte{0x77}) {
-		t.Fatalf("expected '0x77', got: %s\n", dat)
+		t.Fatalf("expected '0x77', got: %x\n", dat)
+	}
+	if ver, _ := btree_tree.version([]byte{0x42}); ver != 2 {
+		t.Fatalf("expected version 2, got: %d\n", ver)
 	}
-	btree_tree.set([]byte{0x22}, []byte{0x44})
+	btree_tree.set([]byte{0x22}, []byte{0x44}, 0, 3)
 	if btree_tree.count != 2 {
 		t.Fatalf("expected 2, got: %d\n", btree_tree.count) // should be 2
 	}
 	if dat, _ := btree_tree.get([]byte{0x22}); !bytes.Equal(dat, []byte{0x44}) {
-		t.Fatalf("expected '0x44', got: %s\n", dat)
+		t.Fatalf("expected '0x44', got: %x\n", dat)
 	}
 }
 
 // test del
 func Test_BTree_Del(t *testing.T) {
-	btree_tree = new(btree)
-	btree_tree.del([]byte{0x11}) // delete non-existant key
-	if btree_tree.count != 0 {   // check to make sure count doesn't decrement unnecessarily
+	btree_tree = openTestTree(t)
+	defer closeTestTree(t)
+	if err := btree_tree.del([]byte{0x11}); err == nil { // delete non-existant key
+		t.Fatalf("expected error deleting a missing key, got: nil\n")
+	}
+	if btree_tree.count != 0 { // check to make sure count doesn't decrement unnecessarily
 		t.Fatalf("expected size=0, got: %d\n", btree_tree.count) // should be 0
 	}
-	btree_tree.set([]byte{0x11}, []byte{0x11}) // set key
-	btree_tree.del([]byte{0x01})               // attempty to delete key that doesn't exist
-	if btree_tree.count != 1 {                 // check to make sure count doesn't decrement unnecessarily
+	btree_tree.set([]byte{0x11}, []byte{0x11}, 0, 1) // set key
+	btree_tree.del([]byte{0x01})                     // attempty to delete key that doesn't exist
+	if btree_tree.count != 1 {                       // check to make sure count doesn't decrement unnecessarily
 		t.Fatalf("expected size=1, got: %d\n", btree_tree.count) // should be 1
 	}
-	btree_tree.set([]byte{0x22}, []byte{0x22})
+	btree_tree.set([]byte{0x22}, []byte{0x22}, 0, 2)
 	if btree_tree.count != 2 { // check to make sure count is correct
 		t.Fatalf("expected size=2, got: %d\n", btree_tree.count) // should be 2
 	}
-	btree_tree.set([]byte{0x33}, []byte{0x33}) // count=3
-	btree_tree.set([]byte{0x44}, []byte{0x44}) // count=4
-	if btree_tree.count != 4 {                 // check to make sure count is correct
+	btree_tree.set([]byte{0x33}, []byte{0x33}, 0, 3) // count=3
+	btree_tree.set([]byte{0x44}, []byte{0x44}, 0, 4) // count=4
+	if btree_tree.count != 4 {                       // check to make sure count is correct
 		t.Fatalf("expected size=4, got: %d\n", btree_tree.count) // should be 4
 	}
 	btree_tree.del([]byte{0x33}) // del 0x33, now count=3
 	if btree_tree.count != 3 {   // check to make sure count doesn't decrement unnecessarily
 		t.Fatalf("expected size=3, got: %d\n", btree_tree.count) // should be 3
 	}
-	btree_tree.set([]byte{0x55}, []byte{0x55}) // put 0x55, count=4
-	btree_tree.del([]byte{0x11})               // del 0x11, count=3
-	if btree_tree.count != 3 {                 // check to make sure count is correct
+	if ok, _ := btree_tree.has([]byte{0x33}); ok {
+		t.Fatalf("expected 0x33 to be gone\n")
+	}
+	btree_tree.set([]byte{0x55}, []byte{0x55}, 0, 5) // put 0x55, count=4
+	btree_tree.del([]byte{0x11})                     // del 0x11, count=3
+	if btree_tree.count != 3 {                       // check to make sure count is correct
 		t.Fatalf("expected size=3, got: %d\n", btree_tree.count)
 	}
 	btree_tree.del([]byte{0x44}) // del 0x44, count=2
@@ -134,6 +178,129 @@ func Test_BTree_Del(t *testing.T) {
 	}
 }
 
+// test that a tree closed cleanly is loaded from its index file when it
+// is opened again, and that one which was not is rebuilt from the data
+// file
+func Test_BTree_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reopen")
+	st, err := openStore(path, newOptions(nil))
+	if err != nil {
+		t.Fatalf("opening: %s\n", err)
+	}
+	// enough records to split the root a few times
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		if err := st.idx.set(k, k, 0, uint64(i+1)); err != nil {
+			t.Fatalf("setting %s: %s\n", k, err)
+		}
+	}
+	root := st.idx.root
+	if err := st.close(); err != nil {
+		t.Fatalf("closing: %s\n", err)
+	}
+
+	// the index was closed cleanly, so its meta page can be trusted
+	o := newOptions(nil)
+	o.fs = osFS{}
+	p, err := openPager(path, o)
+	if err != nil {
+		t.Fatalf("opening index: %s\n", err)
+	}
+	if p.stale || p.root != root || p.count != 1000 {
+		t.Fatalf("expected a clean index with root %d and 1000 records, got: stale=%v, root=%d, count=%d\n", root, p.stale, p.root, p.count)
+	}
+	if err := p.close(); err != nil {
+		t.Fatalf("closing index: %s\n", err)
+	}
+	checkTree := func(st *store) {
+		if st.idx.count != 1000 {
+			t.Fatalf("expected 1000 records, got: %d\n", st.idx.count)
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(strconv.Itoa(i))
+			if dat, err := st.idx.get(k); err != nil || !bytes.Equal(dat, k) {
+				t.Fatalf("expected %q, got: %q, %v\n", k, dat, err)
+			}
+		}
+	}
+	st, err = openStore(path, newOptions(nil))
+	if err != nil {
+		t.Fatalf("reopening: %s\n", err)
+	}
+	checkTree(st)
+
+	// now leave the index dirty, as if the process had died
+	st.log.close()
+	st.idx.pgr.file.Close()
+	st.idx.ngin.close()
+	meta, err := os.ReadFile(path + `.idx`)
+	if err != nil {
+		t.Fatalf("reading index: %s\n", err)
+	}
+	if meta[40] != fmDirty {
+		t.Fatalf("expected the index to be marked dirty\n")
+	}
+	st, err = openStore(path, newOptions(nil))
+	if err != nil {
+		t.Fatalf("reopening: %s\n", err)
+	}
+	defer st.close()
+	checkTree(st)
+}
+
+// test that a damaged node page in the index file is reported as an
+// error rather than crashing, and that the index is rebuilt from the
+// data file by the next write
+func Test_BTree_Damaged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "damaged")
+	st, err := openStore(path, newOptions(nil))
+	if err != nil {
+		t.Fatalf("opening: %s\n", err)
+	}
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		if err := st.idx.set(k, k, 0, uint64(i+1)); err != nil {
+			t.Fatalf("setting %s: %s\n", k, err)
+		}
+	}
+	root := st.idx.root
+	if err := st.close(); err != nil {
+		t.Fatalf("closing: %s\n", err)
+	}
+	// give the root node a length it can't have
+	fd, err := os.OpenFile(path+`.idx`, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("opening index: %s\n", err)
+	}
+	fd.WriteAt([]byte{0xFF, 0xFF, 0xFF, 0xFF}, int64(root*nodeSize+11))
+	fd.Close()
+
+	st, err = openStore(path, newOptions(nil))
+	if err != nil {
+		t.Fatalf("reopening: %s\n", err)
+	}
+	defer st.close()
+	if _, err := st.idx.get([]byte("42")); err == nil {
+		t.Fatalf("expected an error reading through a damaged node, got: nil\n")
+	}
+	if _, err := st.idx.has([]byte("42")); err == nil {
+		t.Fatalf("expected an error reading through a damaged node, got: nil\n")
+	}
+	// the next write rebuilds the index before it goes ahead
+	if err := st.idx.set([]byte("1000"), []byte("1000"), 0, 1001); err != nil {
+		t.Fatalf("setting after damage: %s\n", err)
+	}
+	if st.idx.count != 1001 {
+		t.Fatalf("expected 1001 records, got: %d\n", st.idx.count)
+	}
+	for i := 0; i <= 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		if dat, err := st.idx.get(k); err != nil || !bytes.Equal(dat, k) {
+			t.Fatalf("expected %q, got: %q, %v\n", k, dat, err)
+		}
+	}
+}
+
 // btree set sequential
 func Benchmark_BTree_SetSeq_1e3(b *testing.B) {
 	benchmark_BTree_SetSeq(b, 1e3)
@@ -155,17 +322,17 @@ func benchmark_BTree_SetSeq(b *testing.B, n int) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		btree_tree = new(btree)
+		btree_tree = openTestTree(b)
 		debug.FreeOSMemory()
 		b.StartTimer()
 		for j := 0; j < n; j++ {
-			btree_tree.set([]byte(strconv.Itoa(j)), []byte{0xde, 0xad, 0xbe, 0xef})
+			btree_tree.set([]byte(strconv.Itoa(j)), []byte{0xde, 0xad, 0xbe, 0xef}, 0, 0)
 		}
 		b.StopTimer()
 		if btree_tree.count != n {
 			b.Fatalf("expected %d entries, got: %d entries instead\n", n, btree_tree.count)
 		}
-		btree_tree.close()
+		closeTestTree(b)
 	}
 	b.StopTimer()
 }
@@ -192,18 +359,18 @@ func benchmark_BTree_SetRnd(b *testing.B, n int) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		btree_tree = new(btree)
+		btree_tree = openTestTree(b)
 		debug.FreeOSMemory()
 		b.StartTimer()
 		for _, v := range a {
 			kv := strconv.Itoa(v)
-			btree_tree.set([]byte(kv), []byte{0xde, 0xad, 0xbe, 0xef})
+			btree_tree.set([]byte(kv), []byte{0xde, 0xad, 0xbe, 0xef}, 0, 0)
 		}
 		b.StopTimer()
 		if btree_tree.count != n {
 			b.Fatalf("expected %d entries, got: %d entries instead\n", n, btree_tree.count)
 		}
-		btree_tree.close()
+		closeTestTree(b)
 	}
 	b.StopTimer()
 }
@@ -226,9 +393,9 @@ func Benchmark_BTree_GetSeq_1e5(b *testing.B) {
 // }
 
 func benchmark_BTree_GetSeq(b *testing.B, n int) {
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	for i := 0; i < n; i++ {
-		btree_tree.set([]byte(strconv.Itoa(i)), []byte{0xde, 0xad, 0xbe, 0xef})
+		btree_tree.set([]byte(strconv.Itoa(i)), []byte{0xde, 0xad, 0xbe, 0xef}, 0, 0)
 	}
 	debug.FreeOSMemory()
 	b.ResetTimer()
@@ -241,7 +408,7 @@ func benchmark_BTree_GetSeq(b *testing.B, n int) {
 		}
 	}
 	b.StopTimer()
-	btree_tree.close()
+	closeTestTree(b)
 }
 
 // btree get random
@@ -262,10 +429,10 @@ func Benchmark_BTree_GetRnd_1e5(b *testing.B) {
 // }
 
 func benchmark_BTree_GetRnd(b *testing.B, n int) {
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	a := rand.New(rand.NewSource(59684)).Perm(n)
 	for _, v := range a { // fill tree with random data
-		btree_tree.set([]byte(strconv.Itoa(v)), []byte{0xde, 0xad, 0xbe, 0xef})
+		btree_tree.set([]byte(strconv.Itoa(v)), []byte{0xde, 0xad, 0xbe, 0xef}, 0, 0)
 	}
 	debug.FreeOSMemory() // free memory, run gc
 	b.ResetTimer()       // and reset timer
@@ -278,7 +445,7 @@ func benchmark_BTree_GetRnd(b *testing.B, n int) {
 		}
 	}
 	b.StopTimer() // stop the timer and close btree_tree.
-	btree_tree.close()
+	closeTestTree(b)
 }
 
 // btree del sequential
@@ -299,9 +466,9 @@ func Benchmark_BTree_DelSeq_1e5(b *testing.B) {
 // }
 
 func benchmark_BTree_DelSeq(b *testing.B, n int) {
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	for i := 0; i < n; i++ {
-		btree_tree.set([]byte(strconv.Itoa(i)), []byte{0xde, 0xad, 0xbe, 0xef})
+		btree_tree.set([]byte(strconv.Itoa(i)), []byte{0xde, 0xad, 0xbe, 0xef}, 0, 0)
 	}
 	debug.FreeOSMemory()
 	b.ResetTimer()
@@ -310,14 +477,14 @@ func benchmark_BTree_DelSeq(b *testing.B, n int) {
 			kv := []byte(strconv.Itoa(j))
 			btree_tree.del(kv)
 			b.StopTimer()
-			if btree_tree.has(kv) {
+			if ok, _ := btree_tree.has(kv); ok {
 				b.Fatalf("key %s exists", kv)
 			}
 			b.StartTimer()
 		}
 	}
 	b.StopTimer()
-	btree_tree.close()
+	closeTestTree(b)
 }
 
 // btree get random
@@ -338,10 +505,10 @@ func Benchmark_BTree_DelRnd_1e5(b *testing.B) {
 // }
 
 func benchmark_BTree_DelRnd(b *testing.B, n int) {
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	a := rand.New(rand.NewSource(65489)).Perm(n)
 	for _, v := range a { // fill tree with random data
-		btree_tree.set([]byte(strconv.Itoa(v)), []byte{0xde, 0xad, 0xbe, 0xef})
+		btree_tree.set([]byte(strconv.Itoa(v)), []byte{0xde, 0xad, 0xbe, 0xef}, 0, 0)
 	}
 	debug.FreeOSMemory() // free memory, run gc
 	b.ResetTimer()       // and reset timer
@@ -350,21 +517,21 @@ func benchmark_BTree_DelRnd(b *testing.B, n int) {
 			kv := []byte(strconv.Itoa(v))
 			btree_tree.del(kv)
 			b.StopTimer()
-			if btree_tree.has(kv) {
+			if ok, _ := btree_tree.has(kv); ok {
 				b.Fatalf("key %s exists", kv)
 			}
 			b.StartTimer()
 		}
 	}
 	b.StopTimer() // stop the timer and close btree_tree.
-	btree_tree.close()
+	closeTestTree(b)
 }
 
 // OTHER TESTING....
 /*
 func Benchmark_BTree_Has(b *testing.B) {
 	b.StopTimer()
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
 		d := data("data-%.3d", i)
@@ -374,38 +541,38 @@ func Benchmark_BTree_Has(b *testing.B) {
 		}
 	}
 	b.StopTimer()
-	btree_tree.close()
+	closeTestTree(b)
 }
 
 func Benchmark_BTree_Add(b *testing.B) {
 	b.StopTimer()
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
 		d := data("data-%.3d", i)
 		btree_tree.add(d, d)
 	}
 	b.StopTimer()
-	btree_tree.close()
+	closeTestTree(b)
 }
 
 func Benchmark_BTree_Set(b *testing.B) {
 	b.StopTimer()
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
 		d := data("data-%.3d", i)
-		btree_tree.set(d, d)
+		btree_tree.set(d, d, 0, 0)
 	}
 	b.StopTimer()
-	btree_tree.close()
+	closeTestTree(b)
 }
 
 func Benchmark_BTree_Get(b *testing.B) {
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	for i := 0; i < b.N; i++ {
 		d := data("data-%.3d", i)
-		btree_tree.set(d, d)
+		btree_tree.set(d, d, 0, 0)
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -415,14 +582,14 @@ func Benchmark_BTree_Get(b *testing.B) {
 		}
 	}
 	b.StopTimer()
-	btree_tree.close()
+	closeTestTree(b)
 }
 
 func Benchmark_BTree_Del(b *testing.B) {
-	btree_tree = new(btree)
+	btree_tree = openTestTree(b)
 	for i := 0; i < b.N; i++ {
 		d := data("data-%.3d", i)
-		btree_tree.set(d, d)
+		btree_tree.set(d, d, 0, 0)
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -430,6 +597,6 @@ func Benchmark_BTree_Del(b *testing.B) {
 		btree_tree.del(d)
 	}
 	b.StopTimer()
-	btree_tree.close()
+	closeTestTree(b)
 }
 */
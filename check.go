@@ -0,0 +1,164 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cagnosolutions/msgpack"
+)
+
+// CheckReport describes what Check (or Repair) found when walking
+// every page of a collection's data file
+type CheckReport struct {
+	Records  int     // intact records found in the data file
+	Indexed  int     // records held in the index
+	Problems []error // everything found wrong; a *CorruptError for each bad record
+
+	bad []payload // runs of pages holding bad records
+}
+
+// OK reports whether nothing was found wrong
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// record a bad run of pages and what was wrong with it
+func (r *CheckReport) reject(p payload, err error) {
+	r.Problems = append(r.Problems, err)
+	r.bad = append(r.bad, p)
+}
+
+// walk every record in ngin. each one must be framed correctly (see
+// extent), hold a value that decodes as msgpack (unless raw is set, as
+// it is for a blob store), and have a key not already seen; the index
+// would only load the first copy of a key.
+func scan(ngin storage, raw bool) *CheckReport {
+	r := new(CheckReport)
+	seen := make(map[string]int)
+	for p := range ngin.loadAllRecords() {
+		if p.err != nil {
+			r.reject(p, p.err)
+			continue
+		}
+		if first, ok := seen[string(p.key)]; ok {
+			r.reject(p, &CorruptError{p.pos, fmt.Sprintf("duplicate key (first seen at block %d)", first)})
+			continue
+		}
+		seen[string(p.key)] = p.pos
+		// it is live (and indexed) from here on, even if its value is bad
+		r.Records++
+		val, _, err := ngin.getRecordVal(p.pos)
+		if err != nil {
+			r.reject(p, err)
+			continue
+		}
+		if raw {
+			continue
+		}
+		var v interface{}
+		if err := msgpack.Unmarshal(val, &v); err != nil {
+			r.reject(p, &CorruptError{p.pos, fmt.Sprintf("value is not valid msgpack -> %s", err)})
+		}
+	}
+	return r
+}
+
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//		CHECK AND REPAIR	//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+
+// check every record in the store, and that the index holds them all.
+// raw is set for a blob store, which holds values as they are.
+func (s *store) check(raw bool) *CheckReport {
+	r := scan(s.idx.ngin, raw)
+	r.Indexed = s.idx.count
+	if r.Indexed != r.Records {
+		r.Problems = append(r.Problems, fmt.Errorf("check: index holds %d records, but %d were found in the data file", r.Indexed, r.Records))
+	}
+	return r
+}
+
+// Check walks every page of the collection's data file, reporting any
+// record that is damaged, has a value that does not decode, or repeats
+// a key, and whether the index holds every record. reads carry on while
+// it runs, but writes wait for it to finish.
+func (c *Collection) Check() *CheckReport {
+	c.RLock()
+	r := c.st.check(false)
+	c.RUnlock()
+	return r
+}
+
+// Repair checks the collection at path, then moves every bad record it
+// finds out of the data file and into a quarantine file (path +
+// `.quarantine`), and rebuilds the index and free page map from what
+// is left. it is an offline operation; the collection must not be open
+// while it is repaired. it returns what was found before repairing.
+// a collection's blob store is repaired on its own, with its path
+// (path + `.blob`); its values are not expected to be msgpack.
+//
+// each run of pages in the quarantine file is stored as it was in the
+// data file (still encrypted, if the collection is), behind a header:
+//
+//	[0:8]  first page of the run in the data file
+//	[8:12] length of the run in bytes
+func Repair(path string, opts ...Option) (*CheckReport, error) {
+	o := newOptions(opts)
+	if o.backend == Memory {
+		return nil, fmt.Errorf("repair: an in-memory collection cannot be repaired")
+	}
+	o.readOnly = false
+	st, err := openStore(path, o)
+	if err != nil {
+		return nil, err
+	}
+	r := st.check(strings.HasSuffix(path, `.blob`))
+	if len(r.bad) > 0 {
+		if err := quarantine(st, path+`.quarantine`, r.bad); err != nil {
+			st.close()
+			return r, err
+		}
+	}
+	if err := st.close(); err != nil {
+		return r, err
+	}
+	if r.OK() {
+		return r, nil
+	}
+	// the index (and the record count) are rebuilt from the data file
+	// the next time it is opened
+	for _, ext := range []string{`.idx`, `.fm`} {
+		if err := os.Remove(path + ext); err != nil && !os.IsNotExist(err) {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// copy each bad run of pages to the quarantine file at path, then
+// cut them out of the store once the file has been synced
+func quarantine(st *store, path string, bad []payload) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	for _, p := range bad {
+		b := st.idx.ngin.raw(p.pos, p.n)
+		hdr := make([]byte, 12)
+		binary.BigEndian.PutUint64(hdr[0:8], uint64(p.pos))
+		binary.BigEndian.PutUint32(hdr[8:12], uint32(len(b)))
+		if _, err := fd.Write(append(hdr, b...)); err != nil {
+			return fmt.Errorf("repair: error writing quarantine file -> %s", err)
+		}
+	}
+	if err := fd.Sync(); err != nil {
+		return fmt.Errorf("repair: error syncing quarantine file -> %s", err)
+	}
+	for _, p := range bad {
+		st.idx.ngin.cut(p.pos, p.n)
+	}
+	return nil
+}
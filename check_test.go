@@ -0,0 +1,75 @@
+package godb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// test that Check reports a record whose checksum no longer matches,
+// and an index that has lost records, and that Repair quarantines the
+// one and rebuilds the other
+func Test_Check_Repair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "check")
+	c := openTestCollection(t, path)
+	for i := 0; i < 100; i++ {
+		c.Set(i, make([]byte, 500))
+	}
+	if r := c.Check(); !r.OK() || r.Records != 100 || r.Indexed != 100 {
+		t.Fatalf("expected 100 records and no problems, got: %d, %d, %v\n", r.Records, r.Indexed, r.Problems)
+	}
+	blks, _ := c.st.blocks()
+	bad, lost := blks[10], blks[20:22]
+	e := c.st.idx.ngin.(*engine)
+	flipByte(c, bad.pos*e.page+pgHdr+100)
+	// drop records from the index, but not the data file
+	tr := c.st.idx
+	for _, blk := range lost {
+		leaf, _ := tr.find(blk.key)
+		tr.pgr.begin()
+		tr.count--
+		tr.root = tr.deleteEntry(tr.node(tr.root), leaf, blk.key, blk.pos).id
+		if err := tr.commit(); err != nil {
+			t.Fatalf("dropping from index: %s\n", err)
+		}
+	}
+	// the bad record is still indexed, but no longer counts as one
+	r := c.Check()
+	if r.Records != 99 || r.Indexed != 98 || len(r.Problems) != 2 {
+		t.Fatalf("expected 99 records, 98 indexed and 2 problems, got: %d, %d, %v\n", r.Records, r.Indexed, r.Problems)
+	}
+	var cerr *CorruptError
+	if !errors.As(r.Problems[0], &cerr) || cerr.Block != bad.pos || cerr.Reason != "checksum mismatch" {
+		t.Fatalf("expected a checksum mismatch at block %d, got: %v\n", bad.pos, r.Problems[0])
+	}
+	c.Close()
+
+	r, err := Repair(path)
+	if err != nil {
+		t.Fatalf("repairing: %s\n", err)
+	}
+	if len(r.Problems) != 2 {
+		t.Fatalf("expected the same 2 problems, got: %v\n", r.Problems)
+	}
+	if fi, err := os.Stat(path + ".quarantine"); err != nil || fi.Size() == 0 {
+		t.Fatalf("expected the bad record to be quarantined, got: %v\n", err)
+	}
+	c = openTestCollection(t, path)
+	defer c.Close()
+	if r := c.Check(); !r.OK() || r.Records != 99 || r.Indexed != 99 {
+		t.Fatalf("expected 99 records and no problems, got: %d, %d, %v\n", r.Records, r.Indexed, r.Problems)
+	}
+	// the lost records are back in the index, and the bad one is gone
+	var b []byte
+	for _, blk := range lost {
+		k, _ := DecodeKey(blk.key)
+		if err := c.Get(k, &b); err != nil || len(b) != 500 {
+			t.Fatalf("expected record %v to be indexed again, got: %v\n", k, err)
+		}
+	}
+	k, _ := DecodeKey(bad.key)
+	if err := c.Get(k, &b); err == nil {
+		t.Fatalf("expected the bad record to be gone\n")
+	}
+}
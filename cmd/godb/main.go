@@ -0,0 +1,90 @@
+// Command godb is a tool for looking after godb collections.
+//
+//	godb check [-repair] [-key hex] <path>
+//
+// check walks every page of the collection at path (given without
+// an extension, as to godb.OpenCollection) and reports anything it
+// finds wrong with it. with -repair, bad records are moved to a
+// quarantine file (path.quarantine) and the collection's index is
+// rebuilt from what is left. a collection that was not closed cleanly
+// can't be checked without -repair, as its write-ahead log has to be
+// replayed first; check reports that instead. check exits with status
+// 1 if anything was found wrong (or needs recovering), and 2 if the
+// collection could not be checked.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cagnosolutions/godb"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: godb check [-repair] [-key hex] <path>\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "check" {
+		usage()
+	}
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "quarantine bad records and rebuild the index")
+	key := fs.String("key", "", "encryption key of the collection, in hex")
+	fs.Usage = usage
+	fs.Parse(os.Args[2:])
+	if fs.NArg() != 1 {
+		usage()
+	}
+	os.Exit(check(fs.Arg(0), *key, *repair))
+}
+
+// check (and optionally repair) the collection at path, returning
+// the exit status
+func check(path, key string, repair bool) int {
+	var opts []godb.Option
+	if key != "" {
+		k, err := hex.DecodeString(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "godb: invalid key: %s\n", err)
+			return 2
+		}
+		opts = append(opts, godb.WithEncryption(k))
+	}
+	var r *godb.CheckReport
+	if repair {
+		var err error
+		if r, err = godb.Repair(path, opts...); err != nil {
+			fmt.Fprintf(os.Stderr, "godb: %s\n", err)
+			return 2
+		}
+	} else {
+		c, err := godb.OpenCollection(path, append(opts, godb.ReadOnly())...)
+		if err == godb.ErrNeedsRecovery {
+			// checking it read-only would mean leaving out what is in
+			// its write-ahead log
+			fmt.Printf("%s: not closed cleanly; its write-ahead log must be replayed before it can be checked (run with -repair, or open it for writing)\n", path)
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "godb: %s\n", err)
+			return 2
+		}
+		r = c.Check()
+		c.Close()
+	}
+	for _, err := range r.Problems {
+		fmt.Println(err)
+	}
+	fmt.Printf("%s: %d records, %d indexed, %d problems\n", path, r.Records, r.Indexed, len(r.Problems))
+	if r.OK() {
+		return 0
+	}
+	if repair {
+		fmt.Printf("%s: bad records moved to %s.quarantine; index will be rebuilt on next open\n", path, path)
+	}
+	return 1
+}
@@ -2,34 +2,40 @@ package godb
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"log"
-	"os"
-	"runtime"
 	"sync"
+	"time"
 
 	"github.com/cagnosolutions/msgpack"
 )
 
 type Collection struct {
-	st  *store
-	dsn string
-	buf *bytes.Buffer
+	st    *store
+	blobs *store // blob store, opened the first time it is needed
+	opts  *options
+	stop  chan struct{} // closed to stop the reaper
+	done  chan struct{} // closed once the reaper has stopped
+	dsn   string
 	sync.RWMutex
 }
 
-func OpenCollection(path string) (*Collection, error) {
-	st, err := openStore(path)
+// OpenCollection opens (or creates) the collection stored at path,
+// configured by any options given
+func OpenCollection(path string, opts ...Option) (*Collection, error) {
+	o := newOptions(opts)
+	st, err := openStore(path, o)
 	if err != nil {
 		return nil, err
 	}
 	c := &Collection{
-		st:  st,
-		dsn: path,
-		buf: bytes.NewBuffer(make([]byte, maxKey, maxKey)),
+		st:   st,
+		opts: o,
+		dsn:  path,
+	}
+	if st.idx.ngin.expiring() {
+		c.startReaper()
 	}
-	c.buf.Reset()
 	return c, nil
 }
 
@@ -41,19 +47,39 @@ func logger(err error) error {
 	return err
 }
 
-func verify(key, val []byte) error {
+// check key and val are small enough to store in a data file whose
+// records hold vals of up to maxVal bytes
+func verify(key, val []byte, maxVal int) error {
 	if len(key) > maxKey {
-		return fmt.Errorf("verify: key exceeds maximum key length of %d bytes, by %d bytes\n", maxKey, len(key)-maxKey)
+		return ErrKeySize
 	}
 	if len(val) > maxVal {
-		return ErrPageSize // trigger disk page grow
+		return ErrPageSize
 	}
 	return nil
 }
 
 // do a bounds check and return size of marshaled value
 func (c *Collection) boundscheck(key, val interface{}) ([]byte, []byte, error) {
-	k, err := c.genKey(key)
+	k, v, err := encodeKeyVal(key, val)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the limit is set when the collection is opened, and never changes
+	if err := verify(k, v, c.st.idx.ngin.maxValSize()); err != nil {
+		return nil, nil, fmt.Errorf("collection: error while veryifying data (%q)", err)
+	}
+	return k, v, nil
+}
+
+// encode key and marshal val. neither depends on the collection, so a
+// transaction can do it for a collection it hasn't opened yet; the val
+// is checked against the collection's limit once it has been.
+func encodeKeyVal(key, val interface{}) ([]byte, []byte, error) {
+	k, err := genKey(key)
+	if err == ErrKeySize {
+		return nil, nil, err
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("collection: error while generating key (%q)", err)
 	}
@@ -61,161 +87,78 @@ func (c *Collection) boundscheck(key, val interface{}) ([]byte, []byte, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("collection: error while attempting to marshal (%q)", err)
 	}
-	if err := verify(k, v); err != nil {
-		if err != ErrPageSize {
-			return nil, nil, fmt.Errorf("collection: error while veryifying data (%q)", err)
-		}
-		return k, v, err
-	}
 	return k, v, nil
 }
 
+// encode k as a key. keys are encoded before the collection is locked,
+// so each call encodes into a buffer of its own.
 func (c *Collection) genKey(k interface{}) ([]byte, error) {
-	switch k.(type) {
-	case string:
-		k = []byte(k.(string))
-	case int:
-		k = int64(k.(int))
-	case uint:
-		k = uint64(k.(uint))
-	}
-	if err := binary.Write(c.buf, binary.BigEndian, k); err != nil {
-		c.buf.Reset()
+	return genKey(k)
+}
+
+// encode k as a key, checking it is small enough to store
+func genKey(k interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeKey(&buf, k); err != nil {
 		return nil, err
 	}
-	key := make([]byte, maxKey, maxKey)
-	if c.buf.Len() > maxKey {
-		c.buf.Truncate(maxKey)
+	if buf.Len() > maxKey {
+		return nil, ErrKeySize
 	}
-	copy(key[maxKey-c.buf.Len():], c.buf.Bytes())
-	c.buf.Reset()
-	return key, nil
+	return buf.Bytes(), nil
 }
 
-// align to nearest 4KB chunk
-func align(size int) int {
-	if size > 0 {
-		return (size + (1 << 12) - 1) &^ ((1 << 12) - 1)
+func (c *Collection) Add(key, val interface{}) error {
+	// generate key and val, also bounds check
+	k, v, err := c.boundscheck(key, val)
+	if err != nil {
+		return logger(err)
 	}
-	return 1 << 12 // 4KB
-}
-
-// grow the page size on disk
-func (c *Collection) growPageSizeOnDisk(valsz int) error {
 	c.Lock()
-	defer c.Unlock()
-	// new page size
-	ps := align(valsz)
-	// create new index using new page size
-	if err := createEmptyFile(c.dsn+`_.ix`, ps); err != nil {
-		return err
-	}
-	// new file size
-	fs := c.st.count() * ps
-	// create new file using new page size * number of current records
-	if err := createEmptyFile(c.dsn+`_.db`, fs); err != nil {
-		return err
-	}
-	// create new engine
-	en := new(engine)
-	// open path to new "grown" engine
-	if _, err := en.open(c.dsn + `_`); err != nil {
-		// something went wrong; clean up temp files
-		if err := os.Remove(c.dsn + `_.ix`); err != nil {
-			return err
-		}
-		if err := os.Remove(c.dsn + `_.db`); err != nil {
-			return err
-		}
-		return err
-	}
-	// iterate memory mapped records, add them to the new store
-	for pos := 0; true; pos++ {
-		rec, err := c.st.getRecordFromEngine(pos)
-		if err != nil {
-			if err == ErrEngineEOF {
-				break
-			} else if err == ErrEmptyRecord {
-				continue
-			}
-		}
-		// no errors, so add record directly to the new engine (ignore page offset addRecord returns)
-		if _, err := en.addRecord(rec); err != nil {
-			return err
-		}
-	}
-	// close new store so everything syncs
-	if err := en.close(); err != nil {
-		return err
-	}
-	// close the existing store and set to nil
-	if err := c.st.close(); err != nil {
-		return err
-	}
-	// set current store to nil now that is's closed
-	c.st = nil
-	// next remove existing store files
-	if err := os.Remove(c.dsn + `.ix`); err != nil {
-		return err
-	}
-	if err := os.Remove(c.dsn + `.db`); err != nil {
-		return err
-	}
-	// rename new engine files
-	if err := os.Rename(c.dsn+`_.ix`, c.dsn+`.ix`); err != nil {
-		return err
-	}
-	if err := os.Rename(c.dsn+`_.db`, c.dsn+`.db`); err != nil {
-		return err
-	}
-	// reopen store now utilizing new "grown" engine
-	s, err := openStore(c.dsn)
-	if err != nil {
-		return err
+	seq, err := c.st.add(k, v)
+	c.Unlock()
+	if err == nil {
+		err = c.st.wait(seq)
 	}
-	// force a garbage collect before we re-open the store
-	runtime.GC()
-	// re-assign new "grown" store to this collection
-	c.st = s
-	// everything went fine, so return a nil error
-	return nil
+	return logger(err)
 }
 
-func (c *Collection) Add(key, val interface{}) error {
-	// generate key and val, also bounds and grow check
+func (c *Collection) Set(key, val interface{}) error {
+	// generate key and val, also bounds check
 	k, v, err := c.boundscheck(key, val)
 	if err != nil {
-		if err == ErrPageSize {
-			// grow underlying file and proceed (method locks on its own)
-			if err := c.growPageSizeOnDisk(len(v)); err != nil {
-				return logger(err)
-			}
-		} else {
-			return logger(err)
-		}
+		return logger(err)
 	}
 	c.Lock()
-	err = c.st.add(k, v)
+	seq, err := c.st.set(k, v, 0)
 	c.Unlock()
+	if err == nil {
+		err = c.st.wait(seq)
+	}
 	return logger(err)
 }
 
-func (c *Collection) Set(key, val interface{}) error {
-	// generate key and val, also bounds and grow check
+// SetWithTTL sets val for key like Set, but only for d. once d has
+// passed the record is treated as missing, and is deleted the next
+// time the reaper runs.
+func (c *Collection) SetWithTTL(key, val interface{}, d time.Duration) error {
+	if d <= 0 {
+		return logger(fmt.Errorf("collection: ttl must be positive, got %s", d))
+	}
+	// generate key and val, also bounds check
 	k, v, err := c.boundscheck(key, val)
 	if err != nil {
-		if err == ErrPageSize {
-			// grow underlying file and proceed (method locks on its own)
-			if err := c.growPageSizeOnDisk(len(v)); err != nil {
-				return logger(err)
-			}
-		} else {
-			return logger(err)
-		}
+		return logger(err)
 	}
 	c.Lock()
-	err = c.st.set(k, v)
+	seq, err := c.st.set(k, v, time.Now().Add(d).UnixNano())
+	if err == nil {
+		c.startReaper()
+	}
 	c.Unlock()
+	if err == nil {
+		err = c.st.wait(seq)
+	}
 	return logger(err)
 }
 
@@ -230,27 +173,83 @@ func (c *Collection) Get(key, ptr interface{}) error {
 	return logger(err)
 }
 
+// GetWithVersion reads the value under key into ptr like Get, and
+// returns the version of its record. every write to a record gives it
+// a new version, higher than any given out before in the collection.
+func (c *Collection) GetWithVersion(key, ptr interface{}) (uint64, error) {
+	k, err := c.genKey(key)
+	if err != nil {
+		return 0, logger(err)
+	}
+	c.RLock()
+	ver, err := c.st.getVersion(k, ptr)
+	c.RUnlock()
+	return ver, logger(err)
+}
+
+// SetIf sets val for key like Set, but only if the record for key is
+// still at version ver, as returned by GetWithVersion. if it has been
+// written (or deleted) since, it fails with ErrVersionConflict. if ver
+// is 0, val is only set if there is no record for key. a ttl the
+// record was set with is kept.
+func (c *Collection) SetIf(key, val interface{}, ver uint64) error {
+	// generate key and val, also bounds check
+	k, v, err := c.boundscheck(key, val)
+	if err != nil {
+		return logger(err)
+	}
+	c.Lock()
+	seq, err := c.st.setIf(k, v, ver)
+	c.Unlock()
+	if err == nil {
+		err = c.st.wait(seq)
+	}
+	return logger(err)
+}
+
+// Update reads the value under key into ptr, calls fn to change it,
+// then writes ptr back, all while the collection is locked for
+// writing, so no other write can come in between. if fn returns an
+// error nothing is written, and Update returns it. fn must not call
+// any method of the collection, or it will deadlock.
+func (c *Collection) Update(key, ptr interface{}, fn func() error) error {
+	k, err := c.genKey(key)
+	if err != nil {
+		return logger(err)
+	}
+	c.Lock()
+	seq, err := c.st.update(k, ptr, fn)
+	c.Unlock()
+	if err == nil {
+		err = c.st.wait(seq)
+	}
+	return logger(err)
+}
+
 func (c *Collection) Del(key interface{}) error {
 	k, err := c.genKey(key)
 	if err != nil {
 		return logger(err)
 	}
 	c.Lock()
-	err = c.st.del(k)
+	seq, err := c.st.del(k)
 	c.Unlock()
+	if err == nil {
+		err = c.st.wait(seq)
+	}
 	return logger(err)
 }
 
 func (c *Collection) All(ptr interface{}) error {
 	c.RLock()
-	err := c.st.all(ptr)
+	_, err := c.st.all(ptr, nil)
 	c.RUnlock()
 	return logger(err)
 }
 
 func (c *Collection) Query(qry string, ptr interface{}) error {
 	c.RLock()
-	err := c.st.query(qry, ptr)
+	_, err := c.st.query(qry, ptr, nil)
 	c.RUnlock()
 	return logger(err)
 }
@@ -263,9 +262,128 @@ func (c *Collection) Count() int {
 	return n
 }
 
+// number of records moved each time the collection is locked while compacting
+const compactBatch = 64
+
+// Compact moves live records toward the front of the data file and
+// truncates the empty pages left at the end of it, returning the
+// number of bytes reclaimed. records are moved a few at a time and
+// the collection is only locked while they are, so reads are still
+// served while it runs.
+func (c *Collection) Compact() (int64, error) {
+	c.RLock()
+	blks, err := c.st.blocks()
+	c.RUnlock()
+	if err != nil {
+		return 0, logger(err)
+	}
+	for i := 0; i < len(blks); i += compactBatch {
+		j := i + compactBatch
+		if j > len(blks) {
+			j = len(blks)
+		}
+		c.Lock()
+		err := c.st.compact(blks[i:j])
+		c.Unlock()
+		if err != nil {
+			return 0, logger(err)
+		}
+	}
+	c.Lock()
+	n, err := c.st.truncate()
+	c.Unlock()
+	return n, logger(err)
+}
+
+// Sync flushes every mutation made to the collection so far to disk,
+// however its SyncPolicy is set (except SyncNever, where it does
+// nothing). it is how mutations are made durable with SyncManual.
+func (c *Collection) Sync() error {
+	c.RLock()
+	err := c.st.sync()
+	if err == nil && c.blobs != nil {
+		err = c.blobs.sync()
+	}
+	c.RUnlock()
+	return logger(err)
+}
+
+// number of expired records deleted each time the collection is locked while reaping
+const reapBatch = 64
+
+// default interval between reaps
+const reapInterval = time.Minute
+
+// start the reaper, unless it is already running or turned off. it is
+// only started once a record has been given an expiry, so a collection
+// that never uses SetWithTTL never has one. the collection must be
+// locked, unless it is still being opened.
+func (c *Collection) startReaper() {
+	if c.stop != nil || c.opts.reap <= 0 || c.opts.readOnly {
+		return
+	}
+	c.stop, c.done = make(chan struct{}), make(chan struct{})
+	go c.reaper(c.opts.reap, c.stop, c.done)
+}
+
+// reaper deletes expired records every d, until stop is closed, then
+// closes done
+func (c *Collection) reaper(d time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			c.reap()
+		}
+	}
+}
+
+// find and delete expired records. like Compact, the collection is only
+// locked for writing while a few records at a time are deleted.
+func (c *Collection) reap() error {
+	c.RLock()
+	blks, err := c.st.expired()
+	c.RUnlock()
+	if err != nil {
+		return logger(err)
+	}
+	for i := 0; i < len(blks); i += reapBatch {
+		j := i + reapBatch
+		if j > len(blks) {
+			j = len(blks)
+		}
+		c.Lock()
+		err := c.st.reap(blks[i:j])
+		c.Unlock()
+		if err != nil {
+			return logger(err)
+		}
+	}
+	return nil
+}
+
 func (c *Collection) Close() error {
+	c.Lock()
+	stop, done := c.stop, c.done
+	c.stop = nil
+	c.Unlock()
+	if stop != nil {
+		// stop the reaper before closing the store under it
+		close(stop)
+		<-done
+	}
 	c.Lock()
 	err := c.st.close()
+	if c.blobs != nil {
+		if berr := c.blobs.close(); err == nil {
+			err = berr
+		}
+		c.blobs = nil
+	}
 	c.Unlock()
 	return logger(err)
 }
@@ -0,0 +1,498 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// open a collection, failing the test on error
+func openTestCollection(t *testing.T, path string, opts ...Option) *Collection {
+	c, err := OpenCollection(path, opts...)
+	if err != nil {
+		t.Fatalf("opening %s: %s\n", path, err)
+	}
+	return c
+}
+
+var (
+	allBackends  = []Backend{Mmap, Pread, Memory}
+	fileBackends = []Backend{Mmap, Pread} // those a collection can be reopened from
+)
+
+// run test over each of backends in turn, with a path to open a
+// collection at
+func forBackends(t *testing.T, backends []Backend, test func(t *testing.T, path string, backend Backend)) {
+	for _, backend := range backends {
+		t.Run(backend.String(), func(t *testing.T) {
+			test(t, filepath.Join(t.TempDir(), "col"), backend)
+		})
+	}
+}
+
+// leave a collection as a crash would; nothing is flushed, checkpointed
+// or marked clean, and its files are just let go of
+func crashCollection(c *Collection) {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.stop = nil
+	}
+	for _, st := range []*store{c.st, c.blobs} {
+		if st == nil {
+			continue
+		}
+		st.log.close()
+		if st.idx.pgr.file != nil {
+			st.idx.pgr.file.Close()
+		}
+		if e := st.idx.ngin.(*engine); e.file != nil {
+			unlockFile(e.file)
+			e.file.Close()
+		}
+	}
+}
+
+// check that every key in keys holds a value of n bytes
+func checkValues(t *testing.T, c *Collection, keys []int, n int) {
+	for _, k := range keys {
+		var b []byte
+		if err := c.Get(k, &b); err != nil || len(b) != n {
+			t.Fatalf("expected %d bytes for key %d, got: %d, %v\n", n, k, len(b), err)
+		}
+	}
+}
+
+// test that compacting moves records to the front of the data file and
+// reclaims the space left at the end of it
+func Test_Collection_Compact(t *testing.T) {
+	forBackends(t, fileBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend))
+		val := make([]byte, 3000)
+		var keep []int
+		for i := 0; i < 2000; i++ {
+			if err := c.Add(i, val); err != nil {
+				t.Fatalf("adding %d: %s\n", i, err)
+			}
+		}
+		for i := 0; i < 2000; i++ {
+			if i%10 == 0 {
+				keep = append(keep, i)
+				continue
+			}
+			if err := c.Del(i); err != nil {
+				t.Fatalf("deleting %d: %s\n", i, err)
+			}
+		}
+		n, err := c.Compact()
+		if err != nil {
+			t.Fatalf("compacting: %s\n", err)
+		}
+		if n == 0 {
+			t.Fatalf("expected space to be reclaimed, got: 0 bytes\n")
+		}
+		checkValues(t, c, keep, len(val))
+		if err := c.Close(); err != nil {
+			t.Fatalf("closing: %s\n", err)
+		}
+		c = openTestCollection(t, path, WithBackend(backend))
+		defer c.Close()
+		if c.Count() != len(keep) {
+			t.Fatalf("expected %d records, got: %d\n", len(keep), c.Count())
+		}
+		checkValues(t, c, keep, len(val))
+	})
+}
+
+// test that a crash after records have been copied, but before they
+// have been cut from where they were, loses nothing
+func Test_Collection_CompactCrash(t *testing.T) {
+	forBackends(t, fileBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend))
+		val := make([]byte, 3000)
+		var keep []int
+		for i := 0; i < 500; i++ {
+			c.Add(i, val)
+		}
+		for i := 0; i < 500; i++ {
+			if i%5 == 0 {
+				keep = append(keep, i)
+				continue
+			}
+			c.Del(i)
+		}
+		// do the first half of what store.compact does
+		blks, err := c.st.blocks()
+		if err != nil {
+			t.Fatalf("listing blocks: %s\n", err)
+		}
+		moved := 0
+		for _, blk := range blks {
+			ok, err := c.st.idx.move(blk.key, blk.pos)
+			if err != nil {
+				t.Fatalf("moving: %s\n", err)
+			}
+			if ok {
+				moved++
+			}
+		}
+		if moved == 0 {
+			t.Fatalf("expected records to be moved\n")
+		}
+		c.st.idx.ngin.sync()
+		c.st.idx.pgr.sync()
+		crashCollection(c)
+
+		c = openTestCollection(t, path, WithBackend(backend))
+		defer c.Close()
+		if c.Count() != len(keep) {
+			t.Fatalf("expected %d records, got: %d\n", len(keep), c.Count())
+		}
+		checkValues(t, c, keep, len(val))
+	})
+}
+
+// test that records given a ttl go missing once it has passed, and are
+// then deleted by the reaper, which is only started once one is set
+func Test_Collection_TTL(t *testing.T) {
+	forBackends(t, fileBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend), WithReapInterval(10*time.Millisecond))
+		c.Set("forever", 1)
+		if c.stop != nil {
+			t.Fatalf("expected no reaper before a ttl is set\n")
+		}
+		if err := c.SetWithTTL("brief", 2, 20*time.Millisecond); err != nil {
+			t.Fatalf("setting with ttl: %s\n", err)
+		}
+		if c.stop == nil {
+			t.Fatalf("expected the reaper to be started by a ttl\n")
+		}
+		var n int
+		if err := c.Get("brief", &n); err != nil || n != 2 {
+			t.Fatalf("expected 2, got: %d, %v\n", n, err)
+		}
+		time.Sleep(30 * time.Millisecond)
+		if err := c.Get("brief", &n); err == nil {
+			t.Fatalf("expected an expired record to be missing\n")
+		}
+		// wait for the reaper to get to it
+		for i := 0; i < 100 && c.st.count() != 1; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := c.st.count(); n != 1 {
+			t.Fatalf("expected the expired record to be reaped, got: %d records\n", n)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatalf("closing: %s\n", err)
+		}
+		// a record has had an expiry, so the reaper starts straight away
+		c = openTestCollection(t, path, WithBackend(backend), WithReapInterval(10*time.Millisecond))
+		defer c.Close()
+		if c.stop == nil {
+			t.Fatalf("expected the reaper to be started on open\n")
+		}
+		if err := c.Get("forever", &n); err != nil || n != 1 {
+			t.Fatalf("expected 1, got: %d, %v\n", n, err)
+		}
+	})
+}
+
+// test that a collection that never uses a ttl never runs a reaper
+func Test_Collection_NoReaper(t *testing.T) {
+	forBackends(t, fileBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend))
+		c.Set("a", 1)
+		c.Close()
+		c = openTestCollection(t, path, WithBackend(backend))
+		defer c.Close()
+		if c.stop != nil {
+			t.Fatalf("expected no reaper\n")
+		}
+	})
+}
+
+// test that SetIf only writes a record still at the version read, so
+// concurrent read-modify-writes never lose an update
+func Test_Collection_SetIf(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend))
+		defer c.Close()
+		if err := c.SetIf("n", 0, 0); err != nil {
+			t.Fatalf("setting: %s\n", err)
+		}
+		if err := c.SetIf("n", 0, 0); err != ErrVersionConflict {
+			t.Fatalf("expected ErrVersionConflict, got: %v\n", err)
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 25; i++ {
+					for {
+						var n int
+						ver, err := c.GetWithVersion("n", &n)
+						if err != nil {
+							t.Errorf("getting: %s\n", err)
+							return
+						}
+						if err = c.SetIf("n", n+1, ver); err == nil {
+							break
+						}
+						if err != ErrVersionConflict {
+							t.Errorf("setting: %s\n", err)
+							return
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		var n int
+		ver, err := c.GetWithVersion("n", &n)
+		if err != nil || n != 200 {
+			t.Fatalf("expected 200, got: %d, %v\n", n, err)
+		}
+		// deleting and adding again gives a new, higher version
+		c.Del("n")
+		c.Add("n", 1)
+		if ver2, _ := c.GetWithVersion("n", &n); ver2 <= ver {
+			t.Fatalf("expected a version above %d, got: %d\n", ver, ver2)
+		}
+		if err := c.SetIf("n", 2, ver); err != ErrVersionConflict {
+			t.Fatalf("expected ErrVersionConflict, got: %v\n", err)
+		}
+	})
+}
+
+// test that SetIf keeps the ttl of the record it replaces
+func Test_Collection_SetIfTTL(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend), WithReapInterval(0))
+		defer c.Close()
+		if err := c.SetWithTTL("n", 1, 30*time.Millisecond); err != nil {
+			t.Fatalf("setting with ttl: %s\n", err)
+		}
+		var n int
+		ver, _ := c.GetWithVersion("n", &n)
+		if err := c.SetIf("n", 2, ver); err != nil {
+			t.Fatalf("setting: %s\n", err)
+		}
+		time.Sleep(40 * time.Millisecond)
+		if err := c.Get("n", &n); err == nil {
+			t.Fatalf("expected the ttl to be kept, got: %d\n", n)
+		}
+	})
+}
+
+// read every file of the collection at path, to tell if any changed
+func readFiles(path string) []byte {
+	var all []byte
+	for _, ext := range []string{".db", ".idx", ".fm", ".wal"} {
+		b, _ := ioutil.ReadFile(path + ext)
+		all = append(append(all, ext...), b...)
+	}
+	return all
+}
+
+// test that a read-only collection can be read, but not written, and
+// never creates or changes any of its files
+func Test_Collection_ReadOnly(t *testing.T) {
+	forBackends(t, fileBackends, func(t *testing.T, path string, backend Backend) {
+		path = filepath.Join(path, "ro")
+		if _, err := OpenCollection(path, WithBackend(backend), ReadOnly()); err == nil {
+			t.Fatalf("expected opening a missing collection to fail\n")
+		}
+		if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+			t.Fatalf("expected no directory to be created, got: %v\n", err)
+		}
+		c := openTestCollection(t, path, WithBackend(backend))
+		for i := 0; i < 1000; i++ {
+			c.Add(i, fmt.Sprint(i))
+		}
+		c.Close()
+		before := readFiles(path)
+		r := openTestCollection(t, path, WithBackend(backend), ReadOnly())
+		var s string
+		if err := r.Get(999, &s); err != nil || s != "999" {
+			t.Fatalf("expected %q, got: %q, %v\n", "999", s, err)
+		}
+		if err := r.Set(1, "x"); err != ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly, got: %v\n", err)
+		}
+		if err := r.Del(1); err != ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly, got: %v\n", err)
+		}
+		if _, err := r.Compact(); err != ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly, got: %v\n", err)
+		}
+		r.Close()
+		if !bytes.Equal(readFiles(path), before) {
+			t.Fatalf("expected no file to change\n")
+		}
+		// a missing index is rebuilt in memory only
+		os.Remove(path + ".idx")
+		before = readFiles(path)
+		r = openTestCollection(t, path, WithBackend(backend), ReadOnly())
+		if r.Count() != 1000 {
+			t.Fatalf("expected 1000 records, got: %d\n", r.Count())
+		}
+		r.Close()
+		if !bytes.Equal(readFiles(path), before) {
+			t.Fatalf("expected no file to change\n")
+		}
+		// a log that needs replaying can't be, without writing
+		ioutil.WriteFile(path+".wal", []byte("junkjunkjunkjunk"), 0666)
+		if _, err := OpenCollection(path, WithBackend(backend), ReadOnly()); err != ErrNeedsRecovery {
+			t.Fatalf("expected ErrNeedsRecovery, got: %v\n", err)
+		}
+	})
+}
+
+// test that Update changes a record with no other write coming in
+// between, writes nothing if fn fails, and keeps the record's ttl
+func Test_Collection_Update(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend), WithReapInterval(0))
+		defer c.Close()
+		c.Set("n", 0)
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 25; i++ {
+					var n int
+					if err := c.Update("n", &n, func() error { n++; return nil }); err != nil {
+						t.Errorf("updating: %s\n", err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		var n int
+		if c.Get("n", &n); n != 200 {
+			t.Fatalf("expected 200, got: %d\n", n)
+		}
+		stop := errors.New("stop")
+		if err := c.Update("n", &n, func() error { n = -1; return stop }); err != stop {
+			t.Fatalf("expected fn's error, got: %v\n", err)
+		}
+		if c.Get("n", &n); n != 200 {
+			t.Fatalf("expected nothing to be written, got: %d\n", n)
+		}
+		if err := c.Update("missing", &n, func() error { return nil }); err == nil {
+			t.Fatalf("expected updating a missing record to fail\n")
+		}
+		c.SetWithTTL("t", 1, 30*time.Millisecond)
+		c.Update("t", &n, func() error { n = 2; return nil })
+		time.Sleep(40 * time.Millisecond)
+		if err := c.Get("t", &n); err == nil {
+			t.Fatalf("expected the ttl to be kept, got: %d\n", n)
+		}
+	})
+}
+
+// test that each collection checks vals against its own limit, so one
+// that is encrypted and one that isn't can be open at the same time
+func Test_Collection_MaxVal(t *testing.T) {
+	dir := t.TempDir()
+	cols := make([]*Collection, 2)
+	var wg sync.WaitGroup
+	for i, opts := range [][]Option{nil, {WithEncryption([]byte("0123456789abcdef"))}} {
+		wg.Add(1)
+		go func(i int, opts []Option) {
+			defer wg.Done()
+			cols[i] = openTestCollection(t, filepath.Join(dir, fmt.Sprintf("c%d", i)), opts...)
+		}(i, opts)
+	}
+	wg.Wait()
+	plain, enc := cols[0], cols[1]
+	defer plain.Close()
+	defer enc.Close()
+	max := plain.st.idx.ngin.maxValSize()
+	e := enc.st.idx.ngin.(*engine)
+	if e.maxValSize() != max-e.crypt.overhead() {
+		t.Fatalf("expected a limit of %d, got: %d\n", max-e.crypt.overhead(), e.maxValSize())
+	}
+	// a val that fits in the plain collection, but not the encrypted one
+	v := make([]byte, e.maxValSize()+1)
+	if err := verify(nil, v, plain.st.idx.ngin.maxValSize()); err != nil {
+		t.Fatalf("expected %d bytes to fit, got: %s\n", len(v), err)
+	}
+	if err := verify(nil, v, e.maxValSize()); err != ErrPageSize {
+		t.Fatalf("expected ErrPageSize, got: %v\n", err)
+	}
+}
+
+// test that records spanning many pages are written, overwritten with
+// larger and smaller values, and deleted without disturbing the ones
+// around them, and read back the same once reopened
+func Test_Collection_MultiPage(t *testing.T) {
+	forBackends(t, fileBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend))
+		page := c.st.idx.ngin.(*engine).page
+		// the value held under each key, by its fill byte and length
+		vals := make(map[int][]byte)
+		set := func(k, n int) {
+			v := bytes.Repeat([]byte{byte(k)}, n)
+			if err := c.Set(k, v); err != nil {
+				t.Fatalf("setting %d: %s\n", k, err)
+			}
+			vals[k] = v
+		}
+		check := func() {
+			for k, want := range vals {
+				var v []byte
+				if err := c.Get(k, &v); err != nil || !bytes.Equal(v, want) {
+					t.Fatalf("expected %d bytes of %d, got: %d, %v\n", len(want), k, len(v), err)
+				}
+			}
+			if c.Count() != len(vals) {
+				t.Fatalf("expected %d records, got: %d\n", len(vals), c.Count())
+			}
+		}
+		for k := 0; k < 30; k++ {
+			set(k, (k%5+1)*page)
+		}
+		check()
+		// grow some, and shrink others
+		for k := 0; k < 30; k += 3 {
+			set(k, 8*page+k)
+		}
+		for k := 1; k < 30; k += 3 {
+			set(k, 10)
+		}
+		check()
+		for k := 2; k < 30; k += 3 {
+			if err := c.Del(k); err != nil {
+				t.Fatalf("deleting %d: %s\n", k, err)
+			}
+			delete(vals, k)
+			var v []byte
+			if err := c.Get(k, &v); err == nil {
+				t.Fatalf("expected %d to be deleted\n", k)
+			}
+		}
+		// new records reuse what the deletes and shrinks freed
+		for k := 30; k < 40; k++ {
+			set(k, 2*page)
+		}
+		check()
+		if err := c.Close(); err != nil {
+			t.Fatalf("closing: %s\n", err)
+		}
+		c = openTestCollection(t, path, WithBackend(backend))
+		defer c.Close()
+		check()
+		if r := c.Check(); !r.OK() {
+			t.Fatalf("expected no problems, got: %v\n", r.Problems)
+		}
+	})
+}
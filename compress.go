@@ -0,0 +1,68 @@
+package godb
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+)
+
+// Compression selects the algorithm used to compress record values
+// written to a collection. the algorithm used for each record is
+// kept in the record's header, so records written with different
+// settings can all be read back no matter what the collection was
+// opened with.
+type Compression byte
+
+const (
+	NoCompression Compression = 0x00 // store values as they are
+	Deflate       Compression = 0x01 // DEFLATE (RFC 1951) from the standard library
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Deflate:
+		return "deflate"
+	}
+	return fmt.Sprintf("Compression(%d)", byte(c))
+}
+
+// compress val using c, returning the algorithm actually used and the
+// compressed bytes. if compressing doesn't make the value any smaller
+// it is stored as it is, so a record never takes more room than it
+// would have without compression.
+func compress(c Compression, val []byte) (Compression, []byte) {
+	switch c {
+	case Deflate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			break
+		}
+		if _, err := w.Write(val); err != nil {
+			break
+		}
+		if err := w.Close(); err != nil {
+			break
+		}
+		if buf.Len() < len(val) {
+			return Deflate, buf.Bytes()
+		}
+	}
+	return NoCompression, val
+}
+
+// decompress val that was compressed using c
+func decompress(c Compression, val []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return val, nil
+	case Deflate:
+		r := flate.NewReader(bytes.NewReader(val))
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unknown compression %d", byte(c))
+}
@@ -0,0 +1,131 @@
+package godb
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+type compDoc struct {
+	ID   int    `msgpack:"id"`
+	Big  bool   `msgpack:"big"`
+	Body string `msgpack:"body"`
+}
+
+// n bytes of text drawn from a small alphabet, so it compresses to
+// around half its size but no further
+func compText(r *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = "abcdefghijklmnop"[r.Intn(16)]
+	}
+	return string(b)
+}
+
+// return the record stored under key in the collection, and the number
+// of pages it spans
+func compRecord(t *testing.T, c *Collection, key interface{}) (*record, int) {
+	k, _ := genKey(key)
+	blks, err := c.st.blocks()
+	if err != nil {
+		t.Fatalf("listing blocks: %s\n", err)
+	}
+	e := c.st.idx.ngin.(*engine)
+	for _, blk := range blks {
+		if bytes.Equal(blk.key, k) {
+			r, err := e.getRecord(blk.pos)
+			if err != nil {
+				t.Fatalf("reading record: %s\n", err)
+			}
+			return r, e.span(blk.pos)
+		}
+	}
+	t.Fatalf("expected a record for %v\n", key)
+	return nil, 0
+}
+
+// test that a value that doesn't get any smaller is stored as it is,
+// with its record flagged as not compressed, and one that does is not
+func Test_Compress_Raw(t *testing.T) {
+	c := openTestCollection(t, "comp", WithBackend(Memory), WithCompression(Deflate))
+	defer c.Close()
+	r := rand.New(rand.NewSource(1))
+	noise := make([]byte, 3000)
+	r.Read(noise)
+	text := bytes.Repeat([]byte("compress me "), 250)
+	c.Set("noise", noise)
+	c.Set("text", text)
+	for _, tt := range []struct {
+		key  string
+		val  []byte
+		comp Compression
+	}{
+		{"noise", noise, NoCompression},
+		{"text", text, Deflate},
+	} {
+		rec, _ := compRecord(t, c, tt.key)
+		if rec.compression() != tt.comp {
+			t.Fatalf("expected %s to be stored with %s, got: %s\n", tt.key, tt.comp, rec.compression())
+		}
+		_, v, _ := encodeKeyVal(tt.key, tt.val)
+		stored := rec.val()
+		if tt.comp == NoCompression && !bytes.Equal(stored, v) {
+			t.Fatalf("expected %s to be stored as it is\n", tt.key)
+		}
+		if tt.comp == Deflate && len(stored) >= len(v) {
+			t.Fatalf("expected %s to be stored in under %d bytes, got: %d\n", tt.key, len(v), len(stored))
+		}
+		var b []byte
+		if err := c.Get(tt.key, &b); err != nil || !bytes.Equal(b, tt.val) {
+			t.Fatalf("expected %s to be read back, got: %d bytes, %v\n", tt.key, len(b), err)
+		}
+	}
+}
+
+// test that compressed values, including ones spanning many pages, are
+// read back by Get, All and Query, on every backend
+func Test_Compress_Read(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend), WithCompression(Deflate))
+		defer c.Close()
+		r := rand.New(rand.NewSource(2))
+		docs := make([]compDoc, 60)
+		for i := range docs {
+			docs[i] = compDoc{ID: i, Big: i%3 == 0, Body: compText(r, 200)}
+			if docs[i].Big {
+				docs[i].Body = compText(r, 40000)
+			}
+			if err := c.Set(i, docs[i]); err != nil {
+				t.Fatalf("setting %d: %s\n", i, err)
+			}
+		}
+		e := c.st.idx.ngin.(*engine)
+		if rec, n := compRecord(t, c, 0); rec.compression() != Deflate || n < 2 || n >= e.pages(len(docs[0].Body)) {
+			t.Fatalf("expected a compressed record of fewer pages than %d, got: %s over %d\n", e.pages(len(docs[0].Body)), rec.compression(), n)
+		}
+		for i, want := range docs {
+			var d compDoc
+			if err := c.Get(i, &d); err != nil || d != want {
+				t.Fatalf("expected record %d to be read back, got: %d, %v\n", i, d.ID, err)
+			}
+		}
+		var all []compDoc
+		if err := c.All(&all); err != nil || len(all) != len(docs) {
+			t.Fatalf("expected %d records, got: %d, %v\n", len(docs), len(all), err)
+		}
+		for i, d := range all {
+			if d != docs[i] {
+				t.Fatalf("expected record %d to be read back, got: %d\n", i, d.ID)
+			}
+		}
+		var big []compDoc
+		if err := c.Query("big == true", &big); err != nil || len(big) != 20 {
+			t.Fatalf("expected 20 records, got: %d, %v\n", len(big), err)
+		}
+		for i, d := range big {
+			if d != docs[i*3] {
+				t.Fatalf("expected record %d to be read back, got: %d\n", i*3, d.ID)
+			}
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package godb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// what a sealed piece of data is; used as the additional data
+// when sealing, so data sealed for one purpose can't be passed
+// off as another
+const (
+	sealRecord byte = 'r' // a record in the data file
+	sealNode   byte = 'n' // a node in the index file
+	sealEntry  byte = 'w' // an entry in the write-ahead log
+	sealCheck  byte = 'k' // the key check in the superblock
+	sealTx     byte = 't' // a collection's part of a transaction in the transaction log
+)
+
+const sealHdr = 8 // nonce sequence number stored ahead of the sealed data
+
+// crypter seals the data written to a collection's files with
+// AES-GCM. each nonce is derived from the page (or node, or log
+// offset) being written and a sequence number that is never
+// handed out twice for the same key; the sequence number is
+// stored ahead of the sealed data so it can be opened again.
+type crypter struct {
+	aead cipher.AEAD
+	next func() uint64 // returns the next unused sequence number
+}
+
+// create a new crypter for an AES-128, AES-192 or AES-256 key
+func newCrypter(key []byte) (*crypter, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("crypter: invalid key -> %s", err)
+	}
+	aead, err := cipher.NewGCM(blk)
+	if err != nil {
+		return nil, fmt.Errorf("crypter: cannot create cipher -> %s", err)
+	}
+	return &crypter{aead: aead}, nil
+}
+
+// number of bytes sealing adds to the data
+func (c *crypter) overhead() int {
+	return sealHdr + c.aead.Overhead()
+}
+
+// nonce for page k and sequence number seq
+func (c *crypter) nonce(k int, seq uint64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce[0:4], uint32(k))
+	binary.BigEndian.PutUint64(nonce[4:12], seq)
+	return nonce
+}
+
+// seal data of the given kind being written at page k
+func (c *crypter) seal(kind byte, k int, data []byte) []byte {
+	seq := c.next()
+	b := make([]byte, sealHdr, c.overhead()+len(data))
+	binary.BigEndian.PutUint64(b, seq)
+	return c.aead.Seal(b, c.nonce(k, seq), data, []byte{kind})
+}
+
+// open data of the given kind sealed at page k, authenticating it
+func (c *crypter) open(kind byte, k int, b []byte) ([]byte, error) {
+	if len(b) < c.overhead() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	seq := binary.BigEndian.Uint64(b[:sealHdr])
+	data, err := c.aead.Open(nil, c.nonce(k, seq), b[sealHdr:], []byte{kind})
+	if err != nil {
+		return nil, fmt.Errorf("cannot authenticate sealed data (wrong key or tampered with)")
+	}
+	return data, nil
+}
+
+// RotateKey changes the key of the encrypted collection at path from
+// oldKey to newKey. it is an offline operation; the collection must
+// not be open while its key is rotated. every record is sealed again
+// in a copy of the data file, which only replaces the original once
+// it is complete, so the collection can still be opened with the old
+// key if rotating fails part way through. the index is sealed with
+// the old key as well, so it is removed and rebuilt from the data
+// file the next time the collection is opened.
+//
+// the collection's blob store, if it has one, is sealed with the same
+// key, so it is rotated too, first. if rotating one of them fails the
+// other may already have been rotated; a data file already sealed
+// with newKey is left alone, so RotateKey can just be run again.
+func RotateKey(path string, oldKey, newKey []byte) error {
+	if _, err := newCrypter(newKey); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path + `.blob.db`); err == nil {
+		if err := rotateKey(path+`.blob`, oldKey, newKey); err != nil {
+			return fmt.Errorf("rotate: cannot rotate key of blob store -> %s", err)
+		}
+	}
+	return rotateKey(path, oldKey, newKey)
+}
+
+// seal every record of the store at path again, with newKey
+func rotateKey(path string, oldKey, newKey []byte) error {
+	nc, err := newCrypter(newKey)
+	if err != nil {
+		return err
+	}
+	// open and close the store with the old key, so anything left in
+	// its write-ahead log is applied and the log is left empty
+	st, err := openStore(path, newOptions([]Option{WithEncryption(oldKey)}))
+	if err != nil {
+		if st, nerr := openStore(path, newOptions([]Option{WithEncryption(newKey)})); nerr == nil {
+			// already rotated
+			return st.close()
+		}
+		return fmt.Errorf("rotate: cannot open collection with the old key -> %s", err)
+	}
+	if err := st.close(); err != nil {
+		return err
+	}
+	oc, _ := newCrypter(oldKey)
+	tmp := path + `.rotate`
+	defer os.Remove(tmp + `.fm`)
+	if err := copyFile(path+`.db`, tmp+`.db`); err != nil {
+		return fmt.Errorf("rotate: cannot copy data file -> %s", err)
+	}
+	e := newEngine(&options{crypt: oc, fs: osFS{}})
+	if _, err := e.open(tmp); err != nil {
+		os.Remove(tmp + `.db`)
+		return fmt.Errorf("rotate: cannot open copy of data file -> %s", err)
+	}
+	nc.next = e.nextSeq
+	for k := 1; (k+1)*e.page <= e.dev.size(); {
+		n := e.span(k)
+		if n == 0 {
+			k++
+			continue
+		}
+		ext, err := e.extent(k)
+		if err != nil {
+			e.close()
+			os.Remove(tmp + `.db`)
+			return fmt.Errorf("rotate: cannot re-encrypt record -> %s", err)
+		}
+		// extent opened the record into a buffer of its own, so
+		// it is safe to seal it again over the top of its pages
+		e.crypt = nc
+		e.write(k, n, &record{ext})
+		e.crypt = oc
+		k += n
+	}
+	e.crypt = nc
+	e.writeKeyCheck()
+	if err := e.sync(); err != nil {
+		e.close()
+		os.Remove(tmp + `.db`)
+		return err
+	}
+	if err := e.close(); err != nil {
+		os.Remove(tmp + `.db`)
+		return err
+	}
+	if err := os.Remove(path + `.idx`); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp + `.db`)
+		return err
+	}
+	return os.Rename(tmp+`.db`, path+`.db`)
+}
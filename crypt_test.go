@@ -0,0 +1,113 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// test that sealed data only opens for the kind and page it was
+// sealed for, and only if it hasn't been tampered with
+func Test_Crypt_Seal(t *testing.T) {
+	if _, err := newCrypter(make([]byte, 10)); err == nil {
+		t.Fatalf("expected a 10 byte key to be refused\n")
+	}
+	c, err := newCrypter(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("creating crypter: %s\n", err)
+	}
+	var seq uint64
+	c.next = func() uint64 { seq++; return seq }
+	data := []byte("attack at dawn")
+	a, b := c.seal(sealRecord, 7, data), c.seal(sealRecord, 7, data)
+	if bytes.Equal(a, b) {
+		t.Fatalf("expected sealing twice to give different nonces\n")
+	}
+	if bytes.Contains(a, data) {
+		t.Fatalf("expected sealed data not to hold the plaintext\n")
+	}
+	if got, err := c.open(sealRecord, 7, a); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got: %q, %v\n", data, got, err)
+	}
+	if _, err := c.open(sealRecord, 8, a); err == nil {
+		t.Fatalf("expected opening at the wrong page to fail\n")
+	}
+	if _, err := c.open(sealNode, 7, a); err == nil {
+		t.Fatalf("expected opening as the wrong kind to fail\n")
+	}
+	a[len(a)-1] ^= 0x01
+	if _, err := c.open(sealRecord, 7, a); err == nil {
+		t.Fatalf("expected opening tampered data to fail\n")
+	}
+}
+
+// test that nothing is written to any of an encrypted collection's
+// files in the clear, and that it reads back with its key
+func Test_Crypt_Collection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crypt")
+	key := bytes.Repeat([]byte{7}, 32)
+	c := openTestCollection(t, path, WithEncryption(key), WithCompression(Deflate))
+	for i := 0; i < 200; i++ {
+		if err := c.Add(fmt.Sprintf("user%d@secret.example", i), "SECRETNAME"); err != nil {
+			t.Fatalf("adding %d: %s\n", i, err)
+		}
+	}
+	for i := 0; i < 200; i += 2 {
+		c.Del(fmt.Sprintf("user%d@secret.example", i))
+	}
+	if _, err := c.Compact(); err != nil {
+		t.Fatalf("compacting: %s\n", err)
+	}
+	// leave an entry in the log, so it is checked and replayed too
+	c.Set("user1@secret.example", "SECRETNAME")
+	if c.st.log.size == 0 {
+		t.Fatalf("expected an entry in the log\n")
+	}
+	crashCollection(c)
+	for _, ext := range []string{".db", ".idx", ".wal"} {
+		b, _ := ioutil.ReadFile(path + ext)
+		if bytes.Contains(b, []byte("secret.example")) || bytes.Contains(b, []byte("SECRETNAME")) {
+			t.Fatalf("expected nothing in the clear in %s\n", ext)
+		}
+	}
+	c = openTestCollection(t, path, WithEncryption(key), WithCompression(Deflate))
+	defer c.Close()
+	if c.Count() != 100 {
+		t.Fatalf("expected 100 records, got: %d\n", c.Count())
+	}
+	var s string
+	if err := c.Get("user199@secret.example", &s); err != nil || s != "SECRETNAME" {
+		t.Fatalf("expected %q, got: %q, %v\n", "SECRETNAME", s, err)
+	}
+}
+
+// test that opening an encrypted collection without its key, or an
+// unencrypted one with a key, is a *FormatError
+func Test_Crypt_WrongKey(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	c := openTestCollection(t, filepath.Join(dir, "enc"), WithEncryption(key))
+	c.Set("a", 1)
+	c.Close()
+	c = openTestCollection(t, filepath.Join(dir, "plain"))
+	c.Set("a", 1)
+	c.Close()
+	for _, tt := range []struct {
+		name   string
+		opts   []Option
+		reason string
+	}{
+		{"enc", nil, "file is encrypted, but no key was given"},
+		{"enc", []Option{WithEncryption(bytes.Repeat([]byte{8}, 32))}, "wrong encryption key"},
+		{"plain", []Option{WithEncryption(key)}, "file is not encrypted, but a key was given"},
+	} {
+		_, err := OpenCollection(filepath.Join(dir, tt.name), tt.opts...)
+		var ferr *FormatError
+		if !errors.As(err, &ferr) || ferr.Reason != tt.reason {
+			t.Fatalf("expected %q opening %s, got: %v\n", tt.reason, tt.name, err)
+		}
+	}
+}
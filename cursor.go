@@ -0,0 +1,314 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/cagnosolutions/msgpack"
+)
+
+// ErrCursorClosed is returned when a cursor is used after it has been closed
+var ErrCursorClosed = errors.New("cursor: cursor has been closed")
+
+// where a cursor is
+const (
+	curBefore int8 = -1 // moved back past the first record
+	curNone   int8 = 0  // not moved yet
+	curAt     int8 = 1  // at a record
+	curAfter  int8 = 2  // moved on past the last record
+)
+
+// Cursor walks the records of a collection in key order, forward or
+// backward, optionally bounded to a range of keys. the collection is
+// only locked while the cursor moves, so writes carry on in between;
+// a move always lands on the record after (or before) the key the
+// cursor was last at, as the collection is at the time of the move.
+// expired records are skipped. a Cursor must not be used by more than
+// one goroutine at once.
+//
+// Next on a cursor that has not moved yet goes to the first record,
+// and Prev to the last, so every record can be visited with
+//
+//	cur := c.Cursor()
+//	defer cur.Close()
+//	for cur.Next() {
+//		var v T
+//		err := cur.Value(&v)
+//		...
+//	}
+type Cursor struct {
+	c     *Collection
+	start []byte // first key in range, or nil for the first key of all
+	end   []byte // key the range ends before, or nil to run to the last key
+
+	state int8
+	leaf  *node  // leaf holding the current record
+	i     int    // index of the current record in leaf
+	gen   uint64 // generation of the tree when leaf was found
+	key   []byte // current key, encoded
+	val   []byte // current value, copied out of the data file
+	err   error
+}
+
+// Cursor returns a cursor over every record in the collection
+func (c *Collection) Cursor() *Cursor {
+	return &Cursor{c: c}
+}
+
+// Range returns a cursor over the records with keys from start up to,
+// but not including, end
+func (c *Collection) Range(start, end interface{}) (*Cursor, error) {
+	s, err := c.genKey(start)
+	if err != nil {
+		return nil, logger(err)
+	}
+	e, err := c.genKey(end)
+	if err != nil {
+		return nil, logger(err)
+	}
+	return &Cursor{c: c, start: s, end: e}, nil
+}
+
+// Prefix returns a cursor over the records with keys starting with p.
+// p is encoded just like a key, so it only matches keys of the same
+// type as it; it is meant for string and []byte keys.
+func (c *Collection) Prefix(p interface{}) (*Cursor, error) {
+	s, err := c.genKey(p)
+	if err != nil {
+		return nil, logger(err)
+	}
+	// the range ends at the first key that no longer has the prefix
+	var e []byte
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < 0xFF {
+			e = append([]byte(nil), s[:i+1]...)
+			e[i]++
+			break
+		}
+	}
+	return &Cursor{c: c, start: s, end: e}, nil
+}
+
+// First moves to the first record, reporting whether there is one
+func (cur *Cursor) First() bool {
+	return cur.move(func(t *btree) bool {
+		if cur.start != nil {
+			cur.leaf, cur.i = t.seek(cur.start)
+		} else {
+			cur.leaf, cur.i = t.findFirstLeaf(), 0
+		}
+		return cur.forward(t)
+	})
+}
+
+// Last moves to the last record, reporting whether there is one
+func (cur *Cursor) Last() bool {
+	return cur.move(func(t *btree) bool {
+		if cur.end != nil {
+			cur.leaf, cur.i = t.seek(cur.end)
+			cur.i--
+		} else if cur.leaf = t.findLastLeaf(); cur.leaf != nil {
+			cur.i = cur.leaf.numk - 1
+		}
+		return cur.backward(t)
+	})
+}
+
+// Seek moves to the first record with a key at or after key, reporting
+// whether there is one
+func (cur *Cursor) Seek(key interface{}) bool {
+	k, err := cur.c.genKey(key)
+	if err != nil {
+		cur.err = err
+		return false
+	}
+	if cur.start != nil && bytes.Compare(k, cur.start) < 0 {
+		k = cur.start
+	}
+	return cur.move(func(t *btree) bool {
+		cur.leaf, cur.i = t.seek(k)
+		return cur.forward(t)
+	})
+}
+
+// Next moves to the next record, reporting whether there is one
+func (cur *Cursor) Next() bool {
+	switch cur.state {
+	case curNone, curBefore:
+		return cur.First()
+	case curAfter:
+		return false
+	}
+	return cur.move(func(t *btree) bool {
+		// if the current record has gone, the cursor is already at
+		// the one after it
+		if cur.resume(t) {
+			cur.i++
+		}
+		return cur.forward(t)
+	})
+}
+
+// Prev moves to the previous record, reporting whether there is one
+func (cur *Cursor) Prev() bool {
+	switch cur.state {
+	case curNone, curAfter:
+		return cur.Last()
+	case curBefore:
+		return false
+	}
+	return cur.move(func(t *btree) bool {
+		cur.resume(t)
+		cur.i--
+		return cur.backward(t)
+	})
+}
+
+// Key returns the key of the current record, or nil if the cursor is
+// not at one. integers come back as an int64 or uint64 and floats as
+// a float64, whatever size they were stored from.
+func (cur *Cursor) Key() interface{} {
+	if cur.state != curAt {
+		return nil
+	}
+	k, err := DecodeKey(cur.key)
+	if err != nil {
+		return nil
+	}
+	return k
+}
+
+// Value reads the value of the current record into ptr
+func (cur *Cursor) Value(ptr interface{}) error {
+	if cur.state != curAt {
+		return logger(errors.New("cursor: cursor is not at a record"))
+	}
+	return logger(msgpack.Unmarshal(cur.val, ptr))
+}
+
+// Err returns the error that stopped the cursor, if any
+func (cur *Cursor) Err() error {
+	return cur.err
+}
+
+// Close releases the cursor. it can't be moved again once closed.
+func (cur *Cursor) Close() error {
+	if cur.err == ErrCursorClosed {
+		return nil
+	}
+	cur.state, cur.err = curNone, ErrCursorClosed
+	cur.leaf, cur.key, cur.val = nil, nil, nil
+	return nil
+}
+
+// lock the collection for reading and move the cursor with fn
+func (cur *Cursor) move(fn func(t *btree) bool) bool {
+	if cur.err != nil {
+		return false
+	}
+	cur.c.RLock()
+	defer cur.c.RUnlock()
+	if err := cur.c.st.err; err != nil {
+		cur.state, cur.leaf = curNone, nil
+		cur.err = logger(err)
+		return false
+	}
+	t := cur.c.st.idx
+	ok, err := cur.walk(t, fn)
+	if err != nil {
+		cur.state, cur.leaf = curNone, nil
+		cur.err = logger(err)
+		return false
+	}
+	cur.gen = t.gen
+	return ok
+}
+
+// call fn, handing back an error if the index turns out to be damaged
+func (cur *Cursor) walk(t *btree, fn func(t *btree) bool) (ok bool, err error) {
+	defer t.catch(&err)
+	return fn(t), nil
+}
+
+// find the current record again, if the tree has changed since the
+// cursor was last moved. if the record has gone, the cursor is left
+// at the record after it, and false is returned.
+func (cur *Cursor) resume(t *btree) bool {
+	if cur.gen == t.gen {
+		return true
+	}
+	cur.leaf, cur.i = t.seek(cur.key)
+	return cur.leaf != nil && cur.i < cur.leaf.numk && bytes.Equal(cur.leaf.keys[cur.i], cur.key)
+}
+
+// settle on the first live record at or after the cursor's position
+func (cur *Cursor) forward(t *btree) bool {
+	for cur.leaf != nil {
+		if cur.i >= cur.leaf.numk {
+			cur.leaf, cur.i = t.nextLeaf(cur.leaf), 0
+			continue
+		}
+		if cur.end != nil && bytes.Compare(cur.leaf.keys[cur.i], cur.end) >= 0 {
+			break
+		}
+		ok, err := cur.read(t)
+		if err != nil {
+			return false
+		}
+		if ok {
+			return true
+		}
+		cur.i++
+	}
+	cur.state, cur.leaf = curAfter, nil
+	return false
+}
+
+// settle on the first live record at or before the cursor's position
+func (cur *Cursor) backward(t *btree) bool {
+	for cur.leaf != nil {
+		if cur.i < 0 {
+			if cur.leaf = t.prevLeaf(cur.leaf); cur.leaf != nil {
+				cur.i = cur.leaf.numk - 1
+			}
+			continue
+		}
+		if cur.start != nil && bytes.Compare(cur.leaf.keys[cur.i], cur.start) < 0 {
+			break
+		}
+		ok, err := cur.read(t)
+		if err != nil {
+			return false
+		}
+		if ok {
+			return true
+		}
+		cur.i--
+	}
+	cur.state, cur.leaf = curBefore, nil
+	return false
+}
+
+// read the record at the cursor's position, reporting false if it
+// has expired
+func (cur *Cursor) read(t *btree) (bool, error) {
+	r, err := t.ngin.getRecord(cur.leaf.ptrs[cur.i])
+	if err == nil && expired(r.expires()) {
+		return false, nil
+	}
+	var val []byte
+	if err == nil {
+		val, err = r.value()
+	}
+	if err != nil {
+		cur.state, cur.leaf = curNone, nil
+		cur.err = logger(err)
+		return false, err
+	}
+	// the record may point into the data file, so copy it out before
+	// the collection is unlocked
+	cur.key = append(cur.key[:0], cur.leaf.keys[cur.i]...)
+	cur.val = append(cur.val[:0], val...)
+	cur.state = curAt
+	return true, nil
+}
@@ -0,0 +1,156 @@
+package godb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test that a cursor walks every record in key order, both ways
+func Test_Cursor_Walk(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend), WithReapInterval(0))
+		defer c.Close()
+		cur := c.Cursor()
+		if cur.Next() || cur.Prev() || cur.First() || cur.Last() {
+			t.Fatalf("expected an empty collection to have nothing to walk\n")
+		}
+		const n = 2000
+		for i := n - 1; i >= 0; i-- {
+			c.Set(i, i)
+		}
+		cur = c.Cursor()
+		defer cur.Close()
+		i := 0
+		for ; cur.Next(); i++ {
+			var v int
+			if err := cur.Value(&v); err != nil || v != i || cur.Key() != int64(i) {
+				t.Fatalf("expected %d, got: key %v, val %d, %v\n", i, cur.Key(), v, err)
+			}
+		}
+		if i != n || cur.Next() {
+			t.Fatalf("expected %d records, got: %d\n", n, i)
+		}
+		for i = n - 1; cur.Prev(); i-- {
+			if cur.Key() != int64(i) {
+				t.Fatalf("expected %d, got: %v\n", i, cur.Key())
+			}
+		}
+		if i != -1 {
+			t.Fatalf("expected to walk back to the start, got to: %d\n", i)
+		}
+		if err := cur.Err(); err != nil {
+			t.Fatalf("expected no error, got: %s\n", err)
+		}
+	})
+}
+
+// test that a cursor picks up where it was after the records around
+// it are changed, and stops once closed
+func Test_Cursor_Seek(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend), WithReapInterval(0))
+		defer c.Close()
+		for i := 0; i < 2000; i++ {
+			c.Set(i*2, i)
+		}
+		cur := c.Cursor()
+		// seeking a missing key lands on the next one after it
+		if !cur.Seek(1501) || cur.Key() != int64(1502) {
+			t.Fatalf("expected 1502, got: %v\n", cur.Key())
+		}
+		if !cur.Prev() || cur.Key() != int64(1500) {
+			t.Fatalf("expected 1500, got: %v\n", cur.Key())
+		}
+		c.Del(1500)
+		c.Del(1502)
+		if !cur.Next() || cur.Key() != int64(1504) {
+			t.Fatalf("expected 1504, got: %v\n", cur.Key())
+		}
+		if !cur.Prev() || cur.Key() != int64(1498) {
+			t.Fatalf("expected 1498, got: %v\n", cur.Key())
+		}
+		// enough deletes to merge the leaves under the cursor
+		for i := 0; i < 1400; i += 2 {
+			c.Del(i)
+		}
+		if !cur.Prev() || cur.Key() != int64(1496) {
+			t.Fatalf("expected 1496, got: %v\n", cur.Key())
+		}
+		if cur.Seek(4000) {
+			t.Fatalf("expected seeking past the last key to fail\n")
+		}
+		cur.Close()
+		if cur.Next() || cur.Err() != ErrCursorClosed {
+			t.Fatalf("expected ErrCursorClosed, got: %v\n", cur.Err())
+		}
+	})
+}
+
+// test that a range includes its start, but not its end
+func Test_Cursor_Range(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend), WithReapInterval(0))
+		defer c.Close()
+		for i := 0; i < 2000; i++ {
+			c.Set(i, i)
+		}
+		r, err := c.Range(1600, 1700)
+		if err != nil {
+			t.Fatalf("ranging: %s\n", err)
+		}
+		defer r.Close()
+		n := 0
+		for ; r.Next(); n++ {
+			if r.Key() != int64(1600+n) {
+				t.Fatalf("expected %d, got: %v\n", 1600+n, r.Key())
+			}
+		}
+		if n != 100 {
+			t.Fatalf("expected 100 records, got: %d\n", n)
+		}
+		if !r.Last() || r.Key() != int64(1699) {
+			t.Fatalf("expected 1699, got: %v\n", r.Key())
+		}
+		if !r.First() || r.Key() != int64(1600) || r.Prev() {
+			t.Fatalf("expected 1600 to be first, got: %v\n", r.Key())
+		}
+		if r.Seek(1800) {
+			t.Fatalf("expected seeking past the end of the range to fail\n")
+		}
+		if !r.Seek(10) || r.Key() != int64(1600) {
+			t.Fatalf("expected seeking before the range to land on 1600, got: %v\n", r.Key())
+		}
+	})
+}
+
+// test that a prefix covers every key starting with it, and no other,
+// and skips expired records
+func Test_Cursor_Prefix(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend), WithReapInterval(0))
+		defer c.Close()
+		for i := 0; i < 300; i++ {
+			c.Set(fmt.Sprintf("user:%03d", i), i)
+			c.Set(fmt.Sprintf("usr:%03d", i), i)
+		}
+		c.Set("user", -1)
+		c.SetWithTTL("user:000", 0, time.Millisecond)
+		time.Sleep(2 * time.Millisecond)
+		p, err := c.Prefix("user:")
+		if err != nil {
+			t.Fatalf("prefixing: %s\n", err)
+		}
+		defer p.Close()
+		n := 0
+		for ; p.Prev(); n++ {
+			if k, _ := p.Key().(string); !strings.HasPrefix(k, "user:") {
+				t.Fatalf("expected a key starting with user:, got: %v\n", p.Key())
+			}
+		}
+		if n != 299 {
+			t.Fatalf("expected 299 records, got: %d\n", n)
+		}
+	})
+}
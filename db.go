@@ -1,27 +1,155 @@
 package godb
 
 import (
+	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 // errors
-const ErrKind error = errors.New("invalid kind: expected a pointer to a struct")
+var ErrKind error = errors.New("invalid kind: expected a pointer to a struct")
 
+// DB is a directory of collections, each opened by name the first
+// time it is asked for, that can be read and written together in a
+// transaction (see Begin). every collection is opened with the options
+// the DB was opened with, and is closed along with the DB.
+//
+// a transaction is written to the transaction log (tx.log, in the same
+// directory) before any of it is applied to its collections, and the
+// log is only cleared once every one of them has it on disk. if the DB
+// crashes part way through applying a transaction, it is applied again
+// in full the next time the DB is opened. if applying one fails part
+// way through without a crash, the DB and the collections it was being
+// applied to refuse to be read or written with ErrTxFailed, so the half
+// applied transaction is never seen, until the DB is closed and opened
+// again.
 type DB struct {
-	*store
+	dir   string
+	opts  []Option
+	o     *options
+	cols  map[string]*Collection // collections opened so far, by name
+	txlog *os.File               // transaction log, or nil if the DB is in memory
+	err   error                  // set once a transaction fails part way through being applied
+
+	// guards cols; held while a transaction commits
 	sync.RWMutex
 }
 
-func OpenDB() (*DB, error) {
-	st, err := openStore()
+// OpenDB opens (or creates) the DB kept in the directory dir,
+// configured by any options given, and finishes applying the last
+// transaction committed if it crashed part way through
+func OpenDB(dir string, opts ...Option) (*DB, error) {
+	o := newOptions(opts)
+	db := &DB{
+		dir:  dir,
+		opts: opts,
+		o:    o,
+		cols: make(map[string]*Collection),
+	}
+	if o.backend == Memory {
+		return db, nil
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if o.readOnly {
+		flag = os.O_RDONLY
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(filepath.Join(dir, `tx.log`), flag, 0666)
+	if o.readOnly && os.IsNotExist(err) {
+		return db, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &DB{st}, nil
+	if err := lockFile(fd, o.readOnly); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	db.txlog = fd
+	if err := db.recover(); err != nil {
+		CloseDB(db)
+		return nil, err
+	}
+	return db, nil
+}
+
+// Collection returns the collection called name, opening (or creating)
+// it if it isn't open already. it must not be closed; it is closed when
+// the DB is.
+func (db *DB) Collection(name string) (*Collection, error) {
+	db.Lock()
+	c, err := db.collection(name)
+	db.Unlock()
+	return c, logger(err)
+}
+
+// open the collection called name, if it isn't open already. the DB
+// must be locked.
+func (db *DB) collection(name string) (*Collection, error) {
+	if db.cols == nil {
+		return nil, fmt.Errorf("db: database is closed")
+	}
+	if db.err != nil {
+		return nil, db.err
+	}
+	if c, ok := db.cols[name]; ok {
+		return c, nil
+	}
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	c, err := OpenCollection(filepath.Join(db.dir, name), db.opts...)
+	if err != nil {
+		return nil, err
+	}
+	db.cols[name] = c
+	return c, nil
+}
+
+// the collection called name, opening it if it isn't open already, or
+// nil if it doesn't exist. unlike Collection, it never creates one.
+func (db *DB) existing(name string) (*Collection, error) {
+	db.Lock()
+	defer db.Unlock()
+	if db.cols == nil {
+		return nil, fmt.Errorf("db: database is closed")
+	}
+	if db.err != nil {
+		return nil, db.err
+	}
+	if c, ok := db.cols[name]; ok {
+		return c, nil
+	}
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	if db.o.backend == Memory {
+		return nil, nil
+	}
+	if _, err := os.Stat(filepath.Join(db.dir, name) + `.db`); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return db.collection(name)
+}
+
+// check name can be used as the name of a collection; it must name a
+// file in the DB's directory, and nothing else
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("db: invalid collection name %q", name)
+	}
+	return nil
 }
 
 func (db *DB) Insert(ptr interface{}) error {
@@ -67,6 +195,190 @@ func assign(v interface{}) error {
 	return nil
 }
 
+const (
+	dbkMagic   = "godb.dbk" // identifies a database backup image
+	dbkVersion = 1          // current database backup image format version
+	dbkHdr     = 14         // magic (8) + version (2) + collection count (4)
+)
+
+// a database backup image is a header, followed by each collection's
+// name and then its backup image (see Collection.Backup), in order of
+// name.
+//
+//	[0:8]   magic number
+//	[8:10]  format version
+//	[10:14] collection count
+//
+// each collection's name is preceded by its length (2).
+
+// Backup writes a point-in-time consistent image of every collection
+// in the database to w, while other reads and writes carry on. every
+// collection is snapshotted at once, between transactions, so the
+// image holds each transaction whole or not at all. blobs are not part
+// of the image. see Restore.
+func (db *DB) Backup(w io.Writer) error {
+	db.Lock()
+	names, err := db.names()
+	if err != nil {
+		db.Unlock()
+		return logger(err)
+	}
+	cols := make([]*Collection, len(names))
+	for i, name := range names {
+		if cols[i], err = db.collection(name); err != nil {
+			db.Unlock()
+			return logger(err)
+		}
+	}
+	snaps := make([]*snapshot, len(cols))
+	for i, c := range cols {
+		c.Lock()
+		snaps[i] = c.st.idx.ngin.snapshot()
+		c.Unlock()
+	}
+	db.Unlock()
+	defer func() {
+		for i, s := range snaps {
+			s.release(&cols[i].RWMutex)
+		}
+	}()
+	hdr := make([]byte, dbkHdr)
+	copy(hdr[0:8], dbkMagic)
+	binary.BigEndian.PutUint16(hdr[8:10], dbkVersion)
+	binary.BigEndian.PutUint32(hdr[10:14], uint32(len(names)))
+	if _, err := w.Write(hdr); err != nil {
+		return logger(fmt.Errorf("backup: error writing header -> %s", err))
+	}
+	for i, name := range names {
+		b := make([]byte, 2, 2+len(name))
+		binary.BigEndian.PutUint16(b, uint16(len(name)))
+		if _, err := w.Write(append(b, name...)); err != nil {
+			return logger(fmt.Errorf("backup: error writing name of %q -> %s", name, err))
+		}
+		if err := snaps[i].write(&cols[i].RWMutex, w); err != nil {
+			return logger(fmt.Errorf("backup: collection %q -> %s", name, err))
+		}
+	}
+	return nil
+}
+
+// Restore replaces collections of the database with those in an image
+// written by Backup, read from r. the whole image is read and checked
+// before anything is replaced, and ErrBadBackup is returned if it is
+// not intact. collections that are not in the image are left as they
+// are. a collection in the image that is open is closed first, so one
+// got from Collection before must not be used after; get it again.
+func (db *DB) Restore(r io.Reader) error {
+	if db.o.backend == Memory {
+		return logger(fmt.Errorf("restore: cannot restore a database kept in memory"))
+	}
+	if db.o.readOnly {
+		return ErrReadOnly
+	}
+	db.Lock()
+	defer db.Unlock()
+	if db.cols == nil {
+		return logger(fmt.Errorf("db: database is closed"))
+	}
+	br := bufio.NewReader(r)
+	hdr := make([]byte, dbkHdr)
+	if _, err := io.ReadFull(br, hdr); err != nil || string(hdr[0:8]) != dbkMagic {
+		return ErrBadBackup
+	}
+	if v := binary.BigEndian.Uint16(hdr[8:10]); v != dbkVersion {
+		return logger(fmt.Errorf("restore: unsupported backup version %d (expected %d)", v, dbkVersion))
+	}
+	n := int(binary.BigEndian.Uint32(hdr[10:14]))
+	var names []string
+	defer func() {
+		// left behind only if something went wrong
+		for _, name := range names {
+			os.Remove(filepath.Join(db.dir, name) + `.restore.db`)
+		}
+	}()
+	seen := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return ErrBadBackup
+		}
+		b = make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(br, b); err != nil {
+			return ErrBadBackup
+		}
+		name := string(b)
+		if validName(name) != nil || seen[name] {
+			return ErrBadBackup
+		}
+		seen[name] = true
+		names = append(names, name)
+		if err := restore(filepath.Join(db.dir, name)+`.restore.db`, br); err != nil {
+			return logger(err)
+		}
+	}
+	for _, name := range names {
+		if c, ok := db.cols[name]; ok {
+			delete(db.cols, name)
+			if err := c.Close(); err != nil {
+				return logger(err)
+			}
+		}
+		path := filepath.Join(db.dir, name)
+		if err := replace(path, path+`.restore.db`); err != nil {
+			return logger(err)
+		}
+	}
+	return nil
+}
+
+// names of the collections in the database, open or not, in order
+func (db *DB) names() ([]string, error) {
+	seen := make(map[string]bool)
+	for name := range db.cols {
+		seen[name] = true
+	}
+	if db.o.backend != Memory {
+		fis, err := ioutil.ReadDir(db.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, fi := range fis {
+			name := fi.Name()
+			if fi.IsDir() || !strings.HasSuffix(name, `.db`) {
+				continue
+			}
+			name = strings.TrimSuffix(name, `.db`)
+			// blob stores, and files left by a restore or key rotation
+			switch filepath.Ext(name) {
+			case `.blob`, `.restore`, `.rotate`:
+				continue
+			}
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 func CloseDB(db *DB) error {
-	return db.store.close()
+	db.Lock()
+	defer db.Unlock()
+	var err error
+	for _, c := range db.cols {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	db.cols = nil
+	if db.txlog != nil {
+		if terr := db.txlog.Close(); err == nil {
+			err = terr
+		}
+		db.txlog = nil
+	}
+	return err
 }
@@ -0,0 +1,83 @@
+package godb
+
+import (
+	"bytes"
+	"testing"
+)
+
+// test that a database backup brings back every collection as it was,
+// leaving collections not in it alone
+func Test_DB_Backup(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	defer func() { CloseDB(db) }()
+	a, _ := db.Collection("a")
+	for i := 0; i < 500; i++ {
+		a.Add(i, order{i, "a"})
+	}
+	tx := db.Begin()
+	tx.Set("b", 1, order{1, "b"})
+	tx.Set("c", 1, order{1, "c"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("committing: %s\n", err)
+	}
+	// closed collections are backed up too
+	CloseDB(db)
+	db = openTestDB(t, dir)
+	var img bytes.Buffer
+	if err := db.Backup(&img); err != nil {
+		t.Fatalf("backing up: %s\n", err)
+	}
+	a, _ = db.Collection("a")
+	for i := 0; i < 500; i++ {
+		a.Del(i)
+	}
+	b, _ := db.Collection("b")
+	b.Set(2, order{2, "b"})
+	d, _ := db.Collection("d")
+	d.Set(1, order{1, "d"})
+
+	bad := append([]byte{}, img.Bytes()...)
+	bad[len(bad)/2] ^= 1
+	if err := db.Restore(bytes.NewReader(bad)); err != ErrBadBackup {
+		t.Fatalf("expected ErrBadBackup, got: %v\n", err)
+	}
+	if err := db.Restore(bytes.NewReader(img.Bytes()[:img.Len()-1])); err != ErrBadBackup {
+		t.Fatalf("expected ErrBadBackup, got: %v\n", err)
+	}
+	if a.Count() != 0 {
+		t.Fatalf("expected a bad image to change nothing, got: %d records\n", a.Count())
+	}
+	if err := db.Restore(&img); err != nil {
+		t.Fatalf("restoring: %s\n", err)
+	}
+	for name, n := range map[string]int{"a": 500, "b": 1, "c": 1, "d": 1} {
+		c, err := db.Collection(name)
+		if err != nil {
+			t.Fatalf("opening %s: %s\n", name, err)
+		}
+		if c.Count() != n {
+			t.Fatalf("expected %d records in %s, got: %d\n", n, name, c.Count())
+		}
+	}
+	var o order
+	a, _ = db.Collection("a")
+	if err := a.Get(499, &o); err != nil || o.Item != "a" {
+		t.Fatalf("expected %q, got: %q, %v\n", "a", o.Item, err)
+	}
+}
+
+// test that a database kept in memory can be backed up, but not restored
+func Test_DB_BackupMemory(t *testing.T) {
+	db := openTestDB(t, "", WithBackend(Memory))
+	defer CloseDB(db)
+	a, _ := db.Collection("a")
+	a.Set(1, order{1, "a"})
+	var img bytes.Buffer
+	if err := db.Backup(&img); err != nil {
+		t.Fatalf("backing up: %s\n", err)
+	}
+	if err := db.Restore(&img); err == nil {
+		t.Fatalf("expected restoring into memory to fail\n")
+	}
+}
@@ -0,0 +1,89 @@
+package godb
+
+import "fmt"
+
+// Backend selects the kind of device the pages of a collection's
+// data file are kept on
+type Backend byte
+
+const (
+	Mmap   Backend = 0x00 // map the data file into memory (the default)
+	Pread  Backend = 0x01 // read and write the data file with pread / pwrite, through a page cache
+	Memory Backend = 0x02 // keep everything in memory; nothing is written to disk
+)
+
+func (b Backend) String() string {
+	switch b {
+	case Mmap:
+		return "mmap"
+	case Pread:
+		return "pread"
+	case Memory:
+		return "memory"
+	}
+	return fmt.Sprintf("Backend(%d)", byte(b))
+}
+
+// device holds the bytes of a data file for the engine. the slice
+// returned by slice may alias the device, so it must be treated as
+// read-only and not held on to across a write or resize.
+type device interface {
+	size() int
+	slice(off, n int) []byte
+	write(off int, b []byte)
+	resize(size int) error
+	sync() error
+	close() error
+}
+
+// memDevice keeps the data file in a plain byte slice
+type memDevice struct {
+	data []byte
+}
+
+func newMemDevice(size int) *memDevice {
+	return &memDevice{make([]byte, size)}
+}
+
+func (m *memDevice) size() int {
+	return len(m.data)
+}
+
+func (m *memDevice) slice(off, n int) []byte {
+	return m.data[off : off+n]
+}
+
+func (m *memDevice) write(off int, b []byte) {
+	copy(m.data[off:off+len(b)], b)
+}
+
+// resize the device. it grows by at least doubling, so a data file
+// that keeps growing a little at a time is not copied every time.
+func (m *memDevice) resize(size int) error {
+	if size <= cap(m.data) {
+		old := len(m.data)
+		m.data = m.data[:size]
+		// clear anything left over from before it last shrank
+		for i := old; i < size; i++ {
+			m.data[i] = 0
+		}
+		return nil
+	}
+	n := 2 * cap(m.data)
+	if n < size {
+		n = size
+	}
+	data := make([]byte, size, n)
+	copy(data, m.data)
+	m.data = data
+	return nil
+}
+
+func (m *memDevice) sync() error {
+	return nil
+}
+
+func (m *memDevice) close() error {
+	m.data = nil
+	return nil
+}
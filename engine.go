@@ -0,0 +1,879 @@
+package godb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	KB int = (1 << 10) // kilobyte
+	MB int = (1 << 20) // megabyte
+
+	PAGE int = 4 * KB // default page size
+
+	EMPTY byte = 0x00 // marks a free page (files are zero filled)
+	START byte = 0x01 // marks the first page of a record
+
+	pgHdr    = 11     // page header; marker (1) + page count (2) + length (4) + crc32c (4)
+	maxPages = 0xFFFF // maximum number of pages a record may span
+)
+
+// storage is where a btree keeps its records, each one found by
+// the page (block) it starts at. the engine implements it on top
+// of any of the devices chosen with a Backend.
+type storage interface {
+	open(path string) (bool, error)
+	addRecord(r *record) (int, error)
+	setRecord(k int, r *record) (int, error)
+	getRecord(k int) (*record, error)
+	getRecordVal(k int) ([]byte, int64, error)
+	getRecordExp(k int) (int64, error)
+	delRecord(k int) error
+	loadAllRecords() <-chan payload
+	raw(k, n int) []byte
+	cut(k, n int)
+	span(k int) int
+	move(k int) (int, bool)
+	truncate() (int64, error)
+	version() uint64
+	expiring() bool
+	maxValSize() int
+	snapshot() *snapshot
+	release(s *snapshot)
+	sync() error
+	close() error
+}
+
+// database engine. every record is stored in a run of one or
+// more contiguous pages; the first page of the run begins with
+// a small header holding a start marker, the number of pages
+// in the run, the length of the record data and a checksum of
+// it, so each record only occupies the pages it needs and any
+// damage to it can be detected when it is read back. the pages
+// themselves are kept on a device, which decides how they are
+// read from and written to the data file (or memory).
+type engine struct {
+	file  *os.File // underlying data file, or nil if kept in memory
+	dev   device   // holds the pages of the data file
+	page  int
+	zero  []byte
+	free  *freemap
+	comp  Compression // compression used for values written to the engine
+	crypt *crypter    // seals records if the data file is encrypted, otherwise nil
+	snaps []*snapshot // snapshots being taken of the data file by backups
+
+	maxVal int // largest val a record can hold, set from the page size on open
+
+	backend Backend // kind of device the pages are kept on
+	fs      fsys    // opens the files kept alongside the data file
+
+	ro bool // opened read-only; the file is locked shared and never written to
+	//maxKey = 24
+	//maxVal = page - maxKey - 1 // (-1 is for EOF) 4071
+}
+
+// create a new engine, set up with the given options
+func newEngine(o *options) *engine {
+	return &engine{
+		comp:    o.comp,
+		crypt:   o.crypt,
+		backend: o.backend,
+		fs:      o.fs,
+		ro:      o.readOnly,
+	}
+}
+
+func createEmptyFile(path string, size int) error {
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = fd.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ErrLocked is returned when opening a data file that is already
+// open, in this process or another one, in a way that conflicts
+var ErrLocked = errors.New("engine: data file is locked by another open collection")
+
+// take an advisory lock on a file without waiting for it. a shared
+// lock may be held by any number of readers at once, whereas an
+// exclusive lock is only given to one opener with no readers.
+func lockFile(fd *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(fd.Fd()), how|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return ErrLocked
+		}
+		return err
+	}
+	return nil
+}
+
+// release an advisory lock on a file
+func unlockFile(fd *os.File) error {
+	return syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+}
+
+// copy the file at src to dst, syncing dst to disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (e *engine) open(path string) (bool, error) {
+	// check to make sure engine is not already open
+	if e.dev != nil {
+		// return an error if it is
+		return true, fmt.Errorf("engine[open]: engine is already open at path %q\n", path)
+	}
+	if e.backend == Memory {
+		if e.ro {
+			return false, fmt.Errorf("engine[open]: an in-memory engine cannot be opened read-only")
+		}
+		// nothing is kept on disk, so it is always new
+		e.dev = newMemDevice(2 * MB)
+		return e.setup(path, true)
+	}
+	_, err := os.Stat(path + `.db`)
+	var fdstat bool
+	// new instance
+	if err != nil && !os.IsExist(err) {
+		if e.ro {
+			// nothing is ever created when read-only
+			return fdstat, err
+		}
+		fdstat = true
+		dirs, _ := filepath.Split(path)
+		err = os.MkdirAll(dirs, 0755) // 0800
+		if err != nil {
+			return fdstat, err
+		}
+		// create new database file with initial size of 2MB
+		err = createEmptyFile(path+`.db`, 2*MB)
+		if err != nil {
+			return fdstat, err
+		}
+	}
+	// existing
+	// (not O_APPEND; the pread backend writes at offsets with pwrite)
+	flag, prot := os.O_RDWR, PROT
+	if e.ro {
+		flag, prot = os.O_RDONLY, uint(syscall.PROT_READ)
+	}
+	fd, err := os.OpenFile(path+`.db`, flag, 0666) // 0800
+	if err != nil {
+		return fdstat, err
+	}
+	// lock the file before touching it, so that no two engines ever
+	// map the same file for writing; each would overwrite the other
+	if err := lockFile(fd, e.ro); err != nil {
+		fd.Close()
+		return fdstat, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return fdstat, err
+	}
+	e.file = fd
+	if e.backend == Pread {
+		// read and write the file through a page cache
+		e.dev = newFileDevice(fd, int(info.Size()))
+	} else {
+		// map file into virtual address space
+		if e.dev, err = newMmapDevice(fd, info.Size(), prot); err != nil {
+			fd.Close()
+			e.file = nil
+			return fdstat, err
+		}
+	}
+	return e.setup(path, fdstat)
+}
+
+// set up a newly opened engine, reading (or writing, if the data file
+// is new) the superblock and opening the free page map
+func (e *engine) setup(path string, fdstat bool) (bool, error) {
+	if e.crypt != nil {
+		// nonce sequence numbers are kept in the superblock
+		e.crypt.next = e.nextSeq
+	}
+	var err error
+	if fdstat {
+		// new file, so write a superblock using the default page size
+		e.page = PAGE
+		err = e.initSuper()
+	} else {
+		err = e.readSuper(path)
+	}
+	if err != nil {
+		// refuse files we don't understand, or can't set up
+		e.abandon()
+		return fdstat, err
+	}
+	if !e.ro {
+		// flag the file as open until it is closed
+		e.setFlags(sbOpen, true)
+	}
+	// the largest val that fits in a record (-1 is for EOF)
+	e.maxVal = maxPages*e.page - pgHdr - keyHdr - maxKey - 1
+	if e.crypt != nil {
+		e.maxVal -= e.crypt.overhead()
+	}
+	// set / reassign empty block
+	e.zero = make([]byte, e.page)
+	if e.ro {
+		// nothing is allocated when read-only, so no free page map
+		return fdstat, nil
+	}
+	// open the free page map, rebuilding it if it can't be trusted
+	e.free, err = openFreemap(e.fs, path, e.dev.size()/e.page)
+	if err != nil {
+		e.abandon()
+		return fdstat, err
+	}
+	if e.free.stale {
+		e.rebuildFreemap()
+	}
+	// there were no errors, so return mapped size and a nil error
+	return fdstat, nil
+}
+
+// let go of the device and data file (and so its lock) of an engine
+// that failed to open
+func (e *engine) abandon() {
+	e.dev.close()
+	e.dev = nil
+	if e.file != nil {
+		e.file.Close()
+		e.file = nil
+	}
+}
+
+// return the largest val a record in the data file can hold
+func (e *engine) maxValSize() int {
+	return e.maxVal
+}
+
+// rebuild the free page map by walking the mapped file
+// one record (run of pages) at a time. the record count in
+// the superblock is corrected along the way.
+func (e *engine) rebuildFreemap() {
+	e.free.reset()
+	// page 0 always holds the superblock
+	e.free.set(0)
+	var count int
+	for k := 1; (k+1)*e.page <= e.dev.size(); {
+		n := e.span(k)
+		if n == 0 {
+			k++
+			continue
+		}
+		for i := k; i < k+n && i < e.free.pages; i++ {
+			e.free.set(i)
+		}
+		count++
+		k += n
+	}
+	e.addCount(count - e.count())
+}
+
+// return the number of pages needed to hold sz bytes of record data
+func (e *engine) pages(sz int) int {
+	if e.crypt != nil {
+		sz += e.crypt.overhead()
+	}
+	return (sz + pgHdr + e.page - 1) / e.page
+}
+
+// return the number of pages spanned by the record starting at page
+// k, or zero if page k is not the first page of a record
+func (e *engine) span(k int) int {
+	b := e.dev.slice(k*e.page, 3)
+	if b[0] != START {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b[1:3]))
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// write the page header and record data for a run of n pages at page
+// k. if the engine is encrypted the record data is sealed first, using
+// a nonce derived from page k, so the checksum covers the sealed data.
+func (e *engine) write(k, n int, r *record) {
+	data := r.data
+	if e.crypt != nil {
+		data = e.crypt.seal(sealRecord, k, data)
+	}
+	e.touch(k, n)
+	hdr := make([]byte, pgHdr)
+	hdr[0] = START
+	binary.BigEndian.PutUint16(hdr[1:3], uint16(n))
+	binary.BigEndian.PutUint32(hdr[3:7], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[7:11], crc32.Checksum(data, castagnoli))
+	o := k * e.page
+	e.dev.write(o, hdr)
+	e.dev.write(o+pgHdr, data)
+}
+
+// wipe a run of n pages at page k
+func (e *engine) wipe(k, n int) {
+	e.touch(k, n)
+	for i := k; i < k+n; i++ {
+		e.dev.write(i*e.page, e.zero)
+	}
+}
+
+// find n contiguous free pages, growing the file if there are none
+func (e *engine) alloc(n int) (int, error) {
+	if n > maxPages {
+		return -1, ErrPageSize
+	}
+	k, ok := e.free.alloc(n)
+	for !ok {
+		// haven't found enough empty pages, so let's grow the file
+		if err := e.grow(); err != nil {
+			return -1, err
+		}
+		k, ok = e.free.alloc(n)
+	}
+	return k, nil
+}
+
+// add a new record to the engine at the first available slot
+// return a non-nil error if there is an issue growing the file
+func (e *engine) addRecord(r *record) (int, error) {
+	// find the first run of free pages large enough to hold the record
+	n := e.pages(len(r.data))
+	k, err := e.alloc(n)
+	if err != nil {
+		return -1, err
+	}
+	// write data to pages
+	e.write(k, n, r)
+	e.addCount(1)
+	e.seeVersion(r.version())
+	e.seeExpiry(r.expires())
+	// return location of block in page offset
+	return k, nil
+}
+
+// update a record at provided offset, assuming one exists. if
+// the updated record no longer fits in its current run of pages
+// it is moved, so the (possibly new) page offset is returned.
+// return a non-nil error if offset is outside of mapped reigon
+func (e *engine) setRecord(k int, r *record) (int, error) {
+	// get byte offset from block position k
+	o := k * e.page
+	// do a bounds check; if outside of mapped reigon...
+	if o+e.page > e.dev.size() {
+		// do not grow, return an error
+		return -1, fmt.Errorf("engine[set]: cannot update record at block %d (offset %d)\n", k, o)
+	}
+	e.seeVersion(r.version())
+	e.seeExpiry(r.expires())
+	have, need := e.span(k), e.pages(len(r.data))
+	if need > have {
+		// record has outgrown its pages, move it
+		j, err := e.alloc(need)
+		if err != nil {
+			return -1, err
+		}
+		e.write(j, need, r)
+		e.wipe(k, have)
+		e.free.free(k, have)
+		return j, nil
+	}
+	// wipe pages in case updated data is smaller than original dataset
+	e.wipe(k, have)
+	// write updated data to pages, releasing any it no longer needs
+	e.write(k, need, r)
+	e.free.free(k+need, have-need)
+	// there were no errors, so return the same offset
+	return k, nil
+}
+
+var ErrEmptyRecord error = errors.New("engine: empty record found")
+var ErrEngineEOF error = io.EOF
+
+// CorruptError is returned when a record read back from the
+// engine is not framed correctly or does not match its checksum
+type CorruptError struct {
+	Block  int    // first page of the corrupt record
+	Reason string // what was wrong with it
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("engine: corrupt record at block %d (%s)", e.Block, e.Reason)
+}
+
+// return the record data for the run of pages starting at page k (the
+// key, the val and the eof marker) after verifying it against the
+// checksum in the page header, and decrypting and authenticating it
+// if the engine is encrypted. returns ErrEmptyRecord if there is no
+// record at page k, or a *CorruptError if the record is damaged.
+func (e *engine) extent(k int) ([]byte, error) {
+	n := e.span(k)
+	if n == 0 {
+		return nil, ErrEmptyRecord
+	}
+	o := k * e.page
+	if o+n*e.page > e.dev.size() {
+		return nil, &CorruptError{k, "page count runs past end of file"}
+	}
+	hdr := e.dev.slice(o, pgHdr)
+	sz := int(binary.BigEndian.Uint32(hdr[3:7]))
+	if sz < keyHdr+1 || pgHdr+sz > n*e.page {
+		return nil, &CorruptError{k, fmt.Sprintf("invalid length %d", sz)}
+	}
+	ext := e.dev.slice(o+pgHdr, sz)
+	if sum := binary.BigEndian.Uint32(hdr[7:11]); sum != crc32.Checksum(ext, castagnoli) {
+		return nil, &CorruptError{k, "checksum mismatch"}
+	}
+	if e.crypt != nil {
+		var err error
+		if ext, err = e.crypt.open(sealRecord, k, ext); err != nil {
+			return nil, &CorruptError{k, err.Error()}
+		}
+		if sz = len(ext); sz < keyHdr+1 {
+			return nil, &CorruptError{k, fmt.Sprintf("invalid length %d", sz)}
+		}
+	}
+	if ext[sz-1] != eofVal {
+		return nil, &CorruptError{k, "missing eof marker"}
+	}
+	if kl := (&record{ext}).keyLen(); keyHdr+kl+1 > sz {
+		return nil, &CorruptError{k, fmt.Sprintf("invalid key length %d", kl)}
+	}
+	return ext, nil
+}
+
+// return a record at provided offset, assuming one exists
+// return a non-nil error if offset is outside of mapped reigon
+func (e *engine) getRecord(k int) (*record, error) {
+	// get byte offset from block position k
+	o := k * e.page
+	// do a bounds check; if outside of mapped reigon...
+	if o+e.page > e.dev.size() {
+		// ...return an error
+		return nil, ErrEngineEOF //fmt.Errorf("engine[get]: cannot return record at block %d (offset %d)\n", k, o)
+	}
+	// create record to return
+	r := new(record)
+	// fill out record data if not empty and intact, returning no error
+	ext, err := e.extent(k)
+	if err != nil {
+		// otherwise, return empty record, with an error
+		return r, err
+	}
+	r.data = ext
+	return r, nil
+}
+
+func (e *engine) getRecordKey(k int) ([]byte, error) {
+	// get byte offset from block position k
+	o := k * e.page
+	// do a bounds check; if outside of mapped reigon...
+	if o+e.page > e.dev.size() {
+		// ...return an error
+		return nil, fmt.Errorf("engine[getKey]: cannot return key at block %d (offset %d)\n", k, o)
+	}
+	ext, err := e.extent(k)
+	if err == ErrEmptyRecord {
+		// return empty record, with an error
+		return nil, fmt.Errorf("engine[getKey]: empty key found at block %d (offset %d)", k, o)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return (&record{ext}).key(), nil
+}
+
+// return the expiry time of the record at page k, read from its
+// header; the value is left as it is
+func (e *engine) getRecordExp(k int) (int64, error) {
+	// get byte offset from block position k
+	o := k * e.page
+	// do a bounds check; if outside of mapped reigon...
+	if o+e.page > e.dev.size() {
+		// ...return an error
+		return 0, fmt.Errorf("engine[getExp]: cannot return expiry at block %d (offset %d)\n", k, o)
+	}
+	ext, err := e.extent(k)
+	if err == ErrEmptyRecord {
+		return 0, fmt.Errorf("engine[getExp]: empty record found at block %d (offset %d)", k, o)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return (&record{ext}).expires(), nil
+}
+
+// return the (decompressed) val of the record at page k, along with
+// its expiry time
+func (e *engine) getRecordVal(k int) ([]byte, int64, error) {
+	// get byte offset from block position k
+	o := k * e.page
+	// do a bounds check; if outside of mapped reigon...
+	if o+e.page > e.dev.size() {
+		// ...return an error
+		return nil, 0, fmt.Errorf("engine[getVal]: cannot return val at block %d (offset %d)\n", k, o)
+	}
+	// fill out record data if not empty and intact, returning no error
+	ext, err := e.extent(k)
+	if err == ErrEmptyRecord {
+		// otherwise, return empty record, with an error
+		return nil, 0, fmt.Errorf("engine[getVal]: empty val found at block %d (offset %d)", k, o)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	r := &record{ext}
+	val, err := r.value()
+	if err != nil {
+		return nil, 0, &CorruptError{k, fmt.Sprintf("cannot decompress value -> %s", err)}
+	}
+	return val, r.expires(), nil
+}
+
+// delete a record at provided offset, assuming one exists
+// return a non-nil error if offset is outside of mapped reigon
+func (e *engine) delRecord(k int) error {
+	// get byte offset from block position k
+	o := k * e.page
+	// do a bounds check; if outside of mapped reigon...
+	if o+e.page > e.dev.size() {
+		// ...return an error
+		return fmt.Errorf("engine[del]: cannot delete record at block %d (offset %d)\n", k, o)
+	}
+	// otherwise, wipe every page in the record's run
+	n := e.span(k)
+	if n == 0 {
+		return fmt.Errorf("engine[del]: no record at block %d (offset %d)\n", k, o)
+	}
+	e.wipe(k, n)
+	// and mark the pages as free
+	e.free.free(k, n)
+	e.addCount(-1)
+	// there were no errors, so return nil
+	return nil
+}
+
+// grow the underlying file
+func (e *engine) grow() error {
+	// resize the size to double the current, ie. len * 2
+	size := ((e.dev.size() * 2) + e.page - 1) &^ (e.page - 1)
+	if err := e.dev.resize(size); err != nil {
+		return err
+	}
+	// track the new pages in the free page map
+	e.free.grow(size / e.page)
+	// there were no errors, so return nil
+	return nil
+}
+
+// copy the record at page k into the first run of free pages
+// that comes before it in the file. returns the new page of the
+// record, or false if there is no such run and it was left alone.
+// the record is left where it was as well, so it is never only in
+// memory; the old copy is cut once the new one is on disk.
+func (e *engine) move(k int) (int, bool) {
+	n := e.span(k)
+	if n == 0 {
+		return k, false
+	}
+	j, ok := e.free.alloc(n)
+	if !ok || j > k {
+		if ok {
+			e.free.free(j, n)
+		}
+		return k, false
+	}
+	if e.crypt != nil {
+		// the nonce is derived from the page, so the record has to be
+		// sealed again for its new page rather than copied as it is
+		ext, err := e.extent(k)
+		if err != nil {
+			e.free.free(j, n)
+			return k, false
+		}
+		e.write(j, n, &record{ext})
+	} else {
+		// copy the pages as they are, header and all
+		e.touch(j, n)
+		e.dev.write(j*e.page, e.dev.slice(k*e.page, n*e.page))
+	}
+	// make sure the copy reads back before it is used
+	if _, err := e.extent(j); err != nil {
+		logger(fmt.Errorf("engine[move]: bad copy of record at block %d -> %s", k, err))
+		e.cut(j, n)
+		return k, false
+	}
+	return j, true
+}
+
+// truncate the empty pages at the end of the file, keeping at
+// least the initial file size, and return the bytes reclaimed
+func (e *engine) truncate() (int64, error) {
+	size := (e.free.last() + 1) * e.page
+	if size < 2*MB {
+		size = 2 * MB
+	}
+	if size >= e.dev.size() {
+		return 0, nil
+	}
+	reclaimed := int64(e.dev.size() - size)
+	if err := e.dev.resize(size); err != nil {
+		return 0, err
+	}
+	e.free.shrink(size / e.page)
+	return reclaimed, nil
+}
+
+// close the engine, return any errors encountered
+func (e *engine) close() error {
+	if !e.ro {
+		// flush the free page map so it can be trusted on the next open
+		if err := e.free.close(); err != nil {
+			return err
+		}
+		e.setFlags(sbOpen, false)
+	}
+	if err := e.dev.close(); err != nil { // flush and release the device
+		return err
+	}
+	e.dev = nil
+	if e.file == nil {
+		// nothing kept on disk
+		return nil
+	}
+	if err := unlockFile(e.file); err != nil { // release lock on underlying file
+		return err
+	}
+	if err := e.file.Close(); err != nil { // close underlying file
+		return err
+	}
+	e.file = nil // set file descriptor to nil
+	// there were no errors, so return nil
+	return nil
+}
+
+// flush the data file to disk, blocking until it has been written
+func (e *engine) sync() error {
+	return e.dev.sync()
+}
+
+// return a copy of the run of n pages at page k, as they are
+func (e *engine) raw(k, n int) []byte {
+	return append([]byte(nil), e.dev.slice(k*e.page, n*e.page)...)
+}
+
+// cut the run of n pages at page k out of the data file; the pages
+// are wiped and marked free. the record they held (if any) must not
+// be left in the index.
+func (e *engine) cut(k, n int) {
+	e.wipe(k, n)
+	e.free.free(k, n)
+}
+
+// temp structure
+type payload struct {
+	key []byte
+	pos int
+	n   int   // number of pages in the record's run
+	err error // non-nil if the record at pos is corrupt
+}
+
+// get all of the record data payloads from the engine
+func (e *engine) loadAllRecords() <-chan payload {
+	// initialize the channels to return the keys and blocks on
+	loader := make(chan payload)
+	go func() {
+		// start iterating through mapped file reigon one record at a
+		// time, skipping over the superblock in page 0
+		for k := 1; (k+1)*e.page <= e.dev.size(); k++ {
+			// checking for the first page of a record
+			n := e.span(k)
+			if n == 0 {
+				continue
+			}
+			ext, err := e.extent(k)
+			if err != nil {
+				if (k+n)*e.page > e.dev.size() {
+					// the page count can't be trusted, so don't skip
+					// over any records that may follow
+					n = 1
+				}
+				// found a damaged one; report it instead of indexing it
+				loader <- payload{nil, k, n, err}
+			} else {
+				// found one; return key and block offset
+				loader <- payload{(&record{ext}).key(), k, n, nil}
+			}
+			// skip over the rest of the record's pages
+			k += n - 1
+		}
+		close(loader)
+	}()
+	return loader
+}
+
+/* +--------------------+ //
+// | MEMORY MAPPED FILE | //
+// +--------------------+ */
+
+const (
+	PROT  uint = syscall.PROT_READ | syscall.PROT_WRITE
+	FLAGS uint = syscall.MAP_SHARED
+)
+
+/*func mmap(fd *os.File, off, len int) []byte {
+	mm, err := mmapat(fd.Fd(), int64(off), int64(len), PROT, FLAGS)
+	if err != nil {
+		panic(err)
+	}
+	return mm
+}*/
+
+// map length bytes of fd from offset into memory, or the whole file
+// if length is -1
+func mmapat(fd uintptr, offset, length int64, prot uint, flags uint) ([]byte, error) {
+	if length == -1 {
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(int(fd), &stat); err != nil {
+			return nil, err
+		}
+		length = stat.Size
+	}
+	return syscall.Mmap(int(fd), offset, int(length), int(prot), int(flags))
+}
+
+// mmapDevice keeps the pages of the data file in a shared memory
+// mapping of it, so reads and writes go straight to the page cache
+type mmapDevice struct {
+	file *os.File
+	data []byte
+	prot uint
+}
+
+// map the first size bytes of fd into memory
+func newMmapDevice(fd *os.File, size int64, prot uint) (*mmapDevice, error) {
+	data, err := mmapat(fd.Fd(), 0, size, prot, FLAGS)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapDevice{fd, data, prot}, nil
+}
+
+func (m *mmapDevice) size() int {
+	return len(m.data)
+}
+
+func (m *mmapDevice) slice(off, n int) []byte {
+	return m.data[off : off+n]
+}
+
+func (m *mmapDevice) write(off int, b []byte) {
+	copy(m.data[off:off+len(b)], b)
+}
+
+// resize the underlying file and map it again
+func (m *mmapDevice) resize(size int) error {
+	// unmap current mapping before resizing underlying file...
+	m.munmap()
+	// truncate underlying file to updated size, check for errors
+	if err := syscall.Ftruncate(int(m.file.Fd()), int64(size)); err != nil {
+		return err
+	}
+	// remap underlying file now that it has been resized
+	data, err := mmapat(m.file.Fd(), 0, int64(size), m.prot, FLAGS)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+// unmap the file (Munmap automatically flushes)
+func (m *mmapDevice) close() error {
+	m.munmap()
+	m.data = nil
+	return nil
+}
+
+func (m *mmapDevice) munmap() {
+	if err := syscall.Munmap(m.data); err != nil {
+		panic(err)
+	}
+}
+
+// call msync on the mapping with the given flags
+func (m *mmapDevice) msyncf(flags int) error {
+	if len(m.data) == 0 {
+		return nil
+	}
+	_, _, err := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&m.data[0])), uintptr(len(m.data)), uintptr(flags))
+	if err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (m *mmapDevice) msync() {
+	if err := m.msyncf(syscall.MS_ASYNC); err != nil {
+		panic(err)
+	}
+}
+
+// flush the mapping to disk, blocking until it has been written
+func (m *mmapDevice) sync() error {
+	return m.msyncf(syscall.MS_SYNC)
+}
+
+func (m *mmapDevice) misresident() ([]bool, error) {
+	sz := os.Getpagesize()                    // page size
+	re := make([]bool, (len(m.data)+sz-1)/sz) // result
+	if len(re) == 0 {
+		return re, nil
+	}
+	_, _, err := syscall.Syscall(syscall.SYS_MINCORE, uintptr(unsafe.Pointer(&m.data[0])), uintptr(len(m.data)), uintptr(unsafe.Pointer(&re[0])))
+	for i := range re {
+		*(*uint8)(unsafe.Pointer(&re[i])) &= 1
+	}
+	if err != 0 {
+		return nil, err
+	}
+	return re, nil
+}
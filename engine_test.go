@@ -0,0 +1,107 @@
+package godb
+
+import (
+	"errors"
+	"testing"
+)
+
+// flip a bit of the byte at off in the data file of the collection
+func flipByte(c *Collection, off int) {
+	b := c.st.idx.ngin.(*engine).dev.slice(off, 1)
+	b[0] ^= 0x01
+}
+
+// test that a record whose pages have been damaged is reported as
+// corrupt when it is read, and that other records still read fine
+func Test_Engine_Checksum(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend))
+		defer c.Close()
+		e := c.st.idx.ngin.(*engine)
+		small, large := make([]byte, 100), make([]byte, 3*e.page)
+		c.Add("small", small)
+		c.Add("large", large)
+		c.Add("other", small)
+		blks, err := c.st.blocks()
+		if err != nil {
+			t.Fatalf("listing blocks: %s\n", err)
+		}
+		pos := make(map[string]int)
+		for _, key := range []string{"small", "large"} {
+			k, _ := genKey(key)
+			for _, blk := range blks {
+				if string(blk.key) == string(k) {
+					pos[key] = blk.pos
+				}
+			}
+		}
+		// somewhere in the val of the small record, and on the last page
+		// of the large one
+		flipByte(c, pos["small"]*e.page+pgHdr+50)
+		flipByte(c, (pos["large"]+e.span(pos["large"])-1)*e.page+10)
+		for _, key := range []string{"small", "large"} {
+			var b []byte
+			err := c.Get(key, &b)
+			var cerr *CorruptError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("expected a *CorruptError for %s, got: %v\n", key, err)
+			}
+			if cerr.Block != pos[key] || cerr.Reason != "checksum mismatch" {
+				t.Fatalf("expected a checksum mismatch at block %d, got: %s\n", pos[key], cerr)
+			}
+		}
+		var b []byte
+		if err := c.Get("other", &b); err != nil || len(b) != len(small) {
+			t.Fatalf("expected %d bytes, got: %d, %v\n", len(small), len(b), err)
+		}
+	})
+}
+
+// test that a damaged page header is caught before the record is read
+func Test_Engine_BadHeader(t *testing.T) {
+	forBackends(t, allBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend))
+		defer c.Close()
+		e := c.st.idx.ngin.(*engine)
+		c.Add("a", 1)
+		blks, _ := c.st.blocks()
+		// the high byte of the length
+		flipByte(c, blks[0].pos*e.page+3)
+		if _, err := e.extent(blks[0].pos); err == nil {
+			t.Fatalf("expected a damaged header to be reported\n")
+		}
+		if _, err := e.extent(blks[0].pos + 1); err != ErrEmptyRecord {
+			t.Fatalf("expected ErrEmptyRecord, got: %v\n", err)
+		}
+	})
+}
+
+// test that a data file is opened by one writer, or any number of
+// readers, at a time
+func Test_Engine_Lock(t *testing.T) {
+	forBackends(t, fileBackends, func(t *testing.T, path string, backend Backend) {
+		c := openTestCollection(t, path, WithBackend(backend))
+		c.Add(1, "a")
+		if _, err := OpenCollection(path, WithBackend(backend)); err != ErrLocked {
+			t.Fatalf("expected ErrLocked, got: %v\n", err)
+		}
+		if _, err := OpenCollection(path, WithBackend(backend), ReadOnly()); err != ErrLocked {
+			t.Fatalf("expected ErrLocked opening a reader, got: %v\n", err)
+		}
+		c.Close()
+		r1 := openTestCollection(t, path, WithBackend(backend), ReadOnly())
+		r2 := openTestCollection(t, path, WithBackend(backend), ReadOnly())
+		if _, err := OpenCollection(path, WithBackend(backend)); err != ErrLocked {
+			t.Fatalf("expected ErrLocked opening a writer, got: %v\n", err)
+		}
+		var s string
+		if err := r2.Get(1, &s); err != nil || s != "a" {
+			t.Fatalf("expected %q, got: %q, %v\n", "a", s, err)
+		}
+		r1.Close()
+		r2.Close()
+		// the lock goes with the last of them
+		c = openTestCollection(t, path, WithBackend(backend))
+		c.Close()
+	})
+}
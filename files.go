@@ -0,0 +1,168 @@
+package godb
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// file is what the engine needs of the files kept alongside the
+// data file (the free page map, index and write-ahead log)
+type file interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+	Stat() (os.FileInfo, error)
+}
+
+// fsys opens the files kept alongside the data file
+type fsys interface {
+	openFile(name string, flag int) (file, error)
+}
+
+// osFS opens files on disk
+type osFS struct{}
+
+func (osFS) openFile(name string, flag int) (file, error) {
+	fd, err := os.OpenFile(name, flag, 0666)
+	if err != nil {
+		// don't hand back a nil *os.File wrapped in a non-nil file
+		return nil, err
+	}
+	return fd, nil
+}
+
+// memFS keeps files in memory, for the Memory backend
+type memFS struct {
+	sync.Mutex
+	files map[string]*memFile
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string]*memFile)}
+}
+
+func (fs *memFS) openFile(name string, flag int) (file, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		f = &memFile{name: name}
+		fs.files[name] = f
+	}
+	return f, nil
+}
+
+// memFile is a file kept in memory. it is held in chunks, so it grows
+// without copying what is already there, and a chunk is only
+// allocated once something is written to it; like a hole in a file on
+// disk, a gap that is never written (the unused end of a node page, say)
+// takes up no room.
+type memFile struct {
+	sync.Mutex
+	name   string
+	size   int64
+	chunks map[int64][]byte
+}
+
+// size of a single chunk of a memFile
+const memChunk = int64(4 * KB)
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if rest := f.size - off; int64(n) > rest {
+		n = int(rest)
+	}
+	for i := 0; i < n; {
+		c, o := (off+int64(i))/memChunk, (off+int64(i))%memChunk
+		m := n - i
+		if rest := int(memChunk - o); m > rest {
+			m = rest
+		}
+		if chunk, ok := f.chunks[c]; ok {
+			copy(b[i:i+m], chunk[o:])
+		} else {
+			for j := i; j < i+m; j++ {
+				b[j] = 0
+			}
+		}
+		i += m
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.chunks == nil {
+		f.chunks = make(map[int64][]byte)
+	}
+	for i := 0; i < len(b); {
+		c, o := (off+int64(i))/memChunk, (off+int64(i))%memChunk
+		chunk, ok := f.chunks[c]
+		if !ok {
+			chunk = make([]byte, memChunk)
+			f.chunks[c] = chunk
+		}
+		i += copy(chunk[o:], b[i:])
+	}
+	if end := off + int64(len(b)); end > f.size {
+		f.size = end
+	}
+	return len(b), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.Lock()
+	defer f.Unlock()
+	// drop whatever lies past the new end, so it reads back as zeros
+	// if the file grows again
+	for c, chunk := range f.chunks {
+		switch start := c * memChunk; {
+		case start >= size:
+			delete(f.chunks, c)
+		case start+memChunk > size:
+			for j := size - start; j < memChunk; j++ {
+				chunk[j] = 0
+			}
+		}
+	}
+	f.size = size
+	return nil
+}
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.Lock()
+	defer f.Unlock()
+	return memInfo{f.name, f.size}, nil
+}
+
+// memInfo describes a memFile
+type memInfo struct {
+	name string
+	size int64
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return 0666 }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return false }
+func (i memInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,82 @@
+package godb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+// test that a memFile reads back what was written, with zeros in the gaps
+func Test_MemFile_ReadWrite(t *testing.T) {
+	f := &memFile{name: "test"}
+	// straddle a chunk boundary, and leave a hole in front of it
+	off := 3*memChunk - 5
+	if _, err := f.WriteAt([]byte("hello, world"), off); err != nil {
+		t.Fatalf("writing: %s\n", err)
+	}
+	if len(f.chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got: %d\n", len(f.chunks))
+	}
+	if fi, _ := f.Stat(); fi.Size() != off+12 {
+		t.Fatalf("expected size %d, got: %d\n", off+12, fi.Size())
+	}
+	b := make([]byte, 20)
+	n, err := f.ReadAt(b, off-4)
+	if n != 16 || err != io.EOF {
+		t.Fatalf("expected 16 bytes and EOF, got: %d, %v\n", n, err)
+	}
+	if want := append(make([]byte, 4), "hello, world"...); !bytes.Equal(b[:n], want) {
+		t.Fatalf("expected %q, got: %q\n", want, b[:n])
+	}
+	if _, err := f.ReadAt(b, off+12); err != io.EOF {
+		t.Fatalf("expected EOF reading past the end, got: %v\n", err)
+	}
+}
+
+// test that truncating a memFile drops what lies past the new end
+func Test_MemFile_Truncate(t *testing.T) {
+	f := &memFile{name: "test"}
+	f.WriteAt(bytes.Repeat([]byte{0xFF}, int(2*memChunk)), 0)
+	if err := f.Truncate(memChunk / 2); err != nil {
+		t.Fatalf("truncating: %s\n", err)
+	}
+	if len(f.chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got: %d\n", len(f.chunks))
+	}
+	// growing it again must not bring back the old bytes
+	f.Truncate(2 * memChunk)
+	b := make([]byte, 2*memChunk)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("reading: %s\n", err)
+	}
+	for i, c := range b {
+		want := byte(0xFF)
+		if i >= int(memChunk/2) {
+			want = 0
+		}
+		if c != want {
+			t.Fatalf("expected %#x at %d, got: %#x\n", want, i, c)
+		}
+	}
+}
+
+// test that the memory file system only creates files when asked to
+func Test_MemFS_Open(t *testing.T) {
+	fs := newMemFS()
+	if _, err := fs.openFile("test", os.O_RDWR); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got: %v\n", err)
+	}
+	a, err := fs.openFile("test", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatalf("creating: %s\n", err)
+	}
+	a.WriteAt([]byte("data"), 0)
+	b, err := fs.openFile("test", os.O_RDWR)
+	if err != nil {
+		t.Fatalf("opening: %s\n", err)
+	}
+	if fi, _ := b.Stat(); fi.Size() != 4 {
+		t.Fatalf("expected the same file, got size: %d\n", fi.Size())
+	}
+}
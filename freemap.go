@@ -0,0 +1,237 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	fmHeader = 16 // page count (8) + clean flag (1) + reserved (7)
+
+	fmClean byte = 0x01 // map was flushed on close and matches the data file
+	fmDirty byte = 0x00 // map is (or may be) out of date with the data file
+)
+
+// freemap is a persistent bitmap of the pages in the data
+// file. it holds one bit per page; a set bit means the page
+// is in use, and a clear bit means the page is free. it is
+// kept alongside the data file (path + `.fm`) so allocating
+// a page does not require walking the whole mapped file.
+type freemap struct {
+	file  file     // underlying free map file
+	bits  []uint64 // one bit per page
+	pages int      // number of pages being tracked
+	hint  int      // word index to begin searching for a free page
+	stale bool     // set when the map on disk could not be trusted
+}
+
+// open (or create) the free map for the data file at path. if the
+// map is missing, was not closed cleanly, or does not track the same
+// number of pages as the data file, it is marked stale and must be
+// rebuilt by the caller before it is used.
+func openFreemap(fs fsys, path string, pages int) (*freemap, error) {
+	fd, err := fs.openFile(path+`.fm`, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	m := &freemap{
+		file:  fd,
+		bits:  make([]uint64, words(pages)),
+		pages: pages,
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	b := make([]byte, info.Size())
+	if _, err := fd.ReadAt(b, 0); err != nil && err != io.EOF {
+		fd.Close()
+		return nil, err
+	}
+	switch {
+	case len(b) < fmHeader:
+		m.stale = true // missing or empty
+	case int(binary.LittleEndian.Uint64(b[0:8])) != pages:
+		m.stale = true // data file has been resized without us
+	case b[8] != fmClean:
+		m.stale = true // not closed cleanly
+	case len(b) != fmHeader+len(m.bits)*8:
+		m.stale = true // truncated
+	default:
+		for i := range m.bits {
+			m.bits[i] = binary.LittleEndian.Uint64(b[fmHeader+i*8:])
+		}
+	}
+	// mark the map dirty on disk until it is closed; that way a crash
+	// will leave it stale and it will be rebuilt on the next open
+	if err := m.mark(fmDirty); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// number of 64 bit words needed to hold n bits
+func words(n int) int {
+	return (n + 63) / 64
+}
+
+// write the page count and state flag to the header
+func (m *freemap) mark(state byte) error {
+	var hdr [fmHeader]byte
+	binary.LittleEndian.PutUint64(hdr[0:8], uint64(m.pages))
+	hdr[8] = state
+	_, err := m.file.WriteAt(hdr[:], 0)
+	return err
+}
+
+// reset clears every bit, used when rebuilding a stale map
+func (m *freemap) reset() {
+	for i := range m.bits {
+		m.bits[i] = 0
+	}
+	m.hint = 0
+	m.stale = false
+}
+
+// used returns true if page k is in use
+func (m *freemap) used(k int) bool {
+	return m.bits[k/64]&(1<<uint(k%64)) != 0
+}
+
+// set marks page k as in use
+func (m *freemap) set(k int) {
+	m.bits[k/64] |= 1 << uint(k%64)
+}
+
+// clear marks page k as free
+func (m *freemap) clear(k int) {
+	m.bits[k/64] &^= 1 << uint(k%64)
+	if k/64 < m.hint {
+		m.hint = k / 64
+	}
+}
+
+// alloc finds the first run of n contiguous free pages, marks them
+// as in use and returns the first page of the run. if there is no
+// such run it returns false and the caller must grow the data file
+// (and the map) before trying again.
+func (m *freemap) alloc(n int) (int, bool) {
+	// first free page seen; the hint never moves past it, so it
+	// always points at or before the first free page in the map
+	first := -1
+	var run int
+	for k := m.hint * 64; k < m.pages; k++ {
+		// skip over full words quickly while not inside of a run
+		if run == 0 && k%64 == 0 && m.bits[k/64] == ^uint64(0) {
+			k += 63
+			continue
+		}
+		if m.used(k) {
+			run = 0
+			continue
+		}
+		if first < 0 {
+			first = k
+		}
+		if run++; run == n {
+			k -= n - 1
+			for i := k; i < k+n; i++ {
+				m.set(i)
+			}
+			m.hint = first / 64
+			return k, true
+		}
+	}
+	if first > -1 {
+		m.hint = first / 64
+	} else {
+		m.hint = len(m.bits)
+	}
+	return -1, false
+}
+
+// free marks n pages starting at page k as free
+func (m *freemap) free(k, n int) {
+	for i := k; i < k+n; i++ {
+		m.clear(i)
+	}
+}
+
+// grow extends the map to track n pages; new pages are free
+func (m *freemap) grow(n int) {
+	if n <= m.pages {
+		return
+	}
+	if w := words(n); w > len(m.bits) {
+		bits := make([]uint64, w)
+		copy(bits, m.bits)
+		m.bits = bits
+	}
+	if m.hint > m.pages/64 {
+		m.hint = m.pages / 64
+	}
+	m.pages = n
+}
+
+// shrink truncates the map to track only n pages
+func (m *freemap) shrink(n int) {
+	if n >= m.pages {
+		return
+	}
+	for k := n; k < m.pages; k++ {
+		m.clear(k)
+	}
+	m.bits = m.bits[:words(n)]
+	m.pages = n
+	if m.hint > len(m.bits) {
+		m.hint = len(m.bits)
+	}
+}
+
+// last returns the last page in use, or -1 if no page is in use
+func (m *freemap) last() int {
+	for w := len(m.bits) - 1; w >= 0; w-- {
+		if m.bits[w] == 0 {
+			continue
+		}
+		for b := 63; b >= 0; b-- {
+			if m.bits[w]&(1<<uint(b)) != 0 {
+				return w*64 + b
+			}
+		}
+	}
+	return -1
+}
+
+// flush writes the whole map to disk and marks it clean
+func (m *freemap) flush() error {
+	b := make([]byte, fmHeader+len(m.bits)*8)
+	binary.LittleEndian.PutUint64(b[0:8], uint64(m.pages))
+	b[8] = fmClean
+	for i, w := range m.bits {
+		binary.LittleEndian.PutUint64(b[fmHeader+i*8:], w)
+	}
+	if err := m.file.Truncate(int64(len(b))); err != nil {
+		return err
+	}
+	if _, err := m.file.WriteAt(b, 0); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+// close flushes the map and closes the underlying file
+func (m *freemap) close() error {
+	if err := m.flush(); err != nil {
+		return fmt.Errorf("freemap[close]: error flushing free map -> %s", err)
+	}
+	if err := m.file.Close(); err != nil {
+		return err
+	}
+	m.file = nil
+	return nil
+}
@@ -0,0 +1,169 @@
+package godb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// open a free map over pages pages, failing the test on error
+func openTestFreemap(t *testing.T, fs fsys, pages int) *freemap {
+	m, err := openFreemap(fs, "fm", pages)
+	if err != nil {
+		t.Fatalf("opening free map: %s\n", err)
+	}
+	return m
+}
+
+// test that pages are allocated from the first run long enough, and
+// are handed out again once freed, as the map grows and shrinks
+func Test_Freemap_Alloc(t *testing.T) {
+	fs := newMemFS()
+	m := openTestFreemap(t, fs, 200)
+	if !m.stale {
+		t.Fatalf("expected a new map to be stale\n")
+	}
+	m.reset()
+	for _, run := range []struct{ n, want int }{{3, 0}, {2, 3}, {100, 5}} {
+		if k, ok := m.alloc(run.n); !ok || k != run.want {
+			t.Fatalf("expected page %d, got: %d, %v\n", run.want, k, ok)
+		}
+	}
+	// a run too long for what is left
+	if _, ok := m.alloc(100); ok {
+		t.Fatalf("expected no run of 100 free pages\n")
+	}
+	// a freed run is used again, but only by what fits in it
+	m.free(3, 2)
+	if k, ok := m.alloc(3); !ok || k != 105 {
+		t.Fatalf("expected page 105, got: %d, %v\n", k, ok)
+	}
+	if k, ok := m.alloc(2); !ok || k != 3 {
+		t.Fatalf("expected page 3, got: %d, %v\n", k, ok)
+	}
+	// grown pages are free, and runs carry on across the old end
+	m.grow(300)
+	if k, ok := m.alloc(150); !ok || k != 108 {
+		t.Fatalf("expected page 108, got: %d, %v\n", k, ok)
+	}
+	if m.last() != 257 {
+		t.Fatalf("expected page 257 to be the last in use, got: %d\n", m.last())
+	}
+	// shrinking drops whatever was past the new end
+	m.shrink(120)
+	if m.pages != 120 || m.last() != 119 {
+		t.Fatalf("expected 120 pages with the last in use, got: %d, %d\n", m.pages, m.last())
+	}
+	if _, ok := m.alloc(1); ok {
+		t.Fatalf("expected no free page\n")
+	}
+	m.free(0, 120)
+	if m.last() != -1 {
+		t.Fatalf("expected no page in use, got: %d\n", m.last())
+	}
+	if k, ok := m.alloc(120); !ok || k != 0 {
+		t.Fatalf("expected page 0, got: %d, %v\n", k, ok)
+	}
+}
+
+// test that a map closed cleanly is read back as it was, and one that
+// wasn't, or doesn't track the same number of pages, is stale
+func Test_Freemap_Reopen(t *testing.T) {
+	fs := newMemFS()
+	m := openTestFreemap(t, fs, 200)
+	m.reset()
+	m.alloc(70)
+	m.free(10, 5)
+	bits := append([]uint64(nil), m.bits...)
+	if err := m.close(); err != nil {
+		t.Fatalf("closing: %s\n", err)
+	}
+	m = openTestFreemap(t, fs, 200)
+	if m.stale || !reflect.DeepEqual(m.bits, bits) {
+		t.Fatalf("expected the map to be read back as it was\n")
+	}
+	// never closed, as after a crash
+	m = openTestFreemap(t, fs, 200)
+	if !m.stale {
+		t.Fatalf("expected a map that wasn't closed to be stale\n")
+	}
+	m.close()
+	m = openTestFreemap(t, fs, 264)
+	if !m.stale {
+		t.Fatalf("expected a map of the wrong size to be stale\n")
+	}
+}
+
+// test that a free map that is missing, or stale after a crash, is
+// rebuilt from the data file, so no record is handed out again
+func Test_Freemap_Rebuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fm")
+	c := openTestCollection(t, path)
+	val := make([]byte, 3000)
+	var keys []int
+	for i := 0; i < 500; i++ {
+		c.Add(i, val)
+		keys = append(keys, i)
+	}
+	for i := 0; i < 500; i += 3 {
+		c.Del(i)
+	}
+	c.Close()
+	c = openTestCollection(t, path)
+	bits := append([]uint64(nil), c.st.idx.ngin.(*engine).free.bits...)
+	crashCollection(c)
+	// stale after a crash, and with nothing in use
+	b := make([]byte, fmHeader+len(bits)*8)
+	b[8] = fmDirty
+	if err := ioutil.WriteFile(path+".fm", b, 0666); err != nil {
+		t.Fatalf("writing free map: %s\n", err)
+	}
+	for _, missing := range []bool{false, true} {
+		if missing {
+			c.Close()
+			os.Remove(path + ".fm")
+		}
+		c = openTestCollection(t, path)
+		if got := c.st.idx.ngin.(*engine).free.bits; !reflect.DeepEqual(got, bits) {
+			t.Fatalf("expected the rebuilt map to match the data file\n")
+		}
+		// new records go in free pages, not over the ones kept
+		for i := 500; i < 600; i++ {
+			c.Set(i, val)
+		}
+		for i := 0; i < 500; i++ {
+			if i%3 == 0 {
+				c.Set(i, val)
+			}
+		}
+		checkValues(t, c, append(keys, 500), len(val))
+		for i := 500; i < 600; i++ {
+			c.Del(i)
+		}
+		bits = append(bits[:0], c.st.idx.ngin.(*engine).free.bits...)
+	}
+	c.Close()
+}
+
+// test that a collection whose free map can't be opened lets go of its
+// data file, so it can be opened again once the problem is fixed
+func Test_Freemap_OpenFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fm")
+	c := openTestCollection(t, path)
+	c.Add(1, "a")
+	c.Close()
+	os.Remove(path + ".fm")
+	os.Mkdir(path+".fm", 0755)
+	if _, err := OpenCollection(path); err == nil {
+		t.Fatalf("expected opening to fail\n")
+	}
+	os.Remove(path + ".fm")
+	c = openTestCollection(t, path)
+	defer c.Close()
+	var s string
+	if err := c.Get(1, &s); err != nil || s != "a" {
+		t.Fatalf("expected %q, got: %q, %v\n", "a", s, err)
+	}
+}
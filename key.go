@@ -0,0 +1,159 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// key type tags; every encoded key starts with one of these, so keys
+// of different types never collide and sort grouped by their type
+const (
+	keyBool   byte = 0x01
+	keyInt    byte = 0x02 // any signed integer, stored as an int64
+	keyUint   byte = 0x03 // any unsigned integer, stored as a uint64
+	keyFloat  byte = 0x04 // any float, stored as a float64
+	keyString byte = 0x05
+	keyBytes  byte = 0x06
+	keyRaw    byte = 0x07 // anything else binary.Write can encode
+)
+
+const signBit = 1 << 63
+
+// encodeKey writes k to buf so that comparing the bytes of two
+// encoded keys of the same type gives the natural order of the
+// values they came from. the btree compares keys byte by byte, so
+// this is what makes iteration and range scans come out in order.
+//
+//	bool    tag + 0x00 or 0x01
+//	int     tag + big endian int64 with the sign bit flipped, so
+//	        negative numbers sort before positive ones
+//	uint    tag + big endian uint64
+//	float   tag + big endian float64 bits; positive numbers have
+//	        the sign bit flipped and negative numbers have every
+//	        bit flipped, so they sort below zero in reverse
+//	string  tag + the bytes of the string, unpadded, so shorter
+//	        strings sort before longer ones sharing their prefix
+//	[]byte  same as a string
+//	other   tag + whatever binary.Write produces for it
+func encodeKey(buf *bytes.Buffer, k interface{}) error {
+	switch v := k.(type) {
+	case bool:
+		buf.WriteByte(keyBool)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case int:
+		encodeInt(buf, int64(v))
+	case int8:
+		encodeInt(buf, int64(v))
+	case int16:
+		encodeInt(buf, int64(v))
+	case int32:
+		encodeInt(buf, int64(v))
+	case int64:
+		encodeInt(buf, v)
+	case uint:
+		encodeUint(buf, uint64(v))
+	case uint8:
+		encodeUint(buf, uint64(v))
+	case uint16:
+		encodeUint(buf, uint64(v))
+	case uint32:
+		encodeUint(buf, uint64(v))
+	case uint64:
+		encodeUint(buf, v)
+	case float32:
+		encodeFloat(buf, float64(v))
+	case float64:
+		encodeFloat(buf, v)
+	case string:
+		buf.WriteByte(keyString)
+		buf.WriteString(v)
+	case []byte:
+		buf.WriteByte(keyBytes)
+		buf.Write(v)
+	default:
+		buf.WriteByte(keyRaw)
+		return binary.Write(buf, binary.BigEndian, k)
+	}
+	return nil
+}
+
+func encodeInt(buf *bytes.Buffer, n int64) {
+	encodeUint64(buf, keyInt, uint64(n)^signBit)
+}
+
+func encodeUint(buf *bytes.Buffer, n uint64) {
+	encodeUint64(buf, keyUint, n)
+}
+
+func encodeFloat(buf *bytes.Buffer, f float64) {
+	bits := math.Float64bits(f)
+	if bits&signBit != 0 {
+		bits = ^bits
+	} else {
+		bits ^= signBit
+	}
+	encodeUint64(buf, keyFloat, bits)
+}
+
+// write a type tag followed by n in big endian order
+func encodeUint64(buf *bytes.Buffer, tag byte, n uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	buf.WriteByte(tag)
+	buf.Write(b[:])
+}
+
+// DecodeKey turns a key, as it is encoded in a collection's index and
+// data file, back into the go value it was encoded from. integers
+// come back as an int64 or uint64 and floats as a float64, whatever
+// size they were stored from; keys of any other type come back as the
+// raw bytes binary.Write produced for them.
+func DecodeKey(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("key[decode]: empty key")
+	}
+	tag, v := b[0], b[1:]
+	switch tag {
+	case keyBool:
+		if len(v) != 1 {
+			break
+		}
+		return v[0] == 1, nil
+	case keyInt:
+		if len(v) != 8 {
+			break
+		}
+		return int64(binary.BigEndian.Uint64(v) ^ signBit), nil
+	case keyUint:
+		if len(v) != 8 {
+			break
+		}
+		return binary.BigEndian.Uint64(v), nil
+	case keyFloat:
+		if len(v) != 8 {
+			break
+		}
+		bits := binary.BigEndian.Uint64(v)
+		if bits&signBit != 0 {
+			bits ^= signBit
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), nil
+	case keyString:
+		return string(v), nil
+	case keyBytes, keyRaw:
+		p := make([]byte, len(v))
+		copy(p, v)
+		return p, nil
+	default:
+		return nil, fmt.Errorf("key[decode]: unknown key type 0x%.2x", tag)
+	}
+	return nil, fmt.Errorf("key[decode]: bad length %d for key type 0x%.2x", len(v), tag)
+}
@@ -0,0 +1,118 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// encode a key, failing the test on error
+func testKey(t *testing.T, k interface{}) []byte {
+	buf := new(bytes.Buffer)
+	if err := encodeKey(buf, k); err != nil {
+		t.Fatalf("encoding %v: %s\n", k, err)
+	}
+	return buf.Bytes()
+}
+
+// test that encoded keys sort in the natural order of their values
+func Test_Key_Order(t *testing.T) {
+	sets := [][]interface{}{
+		{math.MinInt64, -1000, -1, 0, 1, 255, 256, math.MaxInt64},
+		{uint(0), uint(1), uint(256), uint(math.MaxUint64)},
+		{math.Inf(-1), -1e10, -1.5, -0.5, 0.0, 0.5, 1.5, 1e10, math.Inf(1)},
+		{"", "a", "aa", "ab", "b", "ba", "zzzzzzzzzzzzzzzzzzzzzzzzzzzzzz"},
+	}
+	for _, set := range sets {
+		for i := 1; i < len(set); i++ {
+			a, b := testKey(t, set[i-1]), testKey(t, set[i])
+			if bytes.Compare(a, b) != -1 {
+				t.Fatalf("expected %v < %v, got: %x >= %x\n", set[i-1], set[i], a, b)
+			}
+		}
+	}
+}
+
+// test that keys decode back to the values they were encoded from
+func Test_Key_Decode(t *testing.T) {
+	keys := map[interface{}]interface{}{
+		-42:            int64(-42),
+		int8(-3):       int64(-3),
+		uint16(7):      uint64(7),
+		float32(-2.5):  float64(-2.5),
+		3.25:           float64(3.25),
+		"hello, world": "hello, world",
+		true:           true,
+	}
+	for k, want := range keys {
+		got, err := DecodeKey(testKey(t, k))
+		if err != nil {
+			t.Fatalf("decoding %v: %s\n", k, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v (%T), got: %v (%T)\n", want, want, got, got)
+		}
+	}
+	if got, _ := DecodeKey(testKey(t, []byte("raw"))); !bytes.Equal(got.([]byte), []byte("raw")) {
+		t.Fatalf("expected raw, got: %v\n", got)
+	}
+}
+
+// a string key of n bytes, all but the last few the same
+func longKey(n, i int) string {
+	s := fmt.Sprintf("%04d", i)
+	return strings.Repeat("k", n-len(s)) + s
+}
+
+// test that keys of up to maxKey bytes, encoded, round-trip, that a
+// longer one is refused with ErrKeySize, and that long keys sharing
+// all but their last few bytes are kept apart, and in order
+func Test_Key_Long(t *testing.T) {
+	c := openTestCollection(t, "key", WithBackend(Memory))
+	defer c.Close()
+	// the longest string that still fits, once encoded
+	n := maxKey - len(testKey(t, ""))
+	for len(testKey(t, longKey(n, 0))) > maxKey {
+		n--
+	}
+	if len(testKey(t, longKey(n, 0))) != maxKey {
+		t.Fatalf("expected a key of %d bytes, got: %d\n", maxKey, len(testKey(t, longKey(n, 0))))
+	}
+	if err := c.Set(longKey(n+1, 0), 1); err != ErrKeySize {
+		t.Fatalf("expected ErrKeySize setting, got: %v\n", err)
+	}
+	var v int
+	if err := c.Get(longKey(n+1, 0), &v); err != ErrKeySize {
+		t.Fatalf("expected ErrKeySize getting, got: %v\n", err)
+	}
+	// enough to split the leaves a good many times
+	const count = 1000
+	for i := count - 1; i >= 0; i-- {
+		if err := c.Set(longKey(n, i), i); err != nil {
+			t.Fatalf("setting %d: %s\n", i, err)
+		}
+	}
+	if c.Count() != count {
+		t.Fatalf("expected %d records, got: %d\n", count, c.Count())
+	}
+	for i := 0; i < count; i++ {
+		if err := c.Get(longKey(n, i), &v); err != nil || v != i {
+			t.Fatalf("expected %d, got: %d, %v\n", i, v, err)
+		}
+	}
+	cur := c.Cursor()
+	defer cur.Close()
+	for i := 0; cur.Next(); i++ {
+		if cur.Key() != longKey(n, i) {
+			t.Fatalf("expected key %d, got: %.10s...\n", i, cur.Key())
+		}
+	}
+	// and a shorter key that is a prefix of them all sorts first
+	c.Set(longKey(n, 0)[:n-4], -1)
+	if !cur.First() || cur.Key() != longKey(n, 0)[:n-4] {
+		t.Fatalf("expected the prefix first, got: %.10s...\n", cur.Key())
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"unsafe"
 )
 
 // database btree node interface
@@ -12,24 +11,29 @@ type dbBTreeNode interface {
 	hasKey(k []byte) int // returns index of matching key if it exists, otherwise -1
 }
 
-// node represents a btree's node of order M.
-// if M is 128 a node will occupy 4096 bytes.
-// to ensure that a node has only 4096 bytes,
-// a fixed sized key of 24 bytes must be used
+// node represents a btree's node of order M. nodes are stored
+// in pages of the index file and refer to each other by page
+// number. in a leaf node the ptrs hold the block position of
+// each key's record in the data file, and the last ptr holds
+// the page of the next leaf; in an inner node the ptrs hold
+// the pages of its children. a ptr of 0 refers to no node,
+// since page 0 of the index file holds the tree's meta data.
 type node struct {
-	numk int
-	keys [M - 1][]byte
-	ptrs [M]unsafe.Pointer
-	rent *node
-	leaf bool
+	id    int // page of this node in the index file
+	numk  int
+	keys  [M - 1][]byte
+	ptrs  [M]int
+	rent  int // page of the parent node
+	leaf  bool
+	dirty bool // node has changed since it was last written
 }
 
 func (n *node) String() string {
 	var s string
-	s = fmt.Sprintf("{\n\tnumk: %d\n\tleaf: %v\n\tkeys:\n\t\t", n.numk, n.leaf)
+	s = fmt.Sprintf("{\n\tid: %d\n\tnumk: %d\n\tleaf: %v\n\tkeys:\n\t\t", n.id, n.numk, n.leaf)
 	for _, k := range n.keys {
-		if k == nil {
-			s += "[ nil ] "
+		if len(k) < 8 {
+			s += fmt.Sprintf("[%x] ", k)
 		} else {
 			n := binary.BigEndian.Uint64(k[len(k)-8:])
 			s += fmt.Sprintf("[%.5d] ", n)
@@ -37,24 +41,73 @@ func (n *node) String() string {
 	}
 	s += "\n\tptrs:\n\t\t"
 	for _, p := range n.ptrs {
-		if p == nil {
-			s += "< nil > "
-		} else {
-			blk := (*block)(unsafe.Pointer(p))
-			s += fmt.Sprintf("<%.5d> ", blk.pos)
-		}
+		s += fmt.Sprintf("<%.5d> ", p)
 	}
 	return s + "\n}\n"
 }
 
-// create and return a new index node
-func newNode() *node {
-	return &node{}
+// encoded node layout:
+// leaf (1) + numk (2) + rent (8) + size (4) + M ptrs (8 each) + numk keys (2 + len each)
+const nodeHdr = 15
+
+// encode the node into the bytes of its page
+func (n *node) encode() []byte {
+	size := nodeHdr + M*8
+	for i := 0; i < n.numk; i++ {
+		size += 2 + len(n.keys[i])
+	}
+	b := make([]byte, nodeHdr+M*8, size)
+	if n.leaf {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint16(b[1:3], uint16(n.numk))
+	binary.BigEndian.PutUint64(b[3:11], uint64(n.rent))
+	for i, p := range n.ptrs {
+		binary.BigEndian.PutUint64(b[nodeHdr+i*8:], uint64(p))
+	}
+	var sz [2]byte
+	for i := 0; i < n.numk; i++ {
+		binary.BigEndian.PutUint16(sz[:], uint16(len(n.keys[i])))
+		b = append(b, sz[:]...)
+		b = append(b, n.keys[i]...)
+	}
+	binary.BigEndian.PutUint32(b[11:15], uint32(len(b)))
+	return b
 }
 
-// create and return a new leaf node
-func newLeaf() *node {
-	return &node{leaf: true}
+// return the encoded size of a node from the start of its page
+func nodeLen(b []byte) int {
+	return int(binary.BigEndian.Uint32(b[11:15]))
+}
+
+// decode a node from the bytes of its page
+func decodeNode(id int, b []byte) (*node, error) {
+	o := nodeHdr + M*8
+	if len(b) < o {
+		return nil, fmt.Errorf("node: short node (%d bytes)", len(b))
+	}
+	n := &node{id: id, leaf: b[0] == 1}
+	n.numk = int(binary.BigEndian.Uint16(b[1:3]))
+	if n.numk > M-1 {
+		return nil, fmt.Errorf("node: bad key count %d", n.numk)
+	}
+	n.rent = int(binary.BigEndian.Uint64(b[3:11]))
+	for i := range n.ptrs {
+		n.ptrs[i] = int(binary.BigEndian.Uint64(b[nodeHdr+i*8:]))
+	}
+	for i := 0; i < n.numk; i++ {
+		if o+2 > len(b) {
+			return nil, fmt.Errorf("node: short key %d", i)
+		}
+		sz := int(binary.BigEndian.Uint16(b[o : o+2]))
+		if o+2+sz > len(b) {
+			return nil, fmt.Errorf("node: short key %d", i)
+		}
+		n.keys[i] = make([]byte, sz)
+		copy(n.keys[i], b[o+2:o+2+sz])
+		o += 2 + sz
+	}
+	return n, nil
 }
 
 // checks if a node contains a matching key and
@@ -69,17 +122,10 @@ func (n *node) hasKey(k []byte) int {
 	return -1
 }
 
-func (n *node) nextLeaf() *node {
-	// if node has neighbor, visit...
-	if n.leaf && n.ptrs[M-1] != nil {
-		return (*node)(unsafe.Pointer(n.ptrs[M-1]))
-	}
-	return nil
-}
-
-func (n *node) getBlock(i int) *block {
+// return the block position of the i'th record in a leaf
+func (n *node) getBlock(i int) (int, bool) {
 	if i >= n.numk {
-		return nil
+		return -1, false
 	}
-	return (*block)(unsafe.Pointer(n.ptrs[i]))
+	return n.ptrs[i], true
 }
@@ -0,0 +1,91 @@
+package godb
+
+import "time"
+
+// options used when opening a collection
+type options struct {
+	comp Compression // compression used for values written to the collection
+	key  []byte      // encryption key, or nil if the collection isn't encrypted
+
+	backend Backend       // kind of device the data file's pages are kept on
+	sync    SyncPolicy    // when mutations are synced to disk
+	reap    time.Duration // how often expired records are deleted, or 0 for never
+
+	readOnly bool // open for reading only, sharing the data file with other readers
+
+	// set up when the collection is opened
+	crypt *crypter // seals the collection's files, or nil if not encrypted
+	fs    fsys     // opens the files kept alongside the data file
+}
+
+// Option configures a collection when it is opened
+type Option func(*options)
+
+// WithCompression compresses values written to the collection using c.
+// values are decompressed transparently when they are read back.
+func WithCompression(c Compression) Option {
+	return func(o *options) {
+		o.comp = c
+	}
+}
+
+// WithEncryption encrypts the collection at rest using AES-GCM with
+// the given 16, 24 or 32 byte key (for AES-128, AES-192 or AES-256).
+// a new collection is encrypted when it is created; an existing one
+// must always be opened with the key it was encrypted with. use
+// RotateKey to change the key of a collection.
+func WithEncryption(key []byte) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// ReadOnly opens the collection for reading only. Add, Set and Del
+// return ErrReadOnly. the data file is locked shared rather than
+// exclusively, so any number of read-only openers can have it open
+// at once, but not while it is open for writing. files are mapped
+// read-only and nothing is ever created, grown or written to; if
+// the index was not closed cleanly it is rebuilt in memory only.
+func ReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithBackend keeps the pages of the data file on the given kind of
+// device. the default is Mmap. a Memory collection keeps nothing on
+// disk, so it is empty every time it is opened.
+func WithBackend(b Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
+// WithSync sets when mutations made to the collection are synced to
+// disk. the default is SyncAlways.
+func WithSync(p SyncPolicy) Option {
+	return func(o *options) {
+		o.sync = p
+	}
+}
+
+// WithReapInterval sets how often expired records (see SetWithTTL)
+// are looked for and deleted in the background. the default is once
+// a minute; zero turns it off. the reaper is only started once a
+// record has been given an expiry, so a collection that never uses
+// SetWithTTL doesn't run one. expired records are treated as missing
+// whether or not they have been deleted yet.
+func WithReapInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.reap = d
+	}
+}
+
+// apply opts over the default options
+func newOptions(opts []Option) *options {
+	o := &options{comp: NoCompression, backend: Mmap, sync: SyncAlways, reap: reapInterval}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
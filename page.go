@@ -0,0 +1,58 @@
+package godb
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// ErrBadToken is returned when a page is asked for with a continuation
+// token that was not handed out by AllPage or QueryPage
+var ErrBadToken = errors.New("page: invalid continuation token")
+
+// Page picks out one page of the records returned by AllPage or
+// QueryPage. records come back in key order, so a page carries on
+// from the record after the one the last page ended with.
+type Page struct {
+	Limit int    // most records on the page, or 0 for every record left
+	Skip  int    // records to skip over before the first one on the page
+	Token string // continuation token from the last page, or "" to start at the first record
+}
+
+// token for a page carrying on after key
+func pageToken(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// the key the page carries on after, or nil to start at the first record
+func (p *Page) after() ([]byte, error) {
+	if p.Token == "" {
+		return nil, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(p.Token)
+	if err != nil || len(key) == 0 || len(key) > maxKey {
+		return nil, ErrBadToken
+	}
+	return key, nil
+}
+
+// AllPage appends a page of the records in the collection to the
+// slice ptr points to, and returns the continuation token for the
+// next page. the token is "" once the last page has been returned,
+// but a full page may be followed by an empty one. the page carries
+// on from where the token left off, so records added or deleted
+// between pages don't shift the pages after them.
+func (c *Collection) AllPage(ptr interface{}, p Page) (string, error) {
+	c.RLock()
+	next, err := c.st.all(ptr, &p)
+	c.RUnlock()
+	return next, logger(err)
+}
+
+// QueryPage is the same as AllPage, but only for the records matching
+// qry, as in Query. Skip and Limit count matching records only.
+func (c *Collection) QueryPage(qry string, ptr interface{}, p Page) (string, error) {
+	c.RLock()
+	next, err := c.st.query(qry, ptr, &p)
+	c.RUnlock()
+	return next, logger(err)
+}
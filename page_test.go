@@ -0,0 +1,90 @@
+package godb
+
+import (
+	"strings"
+	"testing"
+)
+
+type pageDoc struct {
+	ID  int  `msgpack:"id"`
+	Odd bool `msgpack:"odd"`
+}
+
+// open a collection in memory holding n pageDocs
+func openTestPages(t *testing.T, n int) *Collection {
+	c := openTestCollection(t, "page", WithBackend(Memory), WithReapInterval(0))
+	for i := 0; i < n; i++ {
+		c.Set(i, pageDoc{i, i%2 == 1})
+	}
+	return c
+}
+
+// test that paging through a collection returns every record once, in
+// order, even when records are deleted between pages
+func Test_Page_All(t *testing.T) {
+	c := openTestPages(t, 237)
+	defer c.Close()
+	var all []pageDoc
+	tok, pages := "", 0
+	for {
+		var pg []pageDoc
+		next, err := c.AllPage(&pg, Page{Limit: 50, Token: tok})
+		if err != nil {
+			t.Fatalf("paging: %s\n", err)
+		}
+		if len(pg) > 50 {
+			t.Fatalf("expected at most 50 records, got: %d\n", len(pg))
+		}
+		pages++
+		all = append(all, pg...)
+		if next == "" {
+			break
+		}
+		// deleting a record already returned doesn't shift the pages
+		if pages == 1 {
+			c.Del(10)
+		}
+		tok = next
+	}
+	if len(all) != 237 || pages != 5 {
+		t.Fatalf("expected 237 records on 5 pages, got: %d on %d\n", len(all), pages)
+	}
+	for i, d := range all {
+		if d.ID != i {
+			t.Fatalf("expected record %d, got: %d\n", i, d.ID)
+		}
+	}
+}
+
+// test that skip and limit count only the records a query matches
+func Test_Page_Query(t *testing.T) {
+	c := openTestPages(t, 237)
+	defer c.Close()
+	var q []pageDoc
+	next, err := c.QueryPage("odd == true", &q, Page{Limit: 10, Skip: 5})
+	if err != nil || len(q) != 10 || q[0].ID != 11 || next == "" {
+		t.Fatalf("expected 10 records from 11, got: %v, %v\n", q, err)
+	}
+	q = nil
+	if _, err := c.QueryPage("odd == true", &q, Page{Limit: 10, Token: next}); err != nil || len(q) != 10 || q[0].ID != 31 {
+		t.Fatalf("expected 10 records from 31, got: %v, %v\n", q, err)
+	}
+	q = nil
+	next, err = c.QueryPage("odd == true", &q, Page{Skip: 100})
+	if err != nil || len(q) != 18 || next != "" {
+		t.Fatalf("expected the last 18 records and no token, got: %d, %q, %v\n", len(q), next, err)
+	}
+}
+
+// test that a token that wasn't handed out is refused
+func Test_Page_BadToken(t *testing.T) {
+	c := openTestPages(t, 10)
+	defer c.Close()
+	var pg []pageDoc
+	// not base64, and too long to be a key
+	for _, tok := range []string{"!!", strings.Repeat("A", 2000)} {
+		if _, err := c.AllPage(&pg, Page{Token: tok}); err != ErrBadToken {
+			t.Fatalf("expected ErrBadToken for a %d byte token, got: %v\n", len(tok), err)
+		}
+	}
+}
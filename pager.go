@@ -0,0 +1,329 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	nodeHead  = 4 * KB // bytes read from a node page before its size is known
+	nodeCache = 4096   // number of decoded nodes to hold in memory
+
+	metaMagic   = "godb.idx" // identifies an index file
+	metaVersion = 2          // current index file format version
+)
+
+// size of a single node page in the index file; large enough to hold
+// a full node of maximum length keys, rounded up to a whole page. a
+// node only writes the bytes it uses, so the rest of its page is
+// left as a hole in the file and takes up no room on disk.
+var nodeSize = ((nodeHdr + M*8 + (M-1)*(2+maxKey)) + nodeHead - 1) &^ (nodeHead - 1)
+
+// pager stores the nodes of a btree in pages of an index file
+// kept alongside the data file (path + `.idx`). page 0 holds
+// the meta data for the tree (the root page, the record count
+// and the free page list) and every other page holds a single
+// node. nodes refer to each other by page number, and decoded
+// nodes are kept in a bounded cache so the index can be larger
+// than memory. like the free map, the index is marked dirty on
+// disk while it is open; if it was not closed cleanly it is
+// stale and must be rebuilt from the data file.
+type pager struct {
+	file  file          // underlying index file
+	root  int           // page of the root node
+	count int           // number of records in the tree
+	free  int           // head of the free page list
+	next  int           // next never used page
+	stale bool          // set when the index on disk could not be trusted
+	busy  bool          // set while a write is in progress; nothing is evicted
+	cache map[int]*node // decoded nodes, keyed by page
+	mu    sync.Mutex    // guards cache against concurrent readers
+	crypt *crypter      // seals nodes if the data file is encrypted, otherwise nil
+	ro    bool          // opened read-only; nothing is written to the index file
+}
+
+// open (or create) the index file for the data file at path. if
+// the collection is encrypted the nodes in the index are sealed;
+// each one is then stored behind a 4 byte length rather than as it
+// is. if it is read-only the index is only opened for reading; if it
+// is missing or stale it is rebuilt in memory, and every node is kept
+// in the cache.
+func openPager(path string, o *options) (*pager, error) {
+	c, ro := o.crypt, o.readOnly
+	flag := os.O_RDWR | os.O_CREATE
+	if ro {
+		flag = os.O_RDONLY
+	}
+	fd, err := o.fs.openFile(path+`.idx`, flag)
+	if err != nil && !(ro && os.IsNotExist(err)) {
+		return nil, err
+	}
+	p := &pager{
+		file:  fd,
+		next:  1,
+		cache: make(map[int]*node),
+		crypt: c,
+		ro:    ro,
+	}
+	meta := make([]byte, 42)
+	if fd == nil {
+		p.stale = true
+	} else if _, err := fd.ReadAt(meta, 0); err != nil || string(meta[0:8]) != metaMagic || meta[40] != fmClean || meta[41] != metaVersion {
+		// missing, short, foreign, not closed cleanly or an older format
+		p.stale = true
+	} else {
+		p.root = int(binary.BigEndian.Uint64(meta[8:16]))
+		p.count = int(binary.BigEndian.Uint64(meta[16:24]))
+		p.free = int(binary.BigEndian.Uint64(meta[24:32]))
+		p.next = int(binary.BigEndian.Uint64(meta[32:40]))
+	}
+	if ro {
+		return p, nil
+	}
+	// mark the index dirty on disk until it is closed
+	if err := p.writeMeta(fmDirty); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// write the meta page with the given state flag
+func (p *pager) writeMeta(state byte) error {
+	meta := make([]byte, 42)
+	copy(meta[0:8], metaMagic)
+	binary.BigEndian.PutUint64(meta[8:16], uint64(p.root))
+	binary.BigEndian.PutUint64(meta[16:24], uint64(p.count))
+	binary.BigEndian.PutUint64(meta[24:32], uint64(p.free))
+	binary.BigEndian.PutUint64(meta[32:40], uint64(p.next))
+	meta[40] = state
+	meta[41] = metaVersion
+	_, err := p.file.WriteAt(meta, 0)
+	return err
+}
+
+// reset throws away every node, used when rebuilding a stale index
+func (p *pager) reset() error {
+	p.root, p.count, p.free, p.next = 0, 0, 0, 1
+	p.cache = make(map[int]*node)
+	p.stale, p.busy = false, false
+	if p.ro {
+		return nil
+	}
+	return p.file.Truncate(int64(nodeSize))
+}
+
+// indexError is raised by the pager, as a panic, when a node page
+// can't be read back from the index file. the tree walks its nodes in
+// far too many places to hand an error back from each one, so instead
+// every method of the tree that walks it on behalf of a caller outside
+// it recovers the panic (see btree.catch) and returns the error, and
+// the index is marked stale and rebuilt from the data file.
+type indexError struct {
+	id  int   // page that could not be read
+	err error // why
+}
+
+func (e *indexError) Error() string {
+	return fmt.Sprintf("pager: error reading node page %d -> %s", e.id, e.err)
+}
+
+// get returns the node stored at page id, decoding it if it
+// isn't already cached. returns nil for page 0 (no node).
+func (p *pager) get(id int) *node {
+	if id == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n, ok := p.cache[id]; ok {
+		return n
+	}
+	n, err := p.read(id)
+	if err != nil {
+		panic(&indexError{id, err})
+	}
+	if len(p.cache) >= nodeCache && !p.busy {
+		p.evict()
+	}
+	p.cache[id] = n
+	return n
+}
+
+// read and decode the node stored at page id
+func (p *pager) read(id int) (*node, error) {
+	if id < 0 || id >= p.next {
+		return nil, fmt.Errorf("page is out of range (%d pages)", p.next)
+	}
+	// read the start of the page, and the rest of the node if it is
+	// larger than that. the last page in the file may be short, since
+	// only the used part of a node is written, so hitting the end of
+	// the file is just fine.
+	b := make([]byte, nodeHead)
+	if _, err := p.file.ReadAt(b, int64(id*nodeSize)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	sz := nodeLen(b)
+	if p.crypt != nil {
+		sz = 4 + int(binary.BigEndian.Uint32(b[0:4]))
+	}
+	if sz < nodeHdr || sz > nodeSize {
+		return nil, fmt.Errorf("bad node length %d", sz)
+	}
+	if sz > nodeHead {
+		b = append(b, make([]byte, sz-nodeHead)...)
+		if _, err := p.file.ReadAt(b[nodeHead:], int64(id*nodeSize+nodeHead)); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	b = b[:sz]
+	if p.crypt != nil {
+		var err error
+		if b, err = p.crypt.open(sealNode, id, b[4:]); err != nil {
+			return nil, err
+		}
+	}
+	return decodeNode(id, b)
+}
+
+// alloc returns a new, empty node at an unused page
+func (p *pager) alloc(leaf bool) *node {
+	id := p.free
+	if id != 0 {
+		// re-use a freed page; it holds the next free page
+		b := make([]byte, 8)
+		next := -1
+		if _, err := p.file.ReadAt(b, int64(id*nodeSize)); err == nil {
+			next = int(binary.BigEndian.Uint64(b))
+		}
+		if next < 0 || next >= p.next {
+			// the free list can't be followed any further, so let go
+			// of it and use a new page; the rest of it is never reused
+			logger(fmt.Errorf("pager[alloc]: bad free page %d, dropping the free list", id))
+			id, next = 0, 0
+		}
+		p.free = next
+	}
+	if id == 0 {
+		id = p.next
+		p.next++
+	}
+	n := &node{id: id, leaf: leaf, dirty: true}
+	p.mu.Lock()
+	p.cache[id] = n
+	p.mu.Unlock()
+	return n
+}
+
+// release puts the page of a node that is no longer used on the free list
+func (p *pager) release(n *node) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(p.free))
+	if _, err := p.file.WriteAt(b, int64(n.id*nodeSize)); err != nil {
+		// the page is just never reused
+		logger(fmt.Errorf("pager[release]: error writing free page %d -> %s", n.id, err))
+	} else {
+		p.free = n.id
+	}
+	p.mu.Lock()
+	delete(p.cache, n.id)
+	p.mu.Unlock()
+	n.dirty = false
+}
+
+// begin marks the start of a write; cached nodes are not evicted
+// until it is committed so every node touched by the write stays
+// the one and only copy of that node in memory
+func (p *pager) begin() {
+	p.mu.Lock()
+	p.busy = true
+	p.mu.Unlock()
+}
+
+// commit writes every dirty node to the index file
+func (p *pager) commit() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busy = false
+	if p.ro {
+		// nodes stay dirty, so they are never evicted
+		return nil
+	}
+	for id, n := range p.cache {
+		if !n.dirty {
+			continue
+		}
+		if _, err := p.file.WriteAt(p.encode(n), int64(id*nodeSize)); err != nil {
+			return fmt.Errorf("pager[commit]: error writing node page %d -> %s", id, err)
+		}
+		n.dirty = false
+	}
+	if len(p.cache) > nodeCache {
+		p.evict()
+	}
+	return p.writeMeta(fmDirty)
+}
+
+// sync flushes the index file to disk
+func (p *pager) sync() error {
+	if p.ro {
+		return nil
+	}
+	return p.file.Sync()
+}
+
+// encode a node for writing to its page, sealing it if need be
+func (p *pager) encode(n *node) []byte {
+	b := n.encode()
+	if p.crypt == nil {
+		return b
+	}
+	sealed := p.crypt.seal(sealNode, n.id, b)
+	b = make([]byte, 4+len(sealed))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(sealed)))
+	copy(b[4:], sealed)
+	return b
+}
+
+// evict drops every clean node other than the root from the cache
+func (p *pager) evict() {
+	for id, n := range p.cache {
+		if !n.dirty && id != p.root {
+			delete(p.cache, id)
+		}
+	}
+}
+
+// close commits any dirty nodes, marks the index clean and closes it
+func (p *pager) close() error {
+	if p.ro {
+		if p.file != nil {
+			if err := p.file.Close(); err != nil {
+				return err
+			}
+		}
+		p.file, p.cache = nil, nil
+		return nil
+	}
+	if err := p.commit(); err != nil {
+		return err
+	}
+	if err := p.writeMeta(fmClean); err != nil {
+		return fmt.Errorf("pager[close]: error writing meta page -> %s", err)
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	p.file, p.cache = nil, nil
+	return nil
+}
@@ -0,0 +1,146 @@
+package godb
+
+import (
+	"os"
+	"sync"
+)
+
+const (
+	devBlock = 4 * KB // size of the blocks cached by a fileDevice
+	devCache = 1024   // most blocks cached before the cache is flushed and dropped
+)
+
+// fileDevice reads and writes the data file with pread and pwrite,
+// keeping the blocks it has read or written in a small cache. dirty
+// blocks are written back when the cache fills up, and on sync and
+// close. as writes can't fail part way through for the engine, the
+// first error reading or writing the file is held on to and returned
+// by the next call to sync (or close).
+type fileDevice struct {
+	sync.Mutex
+	file  *os.File
+	sz    int
+	cache map[int][]byte // cached blocks, by block number
+	dirty map[int]bool   // cached blocks changed since they were read
+	err   error          // first error reading or writing the file
+}
+
+// create a device over the first size bytes of fd
+func newFileDevice(fd *os.File, size int) *fileDevice {
+	return &fileDevice{
+		file:  fd,
+		sz:    size,
+		cache: make(map[int][]byte),
+		dirty: make(map[int]bool),
+	}
+}
+
+func (d *fileDevice) size() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.sz
+}
+
+// return cached block i, reading it from the file if it isn't cached
+func (d *fileDevice) block(i int) []byte {
+	if b, ok := d.cache[i]; ok {
+		return b
+	}
+	if len(d.cache) >= devCache {
+		d.flush()
+		d.cache = make(map[int][]byte)
+	}
+	b := make([]byte, devBlock)
+	n := devBlock
+	if end := (i + 1) * devBlock; end > d.sz {
+		n -= end - d.sz
+	}
+	if n > 0 {
+		if _, err := d.file.ReadAt(b[:n], int64(i*devBlock)); err != nil && d.err == nil {
+			d.err = err
+		}
+	}
+	d.cache[i] = b
+	return b
+}
+
+func (d *fileDevice) slice(off, n int) []byte {
+	d.Lock()
+	defer d.Unlock()
+	if i := off / devBlock; (off+n-1)/devBlock == i {
+		// within a single block, so hand back the cached bytes
+		o := off - i*devBlock
+		return d.block(i)[o : o+n]
+	}
+	b := make([]byte, 0, n)
+	for len(b) < n {
+		i, o := (off+len(b))/devBlock, (off+len(b))%devBlock
+		m := devBlock - o
+		if m > n-len(b) {
+			m = n - len(b)
+		}
+		b = append(b, d.block(i)[o:o+m]...)
+	}
+	return b
+}
+
+func (d *fileDevice) write(off int, b []byte) {
+	d.Lock()
+	defer d.Unlock()
+	for len(b) > 0 {
+		i, o := off/devBlock, off%devBlock
+		n := copy(d.block(i)[o:], b)
+		d.dirty[i] = true
+		off += n
+		b = b[n:]
+	}
+}
+
+// write back every dirty block
+func (d *fileDevice) flush() {
+	for i := range d.dirty {
+		b := d.cache[i]
+		n := devBlock
+		if end := (i + 1) * devBlock; end > d.sz {
+			n -= end - d.sz
+		}
+		if n > 0 {
+			if _, err := d.file.WriteAt(b[:n], int64(i*devBlock)); err != nil && d.err == nil {
+				d.err = err
+			}
+		}
+	}
+	d.dirty = make(map[int]bool)
+}
+
+func (d *fileDevice) resize(size int) error {
+	d.Lock()
+	defer d.Unlock()
+	d.flush()
+	if err := d.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	// anything cached past the old end was read as zeros, and anything
+	// past the new end is gone, so start over with an empty cache
+	d.sz = size
+	d.cache = make(map[int][]byte)
+	return nil
+}
+
+func (d *fileDevice) sync() error {
+	d.Lock()
+	defer d.Unlock()
+	d.flush()
+	if d.err != nil {
+		err := d.err
+		d.err = nil
+		return err
+	}
+	return d.file.Sync()
+}
+
+func (d *fileDevice) close() error {
+	err := d.sync()
+	d.cache, d.dirty = nil, nil
+	return err
+}
@@ -0,0 +1,132 @@
+package godb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// open a file device over the file at path, creating it with size
+// bytes if it doesn't exist
+func openTestDevice(t *testing.T, path string, size int) *fileDevice {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("opening %s: %s\n", path, err)
+	}
+	info, _ := fd.Stat()
+	if info.Size() == 0 {
+		fd.Truncate(int64(size))
+		info, _ = fd.Stat()
+	}
+	return newFileDevice(fd, int(info.Size()))
+}
+
+// test that writes to a file device, including ones across blocks and
+// past what the cache holds, are read back, and are on disk once it's
+// closed
+func Test_Pread_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dev")
+	d := openTestDevice(t, path, 4*devBlock)
+	if d.size() != 4*devBlock {
+		t.Fatalf("expected %d bytes, got: %d\n", 4*devBlock, d.size())
+	}
+	// across the boundary of the first two blocks
+	b := bytes.Repeat([]byte("abcdefgh"), 128)
+	d.write(devBlock-100, b)
+	if got := d.slice(devBlock-100, len(b)); !bytes.Equal(got, b) {
+		t.Fatalf("expected the bytes written to be read back\n")
+	}
+	if !bytes.Equal(d.slice(0, 10), make([]byte, 10)) {
+		t.Fatalf("expected the bytes before the write to be zero\n")
+	}
+	if err := d.close(); err != nil {
+		t.Fatalf("closing: %s\n", err)
+	}
+	d.file.Close()
+	data, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(data[devBlock-100:devBlock-100+len(b)], b) {
+		t.Fatalf("expected the bytes written to be in the file\n")
+	}
+
+	// enough blocks that the cache is flushed and dropped part way
+	d = openTestDevice(t, path, 0)
+	defer d.file.Close()
+	n := 2 * devCache * devBlock
+	if err := d.resize(n); err != nil {
+		t.Fatalf("growing: %s\n", err)
+	}
+	for i := 0; i < n/devBlock; i++ {
+		d.write(i*devBlock, []byte{byte(i), byte(i >> 8)})
+	}
+	for i := 0; i < n/devBlock; i++ {
+		if got := d.slice(i*devBlock, 2); got[0] != byte(i) || got[1] != byte(i>>8) {
+			t.Fatalf("expected block %d to be read back, got: %v\n", i, got)
+		}
+	}
+	if err := d.sync(); err != nil {
+		t.Fatalf("syncing: %s\n", err)
+	}
+	if fi, _ := d.file.Stat(); fi.Size() != int64(n) {
+		t.Fatalf("expected a file of %d bytes, got: %d\n", n, fi.Size())
+	}
+}
+
+// test that growing a file device reads zeros past the old end, and
+// shrinking it drops what was past the new end
+func Test_Pread_Resize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dev")
+	d := openTestDevice(t, path, devBlock+10)
+	defer d.file.Close()
+	// the last block is only partly in the file
+	d.write(devBlock, bytes.Repeat([]byte{0xff}, 10))
+	if err := d.resize(3 * devBlock); err != nil {
+		t.Fatalf("growing: %s\n", err)
+	}
+	if got := d.slice(devBlock, 20); !bytes.Equal(got[:10], bytes.Repeat([]byte{0xff}, 10)) || !bytes.Equal(got[10:], make([]byte, 10)) {
+		t.Fatalf("expected the old bytes then zeros, got: %v\n", got)
+	}
+	d.write(2*devBlock, []byte("gone"))
+	if err := d.resize(2 * devBlock); err != nil {
+		t.Fatalf("shrinking: %s\n", err)
+	}
+	if err := d.resize(3 * devBlock); err != nil {
+		t.Fatalf("growing: %s\n", err)
+	}
+	if got := d.slice(2*devBlock, 4); !bytes.Equal(got, make([]byte, 4)) {
+		t.Fatalf("expected the bytes past the end to be dropped, got: %q\n", got)
+	}
+}
+
+// test that a collection on the pread backend keeps its records as it
+// grows, and reads the same once reopened, on either file backend
+func Test_Pread_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pread")
+	c := openTestCollection(t, path, WithBackend(Pread))
+	val := make([]byte, 3000)
+	var keys []int
+	for i := 0; i < 2000; i++ {
+		if err := c.Add(i, val); err != nil {
+			t.Fatalf("adding %d: %s\n", i, err)
+		}
+		keys = append(keys, i)
+	}
+	if e := c.st.idx.ngin.(*engine); e.dev.size() <= 2*MB {
+		t.Fatalf("expected the data file to grow past 2MB, got: %d\n", e.dev.size())
+	}
+	checkValues(t, c, keys, len(val))
+	if err := c.Close(); err != nil {
+		t.Fatalf("closing: %s\n", err)
+	}
+	for _, backend := range []Backend{Pread, Mmap} {
+		c = openTestCollection(t, path, WithBackend(backend))
+		if c.Count() != len(keys) {
+			t.Fatalf("expected %d records, got: %d\n", len(keys), c.Count())
+		}
+		checkValues(t, c, keys, len(val))
+		if err := c.Close(); err != nil {
+			t.Fatalf("closing: %s\n", err)
+		}
+	}
+}
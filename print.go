@@ -3,7 +3,6 @@ package godb
 import (
 	"fmt"
 	"strings"
-	"unsafe"
 )
 
 var queue *print = nil
@@ -19,11 +18,11 @@ func newPrint(n *node) *print {
 
 // utility function to give the length in edges
 // for the path from any node to the root
-func path_to_root(root, child *node) int {
+func (t *btree) path_to_root(root, child *node) int {
 	var length int
 	var c *node = child
-	for c != root {
-		c = c.rent
+	for c.id != root.id {
+		c = t.node(c.rent)
 		length++
 	}
 	return length
@@ -56,7 +55,7 @@ func dequeue() *print {
 }
 
 // prints the bottom row of keys of the tree
-func print_leaves(root *node) {
+func (t *btree) print_leaves(root *node) {
 	fmt.Println("Printing Leaves...")
 	var i int
 	var c *node = root
@@ -65,38 +64,23 @@ func print_leaves(root *node) {
 		return
 	}
 	for !c.leaf {
-		c = (*node)(unsafe.Pointer(c.ptrs[0]))
+		c = t.node(c.ptrs[0])
 	}
 	for {
-		/*
-			for i = 0; i < M-1; i++ {
-				if c.keys[i] == nil {
-					fmt.Printf("___, ")
-					continue
-				}
-				//fmt.Printf("%s, ", c.keys[i])
-				// extract record / value instead
-				rec := (*record)(unsafe.Pointer(c.ptrs[i]))
-				fmt.Printf("%s, ", rec.val)
-			}
-			if c.ptrs[M-1] != nil {
-				fmt.Printf(" | ")
-				c = (*node)(unsafe.Pointer(c.ptrs[M-1]))
-			} else {
-				break
-			}
-		*/
 		for i = 0; i < M-1; i++ {
-			if r := (*record)(unsafe.Pointer(c.ptrs[i])); r == nil {
+			if i >= c.numk {
 				fmt.Printf("___, ")
 				continue
+			}
+			if r, err := t.ngin.getRecord(c.ptrs[i]); err != nil {
+				fmt.Printf("___, ")
 			} else {
 				fmt.Printf("%s ", r.val())
 			}
 		}
-		if c.ptrs[M-1] != nil {
+		if c.ptrs[M-1] != 0 {
 			fmt.Printf(" || ")
-			c = (*node)(unsafe.Pointer(c.ptrs[M-1]))
+			c = t.node(c.ptrs[M-1])
 		} else {
 			break
 		}
@@ -105,7 +89,7 @@ func print_leaves(root *node) {
 }
 
 // print tree out
-func print_tree(root *node) {
+func (t *btree) print_tree(root *node) {
 	fmt.Println("Printing Tree...")
 	var i, rank, new_rank int
 	if root == nil {
@@ -116,8 +100,8 @@ func print_tree(root *node) {
 	enqueue(root)
 	for queue != nil {
 		prt := dequeue()
-		if prt.node.rent != nil && prt.node == (*node)(unsafe.Pointer(prt.node.rent.ptrs[0])) {
-			new_rank = path_to_root(root, prt.node)
+		if prt.node.rent != 0 && prt.node.id == t.node(prt.node.rent).ptrs[0] {
+			new_rank = t.path_to_root(root, prt.node)
 			if new_rank != rank {
 				rank = new_rank
 				fmt.Printf("\n")
@@ -128,7 +112,7 @@ func print_tree(root *node) {
 		}
 		if !prt.node.leaf {
 			for i = 0; i <= prt.node.numk; i++ {
-				enqueue((*node)(unsafe.Pointer(prt.node.ptrs[i])))
+				enqueue(t.node(prt.node.ptrs[i]))
 			}
 		}
 		fmt.Printf("| ")
@@ -137,9 +121,9 @@ func print_tree(root *node) {
 }
 
 func (t *btree) Print() {
-	print_tree(t.root)
+	t.print_tree(t.node(t.root))
 	//fmt.Println()
-	print_leaves(t.root)
+	t.print_leaves(t.node(t.root))
 }
 
 func (t *btree) PrintJSON() {
@@ -148,17 +132,18 @@ func (t *btree) PrintJSON() {
 
 func (t *btree) print_tree_json() string {
 	var i, rank, newRank int
-	if t.root == nil {
+	root := t.node(t.root)
+	if root == nil {
 		return "[]"
 	}
 	queue = nil
 	var btree string
-	enqueue(t.root)
+	enqueue(root)
 	btree = "[["
 	for queue != nil {
 		prt := dequeue()
-		if prt.node.rent != nil && prt.node == (*node)(unsafe.Pointer(prt.node.rent.ptrs[0])) {
-			newRank = path_to_root(t.root, prt.node)
+		if prt.node.rent != 0 && prt.node.id == t.node(prt.node.rent).ptrs[0] {
+			newRank = t.path_to_root(root, prt.node)
 			if newRank != rank {
 				rank = newRank
 				f := strings.LastIndex(btree, ",")
@@ -174,7 +159,7 @@ func (t *btree) print_tree_json() string {
 		btree += strings.Join(keys, ",")
 		if !prt.node.leaf {
 			for i = 0; i <= prt.node.numk; i++ {
-				enqueue((*node)(unsafe.Pointer(prt.node.ptrs[i])))
+				enqueue(t.node(prt.node.ptrs[i]))
 			}
 		}
 		btree += "],"
@@ -1,12 +1,16 @@
 package godb
 
-import "bytes"
+import (
+	"encoding/binary"
+	"time"
+)
 
 const eofVal byte = 0xC1 // not currently use in the msgpack spec, so we use it for our record data EOF
 
+const keyHdr = 19 // compression (1) + key length prefix (2) + expiry (8) + version (8)
+
 var (
-	maxKey = 24
-	maxVal = page - maxKey - 1 // (-1 is for EOF) 4071
+	maxKey = 1 * KB
 )
 
 // data record
@@ -15,29 +19,70 @@ type record struct {
 	// ==============================================================
 	// contains:
 	// ==============================================================
-	// a fixed length key, reserving a    24 byte section for the key
-	// a fixed length val, reserving a 4071+ byte section for the val
-	// a fixed length eof, reserving a     1 byte section for the eof
-	// =============================================================
-	// totaling: 4096+ bytes
+	// a fixed length compression flag, reserving a 1 byte section
+	// a fixed length key size, reserving a 2 byte section for it
+	// a fixed length expiry time, reserving an 8 byte section (0 if
+	// the record never expires, otherwise unix time in nanoseconds)
+	// a fixed length version, reserving an 8 byte section
+	// a variable length key, of up to 1KB
+	// a variable length val, using only as many bytes as it needs
+	// a fixed length eof, reserving a  1 byte section for the eof
 	// ==============================================================
+	// the engine stores it in as many contiguous pages as it needs
+	// ==============================================================
+}
+
+// create a pointer to a new record at version ver, expiring at exp
+// (or never, if exp is 0), compressing val using c
+func newRecord(key, val []byte, exp int64, ver uint64, c Compression) *record {
+	c, val = compress(c, val)
+	data := make([]byte, keyHdr+len(key)+len(val)+1)
+	data[0] = byte(c)
+	binary.BigEndian.PutUint16(data[1:3], uint16(len(key)))
+	binary.BigEndian.PutUint64(data[3:11], uint64(exp))
+	binary.BigEndian.PutUint64(data[11:keyHdr], ver)
+	copy(data[keyHdr:], key)
+	copy(data[keyHdr+len(key):], val)
+	data[len(data)-1] = eofVal
+	return &record{data}
+}
+
+// return the compression used for the val in the data record
+func (r *record) compression() Compression {
+	return Compression(r.data[0])
 }
 
-// create a pointer to a new record
-func newRecord(key, val []byte) (*record, error) {
-	return &record{append(key, append(val, eofVal)...)}
+// return length of the key in the data record
+func (r *record) keyLen() int {
+	return int(binary.BigEndian.Uint16(r.data[1:3]))
+}
+
+// return the expiry time of the data record, or 0 if it never expires
+func (r *record) expires() int64 {
+	return int64(binary.BigEndian.Uint64(r.data[3:11]))
+}
+
+// return the version of the data record
+func (r *record) version() uint64 {
+	return binary.BigEndian.Uint64(r.data[11:keyHdr])
+}
+
+// report whether a record expiring at exp has expired
+func expired(exp int64) bool {
+	return exp != 0 && exp <= time.Now().UnixNano()
 }
 
 // return key from data record
 func (r *record) key() []byte {
-	return r.data[:maxKey]
+	return r.data[keyHdr : keyHdr+r.keyLen()]
 }
 
-// return val from data record
+// return val from data record, as it is stored
 func (r *record) val() []byte {
-	if n := bytes.IndexByte(r.data[maxKey:], eofVal); n > -1 {
-		return r.data[maxKey : maxKey+n]
-	}
-	// should we return nil??
-	return r.data[maxKey:]
+	return r.data[keyHdr+r.keyLen() : len(r.data)-1]
+}
+
+// return val from data record, decompressed
+func (r *record) value() ([]byte, error) {
+	return decompress(r.compression(), r.val())
 }
@@ -5,154 +5,198 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/cagnosolutions/godb/msgpack"
 )
 
 type store struct {
-	//dsn string
 	idx *btree
-	//buf *bytes.Buffer
+	log *wal
+	ro  bool  // opened read-only; mutations are refused
+	err error // set once a transaction fails part way through being applied; reads and writes are then refused with it
 }
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
 //		OPEN A STORE		//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
-func openStore(path string) (*store, error) {
-	idx := &btree{ngin: new(engine)}
-	if err := idx.open(path); err != nil {
+func openStore(path string, o *options) (*store, error) {
+	if o.key != nil {
+		c, err := newCrypter(o.key)
+		if err != nil {
+			return nil, err
+		}
+		o.crypt = c
+	}
+	o.fs = osFS{}
+	if o.backend == Memory {
+		o.fs = newMemFS()
+	}
+	idx := &btree{ngin: newEngine(o), comp: o.comp}
+	if err := idx.open(path, o); err != nil {
 		return nil, err
 	}
-	return &store{idx}, nil
-	/*
-		st := &store{
-			dsn: path,
-			idx: idx,
-			buf: bytes.NewBuffer(make([]byte, maxKey, maxKey)),
+	log, err := openWAL(path, o)
+	if err != nil {
+		idx.close()
+		return nil, err
+	}
+	if o.readOnly {
+		// the log can't be replayed without writing to the data file
+		if log.size > 0 {
+			log.close()
+			idx.close()
+			return nil, ErrNeedsRecovery
 		}
-		st.buf.Reset()
-		return st, nil
-	*/
-}
-
-/*	=~=~=~=~=~=~=~=~=~=~=~=	//
-//		KEY GENERATOR		//
-//	=~=~=~=~=~=~=~=~=~=~=~=	*/
-/*
-func (s *store) genKey(k interface{}) ([]byte, error) {
-	switch k.(type) {
-	case string:
-		k = []byte(k.(string))
-	case int:
-		k = int64(k.(int))
-	case uint:
-		k = uint64(k.(uint))
-	}
-	if err := binary.Write(s.buf, binary.BigEndian, k); err != nil {
-		s.buf.Reset()
+		return &store{idx, log, true, nil}, nil
+	}
+	// replay anything left in the write-ahead log, then checkpoint
+	if err := log.replay(idx); err != nil {
+		log.close()
+		idx.close()
 		return nil, err
 	}
-	key := make([]byte, maxKey, maxKey)
-	if s.buf.Len() > maxKey {
-		s.buf.Truncate(maxKey)
+	if err := log.checkpoint(idx); err != nil {
+		log.close()
+		idx.close()
+		return nil, err
 	}
-	copy(key[maxKey-s.buf.Len():], s.buf.Bytes())
-	s.buf.Reset()
-	return key, nil
+	return &store{idx, log, false, nil}, nil
 }
-*/
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
 //		BOUNDS CHECKER		//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
-var ErrPageSize = errors.New("val too large for current page/block size")
+var ErrPageSize = errors.New("val too large for maximum record size")
+var ErrKeySize = errors.New("key too large for maximum key size")
+var ErrReadOnly = errors.New("store is open read-only")
+var ErrNeedsRecovery = errors.New("store was not closed cleanly; open it for writing once to recover it")
+var ErrVersionConflict = errors.New("record has been written since it was read (version conflict)")
 
-/*
-func verify(key, val []byte) error {
-	// key bounds check
-	if len(key) > maxKey {
-		return fmt.Errorf("store[verify]: key exceeds maximum key length of %d bytes, by %d bytes\n", maxKey, len(key)-maxKey)
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//			ADD				//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+func (s *store) add(key []byte, val []byte) (uint64, error) {
+	if s.ro {
+		return 0, ErrReadOnly
 	}
-	// val bounds check
-	if len(val) > maxVal {
-		//return fmt.Errorf("store[verify]: val exceeds maximum val length of %d bytes, by %d bytes\n", maxVal, len(val)-maxVal)
-		// trigger page/block grow
-		return ErrPageSize
+	if s.err != nil {
+		return 0, s.err
 	}
-	// passed bounds check, no errors so return nil
-	return nil
+	ok, err := s.idx.live(key)
+	if err != nil {
+		return 0, fmt.Errorf("store[add]: error while checking index -> %q", err)
+	}
+	if ok {
+		return 0, fmt.Errorf("store[add]: key already exists, not adding")
+	}
+	ver := s.idx.ngin.version() + 1
+	seq, err := s.log.log(walAdd, key, setEntryVal(ver, 0, val))
+	if err != nil {
+		return 0, fmt.Errorf("store[add]: error while writing to log -> %q", err)
+	}
+	// set rather than add, in case there is an expired record to replace
+	if err := s.idx.set(key, val, 0, ver); err != nil {
+		return 0, fmt.Errorf("store[add]: error while adding to index -> %q", err)
+	}
+	return seq, s.checkpoint()
 }
-*/
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
-//			ADD				//
+//			SET				//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
-func (s *store) add(key []byte, val []byte) error {
-	if err := s.idx.add(key, val); err != nil {
-		return fmt.Errorf("store[add]: error while adding to index -> %q", err)
+// the record expires at exp (unix time in nanoseconds), or never if
+// exp is 0
+func (s *store) set(key []byte, val []byte, exp int64) (uint64, error) {
+	if s.ro {
+		return 0, ErrReadOnly
 	}
-	return nil
+	if s.err != nil {
+		return 0, s.err
+	}
+	ver := s.idx.ngin.version() + 1
+	seq, err := s.log.log(walSet, key, setEntryVal(ver, exp, val))
+	if err != nil {
+		return 0, fmt.Errorf("store[set]: error while writing to log -> %q", err)
+	}
+	if err := s.idx.set(key, val, exp, ver); err != nil {
+		return 0, fmt.Errorf("store[set]: error while adding to index -> %q", err)
+	}
+	return seq, s.checkpoint()
 }
 
-/*
-func (s *store) add(key, val interface{}) error {
-	k, err := s.genKey(key)
-	if err != nil {
-		return fmt.Errorf("store[add]: error while generating key -> %q", err)
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//			UPDATE			//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+// get the val for key into ptr, call fn to change it, then set it
+// back, keeping the record's expiry. if fn returns an error, nothing
+// is set and the error is returned as it is.
+func (s *store) update(key []byte, ptr interface{}, fn func() error) (uint64, error) {
+	if s.ro {
+		return 0, ErrReadOnly
 	}
-	v, err := msgpack.Marshal(val)
+	if s.err != nil {
+		return 0, s.err
+	}
+	if err := s.get(key, ptr); err != nil {
+		return 0, err
+	}
+	if err := fn(); err != nil {
+		return 0, err
+	}
+	val, err := msgpack.Marshal(ptr)
 	if err != nil {
-		return fmt.Errorf("store[add]: error while attempting to marshal -> %q", err)
+		return 0, fmt.Errorf("store[update]: error while attempting to marshal -> %q", err)
 	}
-	if err := verify(k, v); err != nil {
-		if err != ErrPageSize {
-			return fmt.Errorf("store[add]: error while doing bounds check -> %q", err)
-		}
-		return ErrPageSize
+	if err := verify(key, val, s.idx.ngin.maxValSize()); err != nil {
+		return 0, fmt.Errorf("store[update]: error while doing bounds check -> %q", err)
 	}
-	if err := s.idx.add(k, v); err != nil {
-		return fmt.Errorf("store[add]: error while adding to index -> %q", err)
+	exp, err := s.idx.expiry(key)
+	if err != nil {
+		return 0, fmt.Errorf("store[update]: error while checking index -> %q", err)
 	}
-	return nil
+	return s.set(key, val, exp)
 }
-*/
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
-//			SET				//
+//			SET IF			//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
-func (s *store) set(key []byte, val []byte) error {
-	if err := s.idx.set(key, val); err != nil {
-		return fmt.Errorf("store[set]: error while adding to index -> %q", err)
+// set val for key, as long as the record for key is still at version
+// ver (or, if ver is 0, there is no record for key)
+func (s *store) setIf(key []byte, val []byte, ver uint64) (uint64, error) {
+	if s.ro {
+		return 0, ErrReadOnly
 	}
-	return nil
-}
-
-/*
-func (s *store) set(key, val interface{}) error {
-	k, err := s.genKey(key)
-	if err != nil {
-		return fmt.Errorf("store[set]: error while generating key -> %q", err)
+	if s.err != nil {
+		return 0, s.err
 	}
-	v, err := msgpack.Marshal(val)
+	cur, err := s.idx.version(key)
 	if err != nil {
-		return fmt.Errorf("store[set]: error while attempting to marshal -> %q", err)
+		return 0, fmt.Errorf("store[setIf]: error while getting version from index -> %q", err)
 	}
-	if err := verify(k, v); err != nil {
-		return fmt.Errorf("store[set]: error while doing bounds check -> %q", err)
+	if cur != ver {
+		return 0, ErrVersionConflict
 	}
-	if err := s.idx.set(k, v); err != nil {
-		return fmt.Errorf("store[set]: error while setting in index -> %q", err)
+	// keep the record's ttl, if it has one
+	exp, err := s.idx.expiry(key)
+	if err != nil {
+		return 0, fmt.Errorf("store[setIf]: error while checking index -> %q", err)
 	}
-	return nil
+	return s.set(key, val, exp)
 }
-*/
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
 //			GET				//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
 func (s *store) get(key []byte, ptr interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
 	v, err := s.idx.get(key)
+	if _, ok := err.(*CorruptError); ok {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("store[get]: error while getting value from index -> %q", err)
 	}
@@ -162,129 +206,120 @@ func (s *store) get(key []byte, ptr interface{}) error {
 	return nil
 }
 
-/*
-func (s *store) get(key, ptr interface{}) error {
-	k, err := s.genKey(key)
-	if err != nil {
-		return fmt.Errorf("store[get]: error while generating key -> %q", err)
+// get the val for key into ptr, returning the version of its record
+func (s *store) getVersion(key []byte, ptr interface{}) (uint64, error) {
+	if err := s.get(key, ptr); err != nil {
+		return 0, err
 	}
-	v, err := s.idx.get(k)
+	ver, err := s.idx.version(key)
 	if err != nil {
-		return fmt.Errorf("store[get]: error while getting value from index -> %q", err)
+		return 0, fmt.Errorf("store[getVersion]: error while getting version from index -> %q", err)
 	}
-	if err := msgpack.Unmarshal(v, ptr); err != nil {
-		return fmt.Errorf("store[get]: error while attempting to un-marshal -> %q", err)
-	}
-	return nil
+	return ver, nil
 }
-*/
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
 //			DEL				//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
-func (s *store) del(key []byte) error {
-	if err := s.idx.del(key); err != nil {
-		return fmt.Errorf("store[del]: error while deleting value from index -> %q", err)
+func (s *store) del(key []byte) (uint64, error) {
+	if s.ro {
+		return 0, ErrReadOnly
 	}
-	return nil
-}
-
-/*
-func (s *store) del(key interface{}) error {
-	k, err := s.genKey(key)
+	if s.err != nil {
+		return 0, s.err
+	}
+	ok, err := s.idx.live(key)
 	if err != nil {
-		return fmt.Errorf("store[del]: error while generating key -> %q", err)
+		return 0, fmt.Errorf("store[del]: error while checking index -> %q", err)
 	}
-	if err := s.idx.del(k); err != nil {
-		return fmt.Errorf("store[del]: error while deleting value from index -> %q", err)
+	if !ok {
+		return 0, fmt.Errorf("store[del]: key does not exist, not deleting")
 	}
-	return nil
+	seq, err := s.log.log(walDel, key, nil)
+	if err != nil {
+		return 0, fmt.Errorf("store[del]: error while writing to log -> %q", err)
+	}
+	if err := s.idx.del(key); err != nil {
+		return 0, fmt.Errorf("store[del]: error while deleting value from index -> %q", err)
+	}
+	return seq, s.checkpoint()
 }
-*/
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
 //			GETALL			//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
-func (s *store) all(ptr interface{}) error {
-	typ := reflect.TypeOf(ptr)
-	if typ.Kind() != reflect.Ptr {
-		return fmt.Errorf("error: expected pointer to model\n")
-	}
-
-	// derefrencing pointer; getting model type and value
-	typ = typ.Elem()
-	val := reflect.Indirect(reflect.ValueOf(ptr))
-
-	// init vars and split query values
-	var dec *msgpack.Decoder
-	var buf *bytes.Reader
-
-	for rec := range s.idx.nextRecord() {
-		if rec == nil {
-			continue
-		}
-		// fill out buffer, and initialize decoder
-		buf = bytes.NewReader(rec)
-		dec = msgpack.NewDecoder(buf)
-
-		// new pointer to refect value of single ptr type
-		zro := reflect.Indirect(reflect.New(typ.Elem()))
-		if err := dec.DecodeValue(zro); err != nil {
-			return err
-		}
-		// append value to ptr value
-		val.Set(reflect.Append(val, zro))
-	}
-	return nil
+func (s *store) all(ptr interface{}, p *Page) (string, error) {
+	return s.collect(nil, ptr, p)
 }
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
 //			QUERY			//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
-func (s *store) query(qry string, ptr interface{}) error {
+func (s *store) query(qry string, ptr interface{}, p *Page) (string, error) {
+	return s.collect(strings.Split(qry, "&&"), ptr, p)
+}
+
+// append every record matching qrys (or every record, if qrys is nil)
+// to the slice ptr points to, a page at a time if p is not nil. the
+// token for the next page is returned if the page was filled.
+func (s *store) collect(qrys []string, ptr interface{}, p *Page) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
 
 	// type checking for pointer
 	typ := reflect.TypeOf(ptr)
 	if typ.Kind() != reflect.Ptr {
-		return fmt.Errorf("error: expected pointer to model\n")
+		return "", fmt.Errorf("error: expected pointer to model\n")
 	}
 
 	// derefrencing pointer; getting model type and value
 	typ = typ.Elem()
 	val := reflect.Indirect(reflect.ValueOf(ptr))
 
-	// init vars and split query values
-	var dec *msgpack.Decoder
-	var buf *bytes.Reader
-	qrys := strings.Split(qry, "&&")
+	if p == nil {
+		p = new(Page)
+	}
+	after, err := p.after()
+	if err != nil {
+		return "", err
+	}
+	skip, n := p.Skip, 0
+	var last []byte
 
-	// iterate the index by record, skipping empty ones
-	for rec := range s.idx.nextRecord() {
-		if rec == nil {
-			continue
-		}
+	// iterate the index by record, from where the last page left off
+	err = s.idx.scan(after, func(key, rec []byte) (bool, error) {
 		// fill out buffer, and initialize decoder
-		buf = bytes.NewReader(rec)
-		dec = msgpack.NewDecoder(buf)
+		dec := msgpack.NewDecoder(bytes.NewReader(rec))
 
 		// check for a query match
 		ok, err := match(dec, qrys)
-		if err != nil {
-			return err
+		if err != nil || !ok {
+			return true, err
+		}
+		if skip > 0 {
+			skip--
+			return true, nil
 		}
 
-		// found a match!
-		if ok {
-			// new pointer to refect value of single ptr type
-			zro := reflect.Indirect(reflect.New(typ.Elem()))
-			if err := dec.DecodeValue(zro); err != nil {
-				return err
-			}
-			// append matched value to ptr value
-			val.Set(reflect.Append(val, zro))
+		// new pointer to refect value of single ptr type
+		zro := reflect.Indirect(reflect.New(typ.Elem()))
+		if err := dec.DecodeValue(zro); err != nil {
+			return false, err
+		}
+		// append matched value to ptr value
+		val.Set(reflect.Append(val, zro))
+		n++
+		if p.Limit > 0 && n == p.Limit {
+			last = append([]byte(nil), key...)
+			return false, nil
 		}
+		return true, nil
+	})
+	if err != nil || last == nil {
+		return "", err
 	}
-	return nil
+	return pageToken(last), nil
 }
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
@@ -323,90 +358,175 @@ func (s *store) count() int {
 }
 
 /*	=~=~=~=~=~=~=~=~=~=~=~=	//
-//		 CLOSE STORE		//
+//		  COMPACTION		//
 //	=~=~=~=~=~=~=~=~=~=~=~=	*/
-func (s *store) close() error {
-	return s.idx.close()
+// return the key and block position of every record, last block first
+func (s *store) blocks() ([]payload, error) {
+	blks, err := s.idx.blocks()
+	if err != nil {
+		return nil, fmt.Errorf("store[blocks]: error while walking index -> %q", err)
+	}
+	sort.Slice(blks, func(i, j int) bool {
+		return blks[i].pos > blks[j].pos
+	})
+	return blks, nil
 }
 
-/*
-func (s *store) growPageSizeOnDisk(valsz int) error {
-	// new page size
-	ps := align(valsz)
-	// create new index using new page size
-	if err := createEmptyFile(s.dsn+`_.ix`, ps); err != nil {
-		return err
+// move each record toward the front of the data file if there is room
+func (s *store) compact(blks []payload) error {
+	if s.ro {
+		return ErrReadOnly
+	}
+	if s.err != nil {
+		return s.err
+	}
+	// records are copied first, and only cut from where they were
+	// once the copies, and the index pointing at them, are on disk. a
+	// crash in between leaves both copies in the data file, and the
+	// index is rebuilt with the first of them (the new one).
+	var moved []int
+	var err error
+	for _, blk := range blks {
+		var ok bool
+		if ok, err = s.idx.move(blk.key, blk.pos); err != nil {
+			err = fmt.Errorf("store[compact]: error while moving record -> %q", err)
+			break
+		}
+		if ok {
+			moved = append(moved, blk.pos)
+		}
 	}
-	// new file size
-	fs := s.idx.count * ps
-	// create new file using new page size * number of current records
-	if err := createEmptyFile(s.dsn+`_.db`, fs); err != nil {
+	if len(moved) == 0 {
 		return err
 	}
-	// create new engine
-	en := new(engine)
-	// open path to new "grown" engine
-	if _, err := en.open(s.dsn + `_`); err != nil {
-		// something went wrong; clean up temp files
-		if err := os.Remove(s.dsn + `_.ix`); err != nil {
-			return err
-		}
-		if err := os.Remove(s.dsn + `_.db`); err != nil {
-			return err
+	if err := s.idx.ngin.sync(); err != nil {
+		return fmt.Errorf("store[compact]: error while syncing data file -> %q", err)
+	}
+	if err := s.idx.pgr.sync(); err != nil {
+		return fmt.Errorf("store[compact]: error while syncing index -> %q", err)
+	}
+	for _, k := range moved {
+		s.idx.ngin.cut(k, s.idx.ngin.span(k))
+	}
+	return err
+}
+
+// sync the moved records and truncate the end of the data file
+func (s *store) truncate() (int64, error) {
+	if s.ro {
+		return 0, ErrReadOnly
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if err := s.log.checkpoint(s.idx); err != nil {
+		return 0, fmt.Errorf("store[truncate]: error while checkpointing log -> %q", err)
+	}
+	n, err := s.idx.ngin.truncate()
+	if err != nil {
+		return 0, fmt.Errorf("store[truncate]: error while truncating data file -> %q", err)
+	}
+	return n, nil
+}
+
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//			 REAP			//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+// return the key and block position of every expired record
+func (s *store) expired() ([]payload, error) {
+	all, err := s.idx.blocks()
+	if err != nil {
+		return nil, fmt.Errorf("store[expired]: error while walking index -> %q", err)
+	}
+	var blks []payload
+	for _, blk := range all {
+		if exp, err := s.idx.ngin.getRecordExp(blk.pos); err == nil && expired(exp) {
+			blks = append(blks, blk)
 		}
-		return err
 	}
-	// iterate memory mapped records, add them to the new store
-	for pos := 0; true; pos++ {
-		rec, err := s.idx.ngin.getRecord(pos)
+	return blks, nil
+}
+
+// delete each expired record, unless it has been set again since
+func (s *store) reap(blks []payload) error {
+	if s.ro {
+		return ErrReadOnly
+	}
+	if s.err != nil {
+		return s.err
+	}
+	for _, blk := range blks {
+		has, err := s.idx.has(blk.key)
 		if err != nil {
-			if err == ErrEngineEOF {
-				break
-			} else if err == ErrEmptyRecord {
-				continue
-			}
+			return fmt.Errorf("store[reap]: error while checking index -> %q", err)
 		}
-		// no errors, so add record directly to the new engine (ignore page offset addRecord returns)
-		if _, err := en.addRecord(rec); err != nil {
-			return err
+		live, err := s.idx.live(blk.key)
+		if err != nil {
+			return fmt.Errorf("store[reap]: error while checking index -> %q", err)
+		}
+		if !has || live {
+			continue
+		}
+		if _, err := s.log.log(walDel, blk.key, nil); err != nil {
+			return fmt.Errorf("store[reap]: error while writing to log -> %q", err)
+		}
+		if err := s.idx.del(blk.key); err != nil {
+			return fmt.Errorf("store[reap]: error while deleting value from index -> %q", err)
 		}
 	}
-	// close new store so everything syncs
-	if err := en.close(); err != nil {
-		return err
-	}
-	// close the existing store's index
-	if err := s.idx.close(); err != nil {
-		return err
-	}
-	// next remove existing store files
-	if err := os.Remove(s.dsn + `.ix`); err != nil {
-		return err
+	return s.checkpoint()
+}
+
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//		 CHECKPOINT			//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+// checkpoint the write-ahead log once it grows large enough
+func (s *store) checkpoint() error {
+	if s.log.size < walMaxSize {
+		return nil
 	}
-	if err := os.Remove(s.dsn + `.db`); err != nil {
-		return err
+	if err := s.log.checkpoint(s.idx); err != nil {
+		return fmt.Errorf("store[checkpoint]: error while checkpointing log -> %q", err)
 	}
-	// rename new engine files
-	if err := os.Rename(s.dsn+`_.ix`, s.dsn+`.ix`); err != nil {
-		return err
+	return nil
+}
+
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//			SYNC			//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+// wait for the mutation logged with sequence number seq to be synced,
+// as the sync policy requires. the store must not be locked, so other
+// writers can join the same group commit meanwhile.
+func (s *store) wait(seq uint64) error {
+	if err := s.log.wait(seq); err != nil {
+		return fmt.Errorf("store[wait]: error while waiting for sync -> %q", err)
 	}
-	if err := os.Rename(s.dsn+`_.db`, s.dsn+`.db`); err != nil {
-		return err
+	return nil
+}
+
+// sync every mutation made so far to disk
+func (s *store) sync() error {
+	if s.ro {
+		return nil
 	}
-	// reopen current store now utilizing new "grown" engine
-	s.idx = &btree{ngin: new(engine)}
-	if err := s.idx.open(s.dsn); err != nil {
-		return err
+	if err := s.log.sync(); err != nil {
+		return fmt.Errorf("store[sync]: error while syncing log -> %q", err)
 	}
-	// everything went fine, so return a nil error
 	return nil
 }
 
-// align to nearest 4KB chunk
-func align(size int) int {
-	if size > 0 {
-		return (size + (1 << 12) - 1) &^ ((1 << 12) - 1)
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//		 CLOSE STORE		//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+func (s *store) close() error {
+	if !s.ro {
+		if err := s.log.checkpoint(s.idx); err != nil {
+			return err
+		}
+	}
+	if err := s.log.close(); err != nil {
+		return err
 	}
-	return 1 << 12 // 4KB
+	return s.idx.close()
 }
-*/
+
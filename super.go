@@ -0,0 +1,204 @@
+package godb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	sbMagic   = "godb.dat" // identifies a data file
+	sbVersion = 7          // current data file format version (2: length-prefixed keys, 3: order-preserving keys, 4: compression flag, 5: encryption, 6: record expiry, 7: record versions)
+	sbSize    = 74         // magic (8) + version (2) + page size (4) + record count (8) + flags (4) + nonce sequence (8) + key check (32) + record version (8)
+
+	sbOpen      uint32 = 1 << 0 // set while the data file is open
+	sbEncrypted uint32 = 1 << 1 // set if the data file is encrypted
+	sbExpiry    uint32 = 1 << 2 // set once a record has been written with an expiry
+)
+
+// the superblock lives at the start of page 0 of the data file,
+// ahead of any records. it identifies the file as a godb data
+// file, records the format version and page size it was written
+// with, and keeps a count of the records in the file and a set
+// of flags describing it.
+//
+//	[0:8]   magic number
+//	[8:10]  format version
+//	[10:14] page size
+//	[14:22] record count
+//	[22:26] flags
+//	[26:34] next nonce sequence number, for encrypted files
+//	[34:66] key check, for encrypted files; a known value sealed
+//	        with the key, used to tell if the right key was given
+//	[66:74] highest version given to a record so far
+
+// FormatError is returned when opening a file that is not a
+// godb data file, or one written in a format we don't support
+type FormatError struct {
+	Path   string // path of the data file
+	Reason string // what was wrong with it
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("engine: cannot open %q (%s)", e.Path, e.Reason)
+}
+
+// write a new superblock to page 0 of a freshly created data file
+func (e *engine) initSuper() error {
+	b := make([]byte, sbSize)
+	copy(b[0:8], sbMagic)
+	binary.BigEndian.PutUint16(b[8:10], sbVersion)
+	binary.BigEndian.PutUint32(b[10:14], uint32(e.page))
+	e.dev.write(0, b)
+	if e.crypt != nil {
+		e.setFlags(sbEncrypted, true)
+		if err := e.reserveSeq(); err != nil {
+			return err
+		}
+		e.writeKeyCheck()
+	}
+	return nil
+}
+
+// seal a known value with the key, so it can be checked on open
+func (e *engine) writeKeyCheck() {
+	e.touch(0, 1)
+	e.dev.write(34, e.crypt.seal(sealCheck, 0, []byte(sbMagic)))
+}
+
+// read and validate the superblock, setting the page size from it
+func (e *engine) readSuper(path string) error {
+	size := e.dev.size()
+	if size < sbSize {
+		return &FormatError{path, "file is too small to hold a superblock"}
+	}
+	b := e.dev.slice(0, sbSize)
+	if string(b[0:8]) != sbMagic {
+		return &FormatError{path, "not a godb data file (bad magic number)"}
+	}
+	if v := binary.BigEndian.Uint16(b[8:10]); v != sbVersion {
+		return &FormatError{path, fmt.Sprintf("unsupported format version %d (expected %d)", v, sbVersion)}
+	}
+	ps := int(binary.BigEndian.Uint32(b[10:14]))
+	if ps < 512 || ps&(ps-1) != 0 {
+		return &FormatError{path, fmt.Sprintf("invalid page size %d", ps)}
+	}
+	if size%ps != 0 {
+		return &FormatError{path, fmt.Sprintf("file size %d is not a multiple of the page size %d", size, ps)}
+	}
+	e.page = ps
+	switch enc := e.flags()&sbEncrypted != 0; {
+	case enc && e.crypt == nil:
+		return &FormatError{path, "file is encrypted, but no key was given"}
+	case !enc && e.crypt != nil:
+		return &FormatError{path, "file is not encrypted, but a key was given"}
+	case enc:
+		if _, err := e.crypt.open(sealCheck, 0, b[34:66]); err != nil {
+			return &FormatError{path, "wrong encryption key"}
+		}
+		if !e.ro {
+			if err := e.reserveSeq(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// read a 32 or 64 bit field of the superblock
+func (e *engine) super32(off int) uint32 {
+	return binary.BigEndian.Uint32(e.dev.slice(off, 4))
+}
+
+func (e *engine) super64(off int) uint64 {
+	return binary.BigEndian.Uint64(e.dev.slice(off, 8))
+}
+
+// write a 32 or 64 bit field of the superblock
+func (e *engine) setSuper32(off int, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.touch(0, 1)
+	e.dev.write(off, b[:])
+}
+
+func (e *engine) setSuper64(off int, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.touch(0, 1)
+	e.dev.write(off, b[:])
+}
+
+// return the next nonce sequence number, and move on past it
+func (e *engine) nextSeq() uint64 {
+	n := e.super64(26)
+	e.setSuper64(26, n+1)
+	return n
+}
+
+// start handing out nonce sequence numbers from a random point each
+// time the file is opened. the sequence number in the superblock may
+// not have made it to disk before a crash, and the file may have been
+// copied (or the same backup restored twice) with each copy then taking
+// different writes, so carrying on from it could reuse a nonce. from a
+// random point, no two opens hand out the same numbers, short of odds
+// far too long to matter.
+func (e *engine) reserveSeq() error {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Errorf("engine: cannot pick nonce sequence -> %s", err)
+	}
+	e.setSuper64(26, binary.BigEndian.Uint64(b[:]))
+	return nil
+}
+
+// return the record count stored in the superblock
+func (e *engine) count() int {
+	return int(e.super64(14))
+}
+
+// adjust the record count stored in the superblock by n
+func (e *engine) addCount(n int) {
+	e.setSuper64(14, uint64(e.count()+n))
+}
+
+// return the highest version given to a record so far
+func (e *engine) version() uint64 {
+	return e.super64(66)
+}
+
+// note that a record has been written at version v, so no version at
+// or below it is given out again
+func (e *engine) seeVersion(v uint64) {
+	if v > e.version() {
+		e.setSuper64(66, v)
+	}
+}
+
+// note that a record has been written expiring at exp (or never, if
+// exp is 0)
+func (e *engine) seeExpiry(exp int64) {
+	if exp != 0 && e.flags()&sbExpiry == 0 {
+		e.setFlags(sbExpiry, true)
+	}
+}
+
+// report whether a record has ever been written with an expiry, so
+// there may be expired records to reap
+func (e *engine) expiring() bool {
+	return e.flags()&sbExpiry != 0
+}
+
+// return the flags stored in the superblock
+func (e *engine) flags() uint32 {
+	return e.super32(22)
+}
+
+// set or clear flags in the superblock
+func (e *engine) setFlags(f uint32, on bool) {
+	if on {
+		e.setSuper32(22, e.flags()|f)
+		return
+	}
+	e.setSuper32(22, e.flags()&^f)
+}
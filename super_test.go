@@ -0,0 +1,73 @@
+package godb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// test that a data file with a superblock we don't understand is
+// refused with a *FormatError, and left as it was
+func Test_Super_Format(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "super")
+	c := openTestCollection(t, path)
+	c.Set("a", 1)
+	c.Close()
+	orig, err := ioutil.ReadFile(path + ".db")
+	if err != nil {
+		t.Fatalf("reading data file: %s\n", err)
+	}
+	for _, tt := range []struct {
+		name   string
+		change func(b []byte) []byte
+		reason string
+	}{
+		{"bad magic", func(b []byte) []byte {
+			copy(b[0:8], "sqlite3\x00")
+			return b
+		}, "not a godb data file (bad magic number)"},
+		{"old version", func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[8:10], sbVersion-1)
+			return b
+		}, fmt.Sprintf("unsupported format version %d (expected %d)", sbVersion-1, sbVersion)},
+		{"new version", func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[8:10], sbVersion+1)
+			return b
+		}, fmt.Sprintf("unsupported format version %d (expected %d)", sbVersion+1, sbVersion)},
+		{"bad page size", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[10:14], 3000)
+			return b
+		}, "invalid page size 3000"},
+		{"mismatched page size", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[10:14], 1<<30)
+			return b
+		}, fmt.Sprintf("file size %d is not a multiple of the page size %d", len(orig), 1<<30)},
+		{"too small", func(b []byte) []byte {
+			return b[:sbSize-1]
+		}, "file is too small to hold a superblock"},
+	} {
+		b := tt.change(append([]byte(nil), orig...))
+		if err := ioutil.WriteFile(path+".db", b, 0666); err != nil {
+			t.Fatalf("writing data file: %s\n", err)
+		}
+		_, err := OpenCollection(path)
+		var ferr *FormatError
+		if !errors.As(err, &ferr) || ferr.Reason != tt.reason || ferr.Path != path {
+			t.Fatalf("%s: expected %q, got: %v\n", tt.name, tt.reason, err)
+		}
+		if got, _ := ioutil.ReadFile(path + ".db"); string(got) != string(b) {
+			t.Fatalf("%s: expected the data file to be left as it was\n", tt.name)
+		}
+	}
+	// and once put back, it opens again
+	ioutil.WriteFile(path+".db", orig, 0666)
+	c = openTestCollection(t, path)
+	defer c.Close()
+	var n int
+	if err := c.Get("a", &n); err != nil || n != 1 {
+		t.Fatalf("expected 1, got: %d, %v\n", n, err)
+	}
+}
@@ -0,0 +1,66 @@
+package godb
+
+import (
+	"fmt"
+	"time"
+)
+
+// when the write-ahead log is synced
+const (
+	syncAlways byte = iota
+	syncGroup
+	syncManual
+	syncNever
+)
+
+const syncInterval = 10 * time.Millisecond // default group commit interval
+
+// SyncPolicy decides when the mutations made to a collection reach
+// disk. a mutation is durable once the write-ahead log entry for it
+// has been synced; after a crash it is replayed from the log, so the
+// data file itself only has to be flushed at checkpoints.
+type SyncPolicy struct {
+	mode     byte
+	interval time.Duration // group commit: longest a write waits for a sync
+	writes   int           // group commit: writes that trigger a sync
+}
+
+var (
+	// SyncAlways syncs the log after every mutation, before it is
+	// applied. this is the default.
+	SyncAlways = SyncPolicy{mode: syncAlways}
+
+	// SyncManual only syncs the log when Collection.Sync is called
+	// (and at checkpoints). mutations made since the last sync may
+	// be lost in a crash.
+	SyncManual = SyncPolicy{mode: syncManual}
+
+	// SyncNever leaves syncing to the operating system. Collection.Sync
+	// does nothing; the log is still synced at checkpoints and on close.
+	SyncNever = SyncPolicy{mode: syncNever}
+)
+
+// SyncGroup commits writes in groups. the log is synced once n writes
+// are waiting, or once the first of them has waited for d, whichever
+// comes first. each write blocks until a sync covers it, so it is as
+// durable as with SyncAlways, but all the writes waiting share a
+// single sync. if n is zero the log is only synced on the timer; if
+// d is zero a default of 10ms is used, so no write waits forever.
+func SyncGroup(d time.Duration, n int) SyncPolicy {
+	if d <= 0 {
+		d = syncInterval
+	}
+	return SyncPolicy{mode: syncGroup, interval: d, writes: n}
+}
+
+func (p SyncPolicy) String() string {
+	switch p.mode {
+	case syncAlways:
+		return "always"
+	case syncGroup:
+		return fmt.Sprintf("group(%s, %d writes)", p.interval, p.writes)
+	case syncManual:
+		return "manual"
+	}
+	return "never"
+}
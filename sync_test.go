@@ -0,0 +1,103 @@
+package godb
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// syncCounter is a file that counts how often it is synced
+type syncCounter struct {
+	*memFile
+	syncs int32
+}
+
+func (f *syncCounter) Sync() error {
+	atomic.AddInt32(&f.syncs, 1)
+	return nil
+}
+
+// log n entries from n goroutines at once, each waiting on its entry
+// as a collection does, and return how many times the log was synced
+func logConcurrently(t *testing.T, p SyncPolicy, n int) int {
+	f := &syncCounter{memFile: &memFile{name: "test.wal"}}
+	w := newWAL(f, 0, newOptions([]Option{WithSync(p)}))
+	var start, wg sync.WaitGroup
+	var lock sync.Mutex
+	start.Add(1)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start.Wait()
+			// the collection is locked while logging, but not waiting
+			lock.Lock()
+			seq, err := w.log(walSet, []byte("k"), setEntryVal(1, 0, nil))
+			lock.Unlock()
+			if err == nil {
+				err = w.wait(seq)
+			}
+			if err != nil {
+				t.Errorf("logging: %s\n", err)
+			}
+		}()
+	}
+	start.Done()
+	wg.Wait()
+	if w.synced != w.seq && p.mode != syncManual && p.mode != syncNever {
+		t.Fatalf("expected every entry to be synced under %s, got: %d of %d\n", p, w.synced, w.seq)
+	}
+	return int(atomic.LoadInt32(&f.syncs))
+}
+
+// test that each policy syncs the log as often as it says it does
+func Test_Sync_Policies(t *testing.T) {
+	if n := logConcurrently(t, SyncAlways, 20); n != 20 {
+		t.Fatalf("expected 20 syncs, got: %d\n", n)
+	}
+	if n := logConcurrently(t, SyncGroup(time.Hour, 5), 20); n != 4 {
+		t.Fatalf("expected 4 syncs, got: %d\n", n)
+	}
+	if n := logConcurrently(t, SyncGroup(time.Millisecond, 0), 20); n == 0 || n >= 20 {
+		t.Fatalf("expected writes to share syncs, got: %d\n", n)
+	}
+	for _, p := range []SyncPolicy{SyncManual, SyncNever} {
+		if n := logConcurrently(t, p, 20); n != 0 {
+			t.Fatalf("expected no syncs under %s, got: %d\n", p, n)
+		}
+	}
+}
+
+// test that everything written before Sync returns survives a crash,
+// whatever the policy
+func Test_Sync_Crash(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncGroup(5*time.Millisecond, 8), SyncManual, SyncNever} {
+		path := filepath.Join(t.TempDir(), "sync")
+		c := openTestCollection(t, path, WithSync(p))
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 25; i++ {
+					if err := c.Set(g*100+i, "v"); err != nil {
+						t.Errorf("setting: %s\n", err)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		if err := c.Sync(); err != nil {
+			t.Fatalf("syncing: %s\n", err)
+		}
+		crashCollection(c)
+		c = openTestCollection(t, path)
+		if n := c.Count(); n != 200 {
+			t.Fatalf("expected 200 records under %s, got: %d\n", p, n)
+		}
+		c.Close()
+	}
+}
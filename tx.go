@@ -0,0 +1,305 @@
+package godb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/cagnosolutions/msgpack"
+)
+
+// ErrTxDone is returned when a transaction is used after it has been
+// committed or rolled back
+var ErrTxDone = errors.New("tx: transaction has already been committed or rolled back")
+
+// ErrTxFailed is returned by a DB, and by each collection a transaction
+// was being applied to, once applying the transaction has failed part
+// way through. the DB must be closed and opened again, which finishes
+// applying it.
+var ErrTxFailed = errors.New("tx: transaction failed part way through being applied; reopen the database to recover it")
+
+// Tx is a transaction over any number of collections in a DB. its
+// writes are held in the transaction, where only it can see them,
+// until it is committed; then they are applied all together, or not
+// at all. a Tx must not be used by more than one goroutine at once.
+type Tx struct {
+	db     *DB
+	writes map[string][]*walEntry // writes waiting to be committed, by collection
+	done   bool
+}
+
+// Begin starts a new transaction
+func (db *DB) Begin() *Tx {
+	return &Tx{db: db, writes: make(map[string][]*walEntry)}
+}
+
+// add a write to the collection called name, encoding key and val. the
+// collection isn't opened, or created, until the transaction commits.
+func (tx *Tx) write(op byte, name string, key, val interface{}) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := validName(name); err != nil {
+		return logger(err)
+	}
+	var err error
+	ent := &walEntry{op: op}
+	if op == walDel {
+		ent.key, err = genKey(key)
+	} else {
+		ent.key, ent.val, err = encodeKeyVal(key, val)
+	}
+	if err != nil {
+		return logger(err)
+	}
+	tx.writes[name] = append(tx.writes[name], ent)
+	return nil
+}
+
+// Add adds val under key in the collection called name when the
+// transaction is committed, creating the collection if need be. the
+// commit fails if key already exists.
+func (tx *Tx) Add(name string, key, val interface{}) error {
+	return tx.write(walAdd, name, key, val)
+}
+
+// Set sets val under key in the collection called name when the
+// transaction is committed, creating the collection if need be
+func (tx *Tx) Set(name string, key, val interface{}) error {
+	return tx.write(walSet, name, key, val)
+}
+
+// Del deletes key from the collection called name when the
+// transaction is committed. the commit fails if key does not exist.
+func (tx *Tx) Del(name string, key interface{}) error {
+	return tx.write(walDel, name, key, nil)
+}
+
+// Get reads the value under key in the collection called name into
+// ptr, as the transaction sees it: with its own writes applied over
+// what has been committed. reading from a collection that doesn't
+// exist is an error; it is not created.
+func (tx *Tx) Get(name string, key, ptr interface{}) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	k, err := genKey(key)
+	if err != nil {
+		return logger(err)
+	}
+	ents := tx.writes[name]
+	for i := len(ents) - 1; i >= 0; i-- {
+		if string(ents[i].key) != string(k) {
+			continue
+		}
+		if ents[i].op == walDel {
+			return logger(fmt.Errorf("tx: key has been deleted in this transaction"))
+		}
+		return logger(msgpack.Unmarshal(ents[i].val, ptr))
+	}
+	c, err := tx.db.existing(name)
+	if err != nil {
+		return logger(err)
+	}
+	if c == nil {
+		return logger(fmt.Errorf("tx: collection %q does not exist", name))
+	}
+	return c.Get(key, ptr)
+}
+
+// Commit applies every write in the transaction, all or nothing. each
+// add and del is checked first, as it is in a Batch; if any fail then
+// nothing is applied. otherwise the transaction is logged, then applied
+// while every collection it writes to is locked, so no reader sees it
+// half applied. the logs of those collections are synced before Commit
+// returns, whatever their SyncPolicy.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return logger(tx.db.commit(tx.writes))
+}
+
+// Rollback throws away every write in the transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done, tx.writes = true, nil
+	return nil
+}
+
+/*	=~=~=~=~=~=~=~=~=~=~=~=	//
+//		COMMIT AND RECOVER	//
+//	=~=~=~=~=~=~=~=~=~=~=~=	*/
+
+// commit the writes of a transaction, by collection
+func (db *DB) commit(writes map[string][]*walEntry) error {
+	var names []string
+	for name, ents := range writes {
+		if len(ents) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if db.o.readOnly {
+		return ErrReadOnly
+	}
+	db.Lock()
+	defer db.Unlock()
+	// always lock collections in the same order
+	sort.Strings(names)
+	cols := make([]*Collection, len(names))
+	for i, name := range names {
+		c, err := db.collection(name)
+		if err != nil {
+			return err
+		}
+		cols[i] = c
+		c.Lock()
+		defer c.Unlock()
+	}
+	stamped := make(map[string][]*walEntry)
+	for i, c := range cols {
+		if err := c.st.precheck(writes[names[i]]); err != nil {
+			return fmt.Errorf("db[commit]: collection %q -> %s", names[i], err)
+		}
+		stamped[names[i]] = c.st.stamp(writes[names[i]])
+	}
+	if err := db.logTx(names, cols, stamped); err != nil {
+		return err
+	}
+	for i, c := range cols {
+		// an error from here on leaves the transaction half applied
+		// until it is replayed, the next time the DB is opened, so
+		// nothing is let near it until then
+		if _, err := c.st.commit(stamped[names[i]]); err != nil {
+			db.fail(cols)
+			return fmt.Errorf("db[commit]: collection %q -> %s", names[i], err)
+		}
+		if err := c.st.log.flush(); err != nil {
+			db.fail(cols)
+			return fmt.Errorf("db[commit]: collection %q -> %s", names[i], err)
+		}
+	}
+	if err := db.clearTx(); err != nil {
+		// every collection has it, but it would be applied again over
+		// whatever is written next if the DB crashed
+		db.fail(cols)
+		return err
+	}
+	return nil
+}
+
+// mark the DB, and the collections a transaction was being applied to,
+// as failed, so they refuse to be read or written until the DB is
+// reopened. the DB and the collections must be locked.
+func (db *DB) fail(cols []*Collection) {
+	db.err = ErrTxFailed
+	for _, c := range cols {
+		c.st.err = ErrTxFailed
+	}
+}
+
+// write a transaction to the transaction log as a single entry, whose
+// value holds each collection's part of it as an entry of its own,
+// keyed by the collection's name. each part is sealed if the collection
+// is encrypted. the log is emptied first, so nothing left in it from
+// before can be read back as part of this transaction.
+func (db *DB) logTx(names []string, cols []*Collection, writes map[string][]*walEntry) error {
+	if db.txlog == nil {
+		return nil
+	}
+	parts := make([]*walEntry, len(names))
+	for i, name := range names {
+		b := encodeBatch(writes[name])
+		if crypt := cols[i].st.log.crypt; crypt != nil {
+			b = crypt.seal(sealTx, 0, b)
+		}
+		parts[i] = &walEntry{walBat, []byte(name), b}
+	}
+	b := (&walEntry{walBat, nil, encodeBatch(parts)}).encode()
+	if err := db.txlog.Truncate(0); err != nil {
+		return fmt.Errorf("db[logTx]: error truncating transaction log -> %s", err)
+	}
+	if _, err := db.txlog.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("db[logTx]: error writing transaction log -> %s", err)
+	}
+	if err := db.txlog.Sync(); err != nil {
+		return fmt.Errorf("db[logTx]: error syncing transaction log -> %s", err)
+	}
+	return nil
+}
+
+// clear the transaction log, once every collection has its part of the
+// transaction in it on disk
+func (db *DB) clearTx() error {
+	if db.txlog == nil {
+		return nil
+	}
+	if err := db.txlog.Truncate(0); err != nil {
+		return fmt.Errorf("db[clearTx]: error truncating transaction log -> %s", err)
+	}
+	if err := db.txlog.Sync(); err != nil {
+		return fmt.Errorf("db[clearTx]: error syncing transaction log -> %s", err)
+	}
+	return nil
+}
+
+// apply the transaction left in the transaction log, if any, to each
+// of its collections again. applying a part more than once leaves the
+// collection the same, so it doesn't matter how much of it was applied
+// already. a transaction that was only partly logged was never applied
+// at all, and is thrown away.
+func (db *DB) recover() error {
+	b, err := ioutil.ReadAll(io.NewSectionReader(db.txlog, 0, 1<<62))
+	if err != nil {
+		return fmt.Errorf("db[recover]: error reading transaction log -> %s", err)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	ents, err := decodeBatch(b)
+	if err != nil || len(ents) != 1 {
+		if db.o.readOnly {
+			return nil
+		}
+		return db.clearTx()
+	}
+	if db.o.readOnly {
+		return ErrNeedsRecovery
+	}
+	parts, err := decodeBatch(ents[0].val)
+	if err != nil {
+		return fmt.Errorf("db[recover]: error decoding transaction -> %s", err)
+	}
+	for _, part := range parts {
+		name := string(part.key)
+		c, err := db.collection(name)
+		if err != nil {
+			return fmt.Errorf("db[recover]: collection %q -> %s", name, err)
+		}
+		b := part.val
+		if crypt := c.st.log.crypt; crypt != nil {
+			if b, err = crypt.open(sealTx, 0, b); err != nil {
+				return fmt.Errorf("db[recover]: collection %q -> %s", name, err)
+			}
+		}
+		ents, err := decodeBatch(b)
+		if err != nil {
+			return fmt.Errorf("db[recover]: collection %q -> %s", name, err)
+		}
+		if _, err := c.st.commit(ents); err != nil {
+			return fmt.Errorf("db[recover]: collection %q -> %s", name, err)
+		}
+		if err := c.st.log.flush(); err != nil {
+			return fmt.Errorf("db[recover]: collection %q -> %s", name, err)
+		}
+	}
+	return db.clearTx()
+}
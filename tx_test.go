@@ -0,0 +1,261 @@
+package godb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type order struct {
+	ID   int    `msgpack:"id"`
+	Item string `msgpack:"item"`
+}
+
+// open a database, failing the test on error
+func openTestDB(t *testing.T, dir string, opts ...Option) *DB {
+	db, err := OpenDB(dir, opts...)
+	if err != nil {
+		t.Fatalf("opening %s: %s\n", dir, err)
+	}
+	return db
+}
+
+// leave a database as a crash would
+func crashDB(db *DB) {
+	for _, c := range db.cols {
+		crashCollection(c)
+	}
+	if db.txlog != nil {
+		unlockFile(db.txlog)
+		db.txlog.Close()
+	}
+}
+
+// test that a committed transaction is applied whole, and is not seen
+// by anyone else until it is
+func Test_Tx_Commit(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer CloseDB(db)
+	p, _ := db.Collection("orders_pending")
+	p.Add(1, order{1, "a"})
+	tx := db.Begin()
+	var o order
+	if err := tx.Get("orders_pending", 1, &o); err != nil || o.Item != "a" {
+		t.Fatalf("expected %q, got: %q, %v\n", "a", o.Item, err)
+	}
+	tx.Del("orders_pending", 1)
+	tx.Add("orders_done", 1, o)
+	if err := tx.Get("orders_pending", 1, &o); err == nil {
+		t.Fatalf("expected the transaction to see its own delete\n")
+	}
+	if err := tx.Get("orders_done", 1, &o); err != nil || o.Item != "a" {
+		t.Fatalf("expected the transaction to see its own add, got: %v\n", err)
+	}
+	if err := p.Get(1, &o); err != nil {
+		t.Fatalf("expected the record to be there until commit, got: %s\n", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("committing: %s\n", err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("expected ErrTxDone, got: %v\n", err)
+	}
+	d, _ := db.Collection("orders_done")
+	if err := d.Get(1, &o); err != nil || o.Item != "a" {
+		t.Fatalf("expected %q, got: %q, %v\n", "a", o.Item, err)
+	}
+	if err := p.Get(1, &o); err == nil {
+		t.Fatalf("expected the record to be moved\n")
+	}
+	// the log is emptied once the transaction has been applied
+	if fi, _ := db.txlog.Stat(); fi.Size() != 0 {
+		t.Fatalf("expected an empty transaction log, got: %d bytes\n", fi.Size())
+	}
+}
+
+// test that a transaction that can't be applied whole, or is rolled
+// back, changes nothing
+func Test_Tx_Rollback(t *testing.T) {
+	db := openTestDB(t, "", WithBackend(Memory))
+	defer CloseDB(db)
+	p, _ := db.Collection("orders_pending")
+	d, _ := db.Collection("orders_done")
+	p.Add(2, order{2, "b"})
+	tx := db.Begin()
+	tx.Set("orders_done", 5, order{5, "x"})
+	tx.Add("orders_pending", 2, order{2, "dup"})
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("expected adding an existing key to fail the commit\n")
+	}
+	var o order
+	if err := d.Get(5, &o); err == nil {
+		t.Fatalf("expected nothing to be applied\n")
+	}
+	tx = db.Begin()
+	tx.Set("orders_done", 6, order{6, "y"})
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("rolling back: %s\n", err)
+	}
+	if err := tx.Set("orders_done", 7, order{7, "z"}); err != ErrTxDone {
+		t.Fatalf("expected ErrTxDone, got: %v\n", err)
+	}
+	if err := d.Get(6, &o); err == nil {
+		t.Fatalf("expected nothing to be applied\n")
+	}
+}
+
+// test that a transaction only creates a collection once it commits
+func Test_Tx_NoCreate(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	defer CloseDB(db)
+	tx := db.Begin()
+	if err := tx.Set("orders", 1, order{1, "a"}); err != nil {
+		t.Fatalf("setting: %s\n", err)
+	}
+	var o order
+	if err := tx.Get("missing", 1, &o); err == nil {
+		t.Fatalf("expected reading a missing collection to fail\n")
+	}
+	if err := tx.Set("../orders", 1, order{1, "a"}); err == nil {
+		t.Fatalf("expected an invalid collection name to be refused\n")
+	}
+	for _, name := range []string{"orders", "missing"} {
+		if _, err := os.Stat(filepath.Join(dir, name+".db")); !os.IsNotExist(err) {
+			t.Fatalf("expected %s not to be created, got: %v\n", name, err)
+		}
+	}
+	tx.Rollback()
+	if _, err := os.Stat(filepath.Join(dir, "orders.db")); !os.IsNotExist(err) {
+		t.Fatalf("expected a rolled back transaction not to create orders, got: %v\n", err)
+	}
+	tx = db.Begin()
+	tx.Set("orders", 1, order{1, "a"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("committing: %s\n", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "orders.db")); err != nil {
+		t.Fatalf("expected orders to be created, got: %v\n", err)
+	}
+}
+
+// test that a transaction that crashed part way through being applied
+// is applied in full when the database is next opened, and that one
+// only partly logged is thrown away
+func Test_Tx_Recover(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("0123456789abcdef")} {
+		dir := t.TempDir()
+		var opts []Option
+		if key != nil {
+			opts = append(opts, WithEncryption(key))
+		}
+		db := openTestDB(t, dir, opts...)
+		p, _ := db.Collection("orders_pending")
+		d, _ := db.Collection("orders_done")
+		p.Add(2, order{2, "b"})
+		// log a transaction, and apply only the first collection's part
+		k, v, _ := encodeKeyVal(2, order{2, "b"})
+		writes := map[string][]*walEntry{
+			"orders_done":    d.st.stamp([]*walEntry{{walAdd, k, v}}),
+			"orders_pending": p.st.stamp([]*walEntry{{walDel, k, nil}}),
+		}
+		db.Lock()
+		if err := db.logTx([]string{"orders_done", "orders_pending"}, []*Collection{d, p}, writes); err != nil {
+			t.Fatalf("logging: %s\n", err)
+		}
+		if _, err := d.st.commit(writes["orders_done"]); err != nil {
+			t.Fatalf("applying: %s\n", err)
+		}
+		db.Unlock()
+		crashDB(db)
+
+		db = openTestDB(t, dir, opts...)
+		p, _ = db.Collection("orders_pending")
+		d, _ = db.Collection("orders_done")
+		var o order
+		if err := d.Get(2, &o); err != nil || o.Item != "b" {
+			t.Fatalf("expected %q, got: %q, %v\n", "b", o.Item, err)
+		}
+		if p.Count() != 0 || d.Count() != 1 {
+			t.Fatalf("expected 0 and 1 records, got: %d and %d\n", p.Count(), d.Count())
+		}
+		// a torn transaction is thrown away
+		db.txlog.WriteAt([]byte{5, 0, 0}, 0)
+		crashDB(db)
+		db = openTestDB(t, dir, opts...)
+		if fi, _ := db.txlog.Stat(); fi.Size() != 0 {
+			t.Fatalf("expected an empty transaction log, got: %d bytes\n", fi.Size())
+		}
+		if err := CloseDB(db); err != nil {
+			t.Fatalf("closing: %s\n", err)
+		}
+	}
+}
+
+// test that logging a transaction leaves nothing of what was in the
+// log before it
+func Test_Tx_LogTruncates(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer CloseDB(db)
+	c, _ := db.Collection("orders")
+	db.txlog.WriteAt(make([]byte, 4096), 0)
+	k, v, _ := encodeKeyVal(1, order{1, "a"})
+	writes := map[string][]*walEntry{"orders": c.st.stamp([]*walEntry{{walSet, k, v}})}
+	db.Lock()
+	defer db.Unlock()
+	if err := db.logTx([]string{"orders"}, []*Collection{c}, writes); err != nil {
+		t.Fatalf("logging: %s\n", err)
+	}
+	if fi, _ := db.txlog.Stat(); fi.Size() >= 4096 {
+		t.Fatalf("expected just the transaction in the log, got: %d bytes\n", fi.Size())
+	}
+}
+
+// test that a transaction that fails part way through being applied is
+// never seen half applied, and is applied in full once the database is
+// reopened
+func Test_Tx_Failed(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	p, _ := db.Collection("orders_pending")
+	d, _ := db.Collection("orders_done")
+	p.Add(3, order{3, "c"})
+	// the second collection's part can't be logged
+	p.st.log.file.Close()
+	tx := db.Begin()
+	tx.Add("orders_done", 3, order{3, "c"})
+	tx.Del("orders_pending", 3)
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("expected the commit to fail\n")
+	}
+	var o order
+	if err := d.Get(3, &o); err != ErrTxFailed {
+		t.Fatalf("expected ErrTxFailed, got: %v\n", err)
+	}
+	if err := d.Set(4, order{4, "d"}); err != ErrTxFailed {
+		t.Fatalf("expected ErrTxFailed, got: %v\n", err)
+	}
+	if cur := d.Cursor(); cur.First() || cur.Err() != ErrTxFailed {
+		t.Fatalf("expected ErrTxFailed, got: %v\n", cur.Err())
+	}
+	if _, err := db.Collection("orders_done"); err != ErrTxFailed {
+		t.Fatalf("expected ErrTxFailed, got: %v\n", err)
+	}
+	tx = db.Begin()
+	tx.Set("orders_other", 1, order{1, "a"})
+	if err := tx.Commit(); err != ErrTxFailed {
+		t.Fatalf("expected ErrTxFailed, got: %v\n", err)
+	}
+	crashDB(db)
+
+	db = openTestDB(t, dir)
+	defer CloseDB(db)
+	p, _ = db.Collection("orders_pending")
+	d, _ = db.Collection("orders_done")
+	if err := d.Get(3, &o); err != nil || o.Item != "c" {
+		t.Fatalf("expected %q, got: %q, %v\n", "c", o.Item, err)
+	}
+	if p.Count() != 0 || d.Count() != 1 {
+		t.Fatalf("expected 0 and 1 records, got: %d and %d\n", p.Count(), d.Count())
+	}
+}
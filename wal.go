@@ -0,0 +1,353 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	walAdd byte = 0x01 // add record entry; val is version (8) + expiry (8) + val
+	walSet byte = 0x02 // set record entry; val is version (8) + expiry (8) + val
+	walDel byte = 0x03 // delete record entry
+	walBat byte = 0x04 // batch entry; val is the batch's entries, encoded one after another
+
+	walHdr    = 13 // op (1) + key length (4) + val length (4) + checksum (4)
+	walSetHdr = 16 // version (8) + expiry (8), ahead of the val of an add or set entry
+
+	walMaxSize = 4 << 20 // checkpoint once the log grows past 4MB
+)
+
+// wal is a write-ahead log of the mutations made to a store.
+// every add, set and del is appended to the log before it
+// touches the memory mapping, so after a crash any mutation that
+// may have been partially applied to the mapping can be replayed.
+// a checkpoint flushes the mapping to disk and truncates the log.
+// when the log itself is synced is up to the SyncPolicy of the
+// collection; by default it is synced before every mutation.
+type wal struct {
+	file   file       // underlying log file
+	size   int64      // current size of the log in bytes
+	crypt  *crypter   // seals the key and val of each entry, if not nil
+	policy SyncPolicy // when the log is synced
+
+	// group commits are synced and waited on without the collection
+	// being locked, so everything below is guarded by mu instead
+	mu       sync.Mutex
+	cond     *sync.Cond
+	seq      uint64      // number of entries logged
+	synced   uint64      // number of entries known to be on disk
+	flushing bool        // set while the log is being synced
+	timer    *time.Timer // pending group commit, if any
+	err      error       // error from the last sync, if it failed
+}
+
+// a single logged mutation
+type walEntry struct {
+	op  byte
+	key []byte
+	val []byte
+}
+
+// open (or create) the write-ahead log for the store at path. if
+// the collection is encrypted the key and val of each entry are
+// sealed. if it is read-only the log is only opened for reading, and
+// a missing log is treated as an empty one rather than created.
+func openWAL(path string, o *options) (*wal, error) {
+	ro := o.readOnly
+	flag := os.O_RDWR | os.O_CREATE
+	if ro {
+		flag = os.O_RDONLY
+	}
+	fd, err := o.fs.openFile(path+`.wal`, flag)
+	if ro && os.IsNotExist(err) {
+		return newWAL(nil, 0, o), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return newWAL(fd, info.Size(), o), nil
+}
+
+func newWAL(fd file, size int64, o *options) *wal {
+	w := &wal{file: fd, size: size, crypt: o.crypt, policy: o.sync}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// encode an entry; the checksum covers the whole entry
+func (e *walEntry) encode() []byte {
+	b := make([]byte, walHdr+len(e.key)+len(e.val))
+	b[0] = e.op
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(e.key)))
+	binary.BigEndian.PutUint32(b[5:9], uint32(len(e.val)))
+	copy(b[walHdr:], e.key)
+	copy(b[walHdr+len(e.key):], e.val)
+	binary.BigEndian.PutUint32(b[9:13], walChecksum(b))
+	return b
+}
+
+// the val of an add or set entry, for a record at version ver
+// expiring at exp
+func setEntryVal(ver uint64, exp int64, val []byte) []byte {
+	b := make([]byte, walSetHdr+len(val))
+	binary.BigEndian.PutUint64(b[0:8], ver)
+	binary.BigEndian.PutUint64(b[8:16], uint64(exp))
+	copy(b[walSetHdr:], val)
+	return b
+}
+
+// checksum an encoded entry, skipping over the checksum field itself
+func walChecksum(b []byte) uint32 {
+	crc := crc32.ChecksumIEEE(b[:9])
+	return crc32.Update(crc, crc32.IEEETable, b[walHdr:])
+}
+
+// log appends an entry to the log and, depending on the sync policy,
+// syncs it to disk. it must return before the mutation is applied to
+// the mapping. with group commit the entry is not synced yet; wait
+// must be called with the returned sequence number (once the
+// collection has been unlocked) before the mutation is reported done.
+func (w *wal) log(op byte, key, val []byte) (uint64, error) {
+	if w.crypt != nil {
+		// the nonce is derived from the offset of the entry
+		key = w.crypt.seal(sealEntry, int(w.size), key)
+		val = w.crypt.seal(sealEntry, int(w.size)+1, val)
+	}
+	b := (&walEntry{op, key, val}).encode()
+	if _, err := w.file.WriteAt(b, w.size); err != nil {
+		return 0, fmt.Errorf("wal[log]: error writing entry -> %s", err)
+	}
+	w.size += int64(len(b))
+	w.mu.Lock()
+	w.seq++
+	seq, waiting := w.seq, int(w.seq-w.synced)
+	if w.policy.mode == syncGroup && w.timer == nil {
+		// sync this entry (and any that join it) before long
+		w.timer = time.AfterFunc(w.policy.interval, func() { w.flush() })
+	}
+	w.mu.Unlock()
+	switch {
+	case w.policy.mode == syncAlways,
+		w.policy.mode == syncGroup && w.policy.writes > 0 && waiting >= w.policy.writes:
+		if err := w.flush(); err != nil {
+			return 0, fmt.Errorf("wal[log]: error syncing entry -> %s", err)
+		}
+	}
+	return seq, nil
+}
+
+// flush syncs every entry logged so far. only one sync runs at a time;
+// anyone else flushing meanwhile waits for it, then syncs whatever was
+// logged since, if anything.
+func (w *wal) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.flushing {
+		w.cond.Wait()
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.file == nil || w.synced == w.seq {
+		return nil
+	}
+	w.flushing = true
+	seq := w.seq
+	w.mu.Unlock()
+	err := w.file.Sync()
+	w.mu.Lock()
+	w.flushing = false
+	switch {
+	case err == nil:
+		w.err = nil
+		if seq > w.synced {
+			w.synced = seq
+		}
+	case w.synced < seq:
+		w.err = err
+	default:
+		err = nil // a checkpoint synced everything meanwhile
+	}
+	w.cond.Broadcast()
+	return err
+}
+
+// wait blocks until the entry with sequence number seq has been synced
+// by a group commit. it returns straight away under any other policy.
+func (w *wal) wait(seq uint64) error {
+	if w.policy.mode != syncGroup {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.synced < seq && w.err == nil {
+		w.cond.Wait()
+	}
+	if w.synced < seq {
+		return fmt.Errorf("wal[wait]: error syncing entry -> %s", w.err)
+	}
+	return nil
+}
+
+// sync the log on request, unless the policy is to never sync it
+func (w *wal) sync() error {
+	if w.policy.mode == syncNever {
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		return fmt.Errorf("wal[sync]: error syncing log -> %s", err)
+	}
+	return nil
+}
+
+// entries reads every complete entry in the log. reading stops at
+// the first entry that is short or fails its checksum; that entry
+// (and anything after it) was never fully logged, so it was never
+// applied to the mapping and is rolled back by truncating it away.
+func (w *wal) entries() ([]*walEntry, error) {
+	var ents []*walEntry
+	var off int64
+	hdr := make([]byte, walHdr)
+	for {
+		if _, err := w.file.ReadAt(hdr, off); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		klen := int64(binary.BigEndian.Uint32(hdr[1:5]))
+		vlen := int64(binary.BigEndian.Uint32(hdr[5:9]))
+		if off+walHdr+klen+vlen > w.size {
+			break // torn entry
+		}
+		b := make([]byte, walHdr+klen+vlen)
+		if _, err := w.file.ReadAt(b, off); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(b[9:13]) != walChecksum(b) {
+			break // torn entry
+		}
+		ent := &walEntry{
+			op:  b[0],
+			key: b[walHdr : walHdr+klen],
+			val: b[walHdr+klen:],
+		}
+		if w.crypt != nil {
+			var err error
+			if ent.key, err = w.crypt.open(sealEntry, int(off), ent.key); err != nil {
+				return nil, err
+			}
+			if ent.val, err = w.crypt.open(sealEntry, int(off)+1, ent.val); err != nil {
+				return nil, err
+			}
+		}
+		ents = append(ents, ent)
+		off += int64(len(b))
+	}
+	// roll back anything past the last complete entry
+	if off < w.size {
+		if err := w.file.Truncate(off); err != nil {
+			return nil, err
+		}
+		w.size = off
+	}
+	return ents, nil
+}
+
+// replay re-applies every complete entry in the log to the index.
+// entries are applied so that replaying one that had already made
+// it into the mapping leaves the store unchanged.
+func (w *wal) replay(t *btree) error {
+	ents, err := w.entries()
+	if err != nil {
+		return fmt.Errorf("wal[replay]: error reading log -> %s", err)
+	}
+	for _, ent := range ents {
+		if err := ent.apply(t); err != nil {
+			return fmt.Errorf("wal[replay]: error applying entry -> %s", err)
+		}
+	}
+	return nil
+}
+
+// apply an entry to the index
+func (e *walEntry) apply(t *btree) error {
+	switch e.op {
+	case walAdd, walSet:
+		if len(e.val) < walSetHdr {
+			return fmt.Errorf("short set entry")
+		}
+		ver, exp := binary.BigEndian.Uint64(e.val[0:8]), int64(binary.BigEndian.Uint64(e.val[8:16]))
+		return t.set(e.key, e.val[walSetHdr:], exp, ver)
+	case walDel:
+		ok, err := t.has(e.key)
+		if err != nil || !ok {
+			return err
+		}
+		return t.del(e.key)
+	case walBat:
+		ents, err := decodeBatch(e.val)
+		if err != nil {
+			return err
+		}
+		for _, ent := range ents {
+			if err := ent.apply(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown op %#x", e.op)
+}
+
+// checkpoint flushes the mapping to disk and truncates the log
+func (w *wal) checkpoint(t *btree) error {
+	if err := t.ngin.sync(); err != nil {
+		return fmt.Errorf("wal[checkpoint]: error syncing engine -> %s", err)
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("wal[checkpoint]: error truncating log -> %s", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("wal[checkpoint]: error syncing log -> %s", err)
+	}
+	w.size = 0
+	// everything logged is now on disk in the data file
+	w.mu.Lock()
+	w.synced, w.err = w.seq, nil
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	return nil
+}
+
+// close the log file
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.flushing {
+		w.cond.Wait()
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.file == nil {
+		return nil
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	return nil
+}
@@ -0,0 +1,103 @@
+package godb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// test that entries read back from the log as they were logged, and
+// that reading stops at the first one that fails its checksum
+func Test_WAL_Entries(t *testing.T) {
+	f := &memFile{name: "test.wal"}
+	w := newWAL(f, 0, newOptions(nil))
+	logged := []*walEntry{
+		{walAdd, []byte("a"), setEntryVal(1, 0, []byte("one"))},
+		{walSet, []byte("b"), setEntryVal(2, 0, []byte("two"))},
+		{walDel, []byte("a"), nil},
+	}
+	for _, ent := range logged {
+		if _, err := w.log(ent.op, ent.key, ent.val); err != nil {
+			t.Fatalf("logging: %s\n", err)
+		}
+	}
+	ents, err := w.entries()
+	if err != nil {
+		t.Fatalf("reading entries: %s\n", err)
+	}
+	if len(ents) != len(logged) {
+		t.Fatalf("expected %d entries, got: %d\n", len(logged), len(ents))
+	}
+	for i, ent := range ents {
+		if ent.op != logged[i].op || !bytes.Equal(ent.key, logged[i].key) || !bytes.Equal(ent.val, logged[i].val) {
+			t.Fatalf("expected entry %d to be %v, got: %v\n", i, logged[i], ent)
+		}
+	}
+	// flip a bit in the val of the second entry
+	off := int64(len(logged[0].encode()))
+	f.WriteAt([]byte{0xFF}, off+walHdr+1+3)
+	if ents, err = w.entries(); err != nil || len(ents) != 1 {
+		t.Fatalf("expected 1 entry, got: %d, %v\n", len(ents), err)
+	}
+	if w.size != off {
+		t.Fatalf("expected the log to be cut to %d bytes, got: %d\n", off, w.size)
+	}
+}
+
+// test that entries left in the log by a crash are applied when the
+// collection is next opened, and that the log is then emptied
+func Test_WAL_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	c := openTestCollection(t, path)
+	c.Add("a", 1)
+	// log a set and a del without applying them, then crash
+	b, v, _ := encodeKeyVal("b", 2)
+	a, _ := genKey("a")
+	ver := c.st.idx.ngin.version() + 1
+	c.st.log.log(walSet, b, setEntryVal(ver, 0, v))
+	c.st.log.log(walDel, a, nil)
+	crashCollection(c)
+
+	c = openTestCollection(t, path)
+	defer c.Close()
+	var n int
+	if err := c.Get("b", &n); err != nil || n != 2 {
+		t.Fatalf("expected 2, got: %d, %v\n", n, err)
+	}
+	if err := c.Get("a", &n); err == nil {
+		t.Fatalf("expected the logged del to be applied\n")
+	}
+	if got, _ := c.GetWithVersion("b", &n); got != ver {
+		t.Fatalf("expected version %d, got: %d\n", ver, got)
+	}
+	if fi, _ := os.Stat(path + ".wal"); fi.Size() != 0 {
+		t.Fatalf("expected an empty log, got: %d bytes\n", fi.Size())
+	}
+}
+
+// test that an entry only partly written when the collection crashed
+// is thrown away, along with its write
+func Test_WAL_Torn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	c := openTestCollection(t, path)
+	b, bv, _ := encodeKeyVal("b", 2)
+	d, dv, _ := encodeKeyVal("d", 4)
+	c.st.log.log(walSet, b, setEntryVal(1, 0, bv))
+	c.st.log.log(walSet, d, setEntryVal(2, 0, dv))
+	size := c.st.log.size
+	crashCollection(c)
+	if err := os.Truncate(path+".wal", size-3); err != nil {
+		t.Fatalf("truncating log: %s\n", err)
+	}
+
+	c = openTestCollection(t, path)
+	defer c.Close()
+	var n int
+	if err := c.Get("b", &n); err != nil || n != 2 {
+		t.Fatalf("expected 2, got: %d, %v\n", n, err)
+	}
+	if err := c.Get("d", &n); err == nil {
+		t.Fatalf("expected the torn entry to be thrown away\n")
+	}
+}